@@ -3,6 +3,7 @@ module github.com/anant/realtime-pair-programming
 go 1.21
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/aws/aws-sdk-go-v2 v1.24.0
 	github.com/aws/aws-sdk-go-v2/config v1.26.1
 	github.com/aws/aws-sdk-go-v2/credentials v1.16.12
@@ -14,6 +15,8 @@ require (
 	github.com/google/uuid v1.5.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/joho/godotenv v1.5.1
+	github.com/redis/go-redis/v9 v9.5.1
+	go.etcd.io/bbolt v1.3.10
 	golang.org/x/crypto v0.18.0
 )
 
@@ -30,6 +33,14 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.21.5 
 	github.com/aws/aws-sdk-go-v2/service/sts v1.26.5 
 	github.com/aws/smithy-go v1.19.0 
+	github.com/cespare/xxhash/v2 v2.2.0 
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f 
 	github.com/jmespath/go-jmespath v0.4.0 
 	golang.org/x/net v0.17.0 
+	golang.org/x/sys v0.16.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 )
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// APITokenPrefix starts every personal API token, telling them apart from
+// access tokens and making leaked ones easy to scan for.
+const APITokenPrefix = "pat_"
+
+// apiTokenTouchInterval limits how often a token's last use is written.
+const apiTokenTouchInterval = time.Minute
+
+// ErrInvalidToken is returned for credentials that are malformed, unknown
+// or expired, as opposed to failures looking them up.
+var ErrInvalidToken = errors.New("invalid token")
+
+type APITokens interface {
+	GetAPIToken(ctx context.Context, userID, tokenID string) (*models.APIToken, error)
+	TouchAPIToken(ctx context.Context, userID, tokenID string, usedAt time.Time) error
+}
+
+type Users interface {
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+}
+
+// Verifier checks the bearer tokens requests are made with: access tokens
+// against revocations and sessions, personal API tokens against the store.
+type Verifier struct {
+	Sessions  Sessions
+	APITokens APITokens
+	Users     Users
+}
+
+func NewVerifier(sessions Sessions, apiTokens APITokens, users Users) *Verifier {
+	return &Verifier{Sessions: sessions, APITokens: apiTokens, Users: users}
+}
+
+// Verify returns the claims a token acts with and, for API tokens, the
+// scopes it is limited to. Scopes are nil for access tokens, which can do
+// anything their user can.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, []string, error) {
+	if strings.HasPrefix(token, APITokenPrefix) {
+		return v.verifyAPIToken(ctx, token)
+	}
+
+	claims, err := ValidateToken(token)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	if err := CheckRevoked(ctx, v.Sessions, claims); err != nil {
+		return nil, nil, err
+	}
+	return claims, nil, nil
+}
+
+func (v *Verifier) verifyAPIToken(ctx context.Context, token string) (*Claims, []string, error) {
+	userID, tokenID, hash, err := parseAPIToken(token)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	apiToken, err := v.APITokens.GetAPIToken(ctx, userID, tokenID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if !SameHash(apiToken.TokenHash, hash) || !now.Before(apiToken.ExpiresAt) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := v.Users.GetUser(ctx, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) >= apiTokenTouchInterval {
+		if err := v.APITokens.TouchAPIToken(ctx, userID, tokenID, now); err != nil {
+			log.Printf("Error recording API token use: %v", err)
+		}
+	}
+
+	claims := &Claims{
+		UserID:   user.UserID,
+		Username: user.Username,
+		Email:    user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(apiToken.ExpiresAt),
+		},
+	}
+	return claims, apiToken.Scopes, nil
+}
+
+// NewAPIToken returns a fresh API token along with the hash to store in
+// its place. Like refresh tokens, it names the user and token it belongs to.
+func NewAPIToken(userID, tokenID string) (string, string, error) {
+	token, hash, err := NewUserToken()
+	if err != nil {
+		return "", "", err
+	}
+	return APITokenPrefix + userID + "." + tokenID + "." + token, hash, nil
+}
+
+func parseAPIToken(token string) (userID, tokenID, hash string, err error) {
+	parts := strings.Split(strings.TrimPrefix(token, APITokenPrefix), ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", ErrInvalidToken
+	}
+	return parts[0], parts[1], hashSecret(parts[2]), nil
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MaxTokenLifetime bounds how long any token we sign stays valid. A key
+// that has been replaced keeps verifying for this long after its
+// successor takes over, so nothing it signed is cut short.
+const MaxTokenLifetime = 30 * 24 * time.Hour
+
+// SigningKey is one entry of the key set. It signs tokens from ActiveFrom
+// until a newer key becomes active.
+type SigningKey struct {
+	ID         string
+	ActiveFrom time.Time
+	Method     jwt.SigningMethod
+	Private    crypto.Signer
+}
+
+// keys is ordered by ActiveFrom and set once at startup by LoadKeys.
+var keys []*SigningKey
+
+// keyManifest is the file named by JWT_KEYS_FILE. Key paths are relative
+// to the manifest.
+type keyManifest struct {
+	Keys []struct {
+		ID         string    `json:"kid"`
+		Path       string    `json:"path"`
+		ActiveFrom time.Time `json:"activeFrom"`
+	} `json:"keys"`
+}
+
+// LoadKeys reads the key manifest and the PEM encoded private keys it
+// lists. RSA keys sign with RS256 and Ed25519 keys with EdDSA. It fails
+// unless some key is active right now.
+func LoadKeys(manifestPath string) error {
+	if manifestPath == "" {
+		return errors.New("no signing keys configured, set JWT_KEYS_FILE")
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest keyManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("parsing %s: %w", manifestPath, err)
+	}
+
+	loaded := make([]*SigningKey, 0, len(manifest.Keys))
+	seen := make(map[string]bool)
+	for _, entry := range manifest.Keys {
+		if entry.ID == "" || seen[entry.ID] {
+			return fmt.Errorf("key %q: kid must be set and unique", entry.ID)
+		}
+		seen[entry.ID] = true
+
+		path := entry.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(manifestPath), path)
+		}
+		key, err := readPrivateKey(path)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", entry.ID, err)
+		}
+		loaded = append(loaded, &SigningKey{
+			ID:         entry.ID,
+			ActiveFrom: entry.ActiveFrom,
+			Method:     signingMethod(key),
+			Private:    key,
+		})
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].ActiveFrom.Before(loaded[j].ActiveFrom)
+	})
+
+	if len(loaded) == 0 || loaded[0].ActiveFrom.After(time.Now()) {
+		return errors.New("no signing key is active yet")
+	}
+	keys = loaded
+	return nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+}
+
+func signingMethod(key crypto.Signer) jwt.SigningMethod {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// signingKey is the newest key that is already active.
+func signingKey(now time.Time) *SigningKey {
+	var current *SigningKey
+	for _, key := range keys {
+		if key.ActiveFrom.After(now) {
+			break
+		}
+		current = key
+	}
+	return current
+}
+
+// verificationKeys are all keys except those retired for good. Keys that
+// are not active yet are included so nodes whose clocks run ahead can
+// already be verified.
+func verificationKeys(now time.Time) []*SigningKey {
+	var valid []*SigningKey
+	for i, key := range keys {
+		if i+1 < len(keys) && now.After(keys[i+1].ActiveFrom.Add(MaxTokenLifetime)) {
+			continue
+		}
+		valid = append(valid, key)
+	}
+	return valid
+}
+
+func sign(claims jwt.Claims) (string, error) {
+	key := signingKey(time.Now())
+	if key == nil {
+		return "", errors.New("no signing key available")
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+func parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append(opts, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range verificationKeys(time.Now()) {
+			if key.ID == kid && key.Method.Alg() == token.Method.Alg() {
+				return key.Private.Public(), nil
+			}
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}, opts...)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKeys returns the public half of every key that still verifies,
+// for other services checking our tokens.
+func PublicKeys() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range verificationKeys(time.Now()) {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -2,7 +2,10 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"log"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -10,8 +13,21 @@ type contextKey string
 
 const UserIDKey contextKey = "userId"
 const UsernameKey contextKey = "username"
+const ClaimsKey contextKey = "claims"
 
-func Middleware(next http.Handler) http.Handler {
+// ScopesKey holds the scopes of the API token a request was made with. It
+// is unset for requests made with an access token.
+const ScopesKey contextKey = "scopes"
+
+// Middleware authenticates requests with a bearer access token or personal
+// API token, turning away tokens that have been revoked.
+func Middleware(verifier *Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return authenticate(verifier, next)
+	}
+}
+
+func authenticate(verifier *Verifier, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -25,15 +41,48 @@ func Middleware(next http.Handler) http.Handler {
 			return
 		}
 
-		claims, err := ValidateToken(parts[1])
+		claims, scopes, err := verifier.Verify(r.Context(), parts[1])
 		if err != nil {
+			if !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrRevoked) {
+				log.Printf("Error verifying token: %v", err)
+			}
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
 		ctx = context.WithValue(ctx, UsernameKey, claims.Username)
-		
+		ctx = context.WithValue(ctx, ClaimsKey, claims)
+		if scopes != nil {
+			ctx = context.WithValue(ctx, ScopesKey, scopes)
+		}
+
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RequireScope turns away requests made with an API token that lacks
+// scope. Access tokens always pass.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if scopes, ok := r.Context().Value(ScopesKey).([]string); ok && !slices.Contains(scopes, scope) {
+				http.Error(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession turns away requests made with an API token, for account
+// management that only a logged in user may do, such as creating tokens.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(ScopesKey).([]string); ok {
+			http.Error(w, "API tokens cannot be used here", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
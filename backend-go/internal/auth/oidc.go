@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcStateAudience marks the tokens that carry an OIDC login between the
+// redirect to the provider and the callback.
+const oidcStateAudience = "oidc-state"
+
+// OIDCStateTTL is how long a user has to finish logging in at the provider.
+const OIDCStateTTL = 10 * time.Minute
+
+// OIDCStateClaims hold what the callback needs to finish a login. They
+// live in a cookie on the user's browser, so the server keeps no state.
+type OIDCStateClaims struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func GenerateOIDCStateToken(state, nonce, verifier string) (string, error) {
+	now := time.Now()
+	claims := &OIDCStateClaims{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{oidcStateAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(OIDCStateTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return sign(claims)
+}
+
+func ValidateOIDCStateToken(tokenString string) (*OIDCStateClaims, error) {
+	token, err := parse(tokenString, &OIDCStateClaims{}, jwt.WithAudience(oidcStateAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*OIDCStateClaims)
+	if !ok || !token.Valid || claims.State == "" || claims.Nonce == "" || claims.Verifier == "" {
+		return nil, errors.New("invalid OIDC state token")
+	}
+	return claims, nil
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RefreshTokenTTL is how long a session lasts without being refreshed.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrRevoked             = errors.New("token has been revoked")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+)
+
+// Sessions is the server-side state access tokens are checked against.
+type Sessions interface {
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	SessionActive(ctx context.Context, userID, sessionID string) (bool, error)
+}
+
+// CheckRevoked fails for access tokens revoked by jti or whose session has
+// been logged out. Tokens issued before sessions existed name no session
+// and are only checked by jti.
+func CheckRevoked(ctx context.Context, sessions Sessions, claims *Claims) error {
+	if claims.ID != "" {
+		revoked, err := sessions.IsTokenRevoked(ctx, claims.ID)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return ErrRevoked
+		}
+	}
+	if claims.SessionID != "" {
+		active, err := sessions.SessionActive(ctx, claims.UserID, claims.SessionID)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return ErrRevoked
+		}
+	}
+	return nil
+}
+
+// NewRefreshToken returns a fresh refresh token for a session along with
+// the hash to store in its place.
+func NewRefreshToken(userID, sessionID string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return userID + "." + sessionID + "." + encoded, hashSecret(encoded), nil
+}
+
+// ParseRefreshToken splits a refresh token into the user and session it
+// belongs to and the hash of its secret.
+func ParseRefreshToken(token string) (userID, sessionID, hash string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+	return parts[0], parts[1], hashSecret(parts[2]), nil
+}
+
+// SameHash compares token hashes in constant time.
+func SameHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// NewUserToken returns a random single-use token, such as a password reset
+// token, along with the hash to store in its place.
+func NewUserToken() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashSecret(token), nil
+}
+
+// HashUserToken returns the hash a user token is stored under.
+func HashUserToken(token string) string {
+	return hashSecret(token)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
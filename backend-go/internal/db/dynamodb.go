@@ -13,11 +13,24 @@ import (
 )
 
 type DynamoDB struct {
-	Client        *dynamodb.Client
-	UsersTable    string
-	RoomsTable    string
-	MessagesTable string
-	CodeSyncTable string
+	Client          *dynamodb.Client
+	UsersTable      string
+	IdentitiesTable string
+	RoomsTable      string
+	MessagesTable   string
+	CodeSyncTable   string
+	VersionsTable   string
+	FilesTable      string
+	InvitesTable    string
+	SessionsTable   string
+	RevokedTable    string
+	UserTokensTable string
+	AttemptsTable   string
+	AuditTable      string
+	APITokensTable  string
+	UserRoomsTable  string
+
+	created map[string]bool
 }
 
 func NewDynamoDB() (*DynamoDB, error) {
@@ -40,17 +53,31 @@ func NewDynamoDB() (*DynamoDB, error) {
 	client := dynamodb.NewFromConfig(cfg)
 
 	db := &DynamoDB{
-		Client:        client,
-		UsersTable:    os.Getenv("DYNAMO_USERS_TABLE"),
-		RoomsTable:    os.Getenv("DYNAMO_ROOMS_TABLE"),
-		MessagesTable: os.Getenv("DYNAMO_MESSAGES_TABLE"),
-		CodeSyncTable: os.Getenv("DYNAMO_CODESYNC_TABLE"),
+		Client:          client,
+		UsersTable:      os.Getenv("DYNAMO_USERS_TABLE"),
+		IdentitiesTable: envOr("DYNAMO_IDENTITIES_TABLE", "UserIdentities"),
+		RoomsTable:      os.Getenv("DYNAMO_ROOMS_TABLE"),
+		MessagesTable:   os.Getenv("DYNAMO_MESSAGES_TABLE"),
+		CodeSyncTable:   os.Getenv("DYNAMO_CODESYNC_TABLE"),
+		VersionsTable:   envOr("DYNAMO_VERSIONS_TABLE", "CodeVersions"),
+		FilesTable:      envOr("DYNAMO_FILES_TABLE", "WorkspaceFiles"),
+		InvitesTable:    envOr("DYNAMO_INVITES_TABLE", "RoomInvites"),
+		SessionsTable:   envOr("DYNAMO_SESSIONS_TABLE", "Sessions"),
+		RevokedTable:    envOr("DYNAMO_REVOKED_TABLE", "RevokedTokens"),
+		UserTokensTable: envOr("DYNAMO_USER_TOKENS_TABLE", "UserTokens"),
+		AttemptsTable:   envOr("DYNAMO_LOGIN_ATTEMPTS_TABLE", "LoginAttempts"),
+		AuditTable:      envOr("DYNAMO_AUDIT_TABLE", "AuditLog"),
+		APITokensTable:  envOr("DYNAMO_API_TOKENS_TABLE", "APITokens"),
+		UserRoomsTable:  envOr("DYNAMO_USER_ROOMS_TABLE", "UserRooms"),
 	}
 
 	log.Printf("DynamoDB client initialized (Region: %s)", region)
 	return db, nil
 }
 
+// EnsureTablesExist creates missing tables, and adds any global secondary
+// indexes an existing table lacks. DynamoDB builds new indexes in the
+// background, so queries against them fail until they are active.
 func (db *DynamoDB) EnsureTablesExist(ctx context.Context) error {
 	tables := []struct {
 		Name string
@@ -83,6 +110,15 @@ func (db *DynamoDB) EnsureTablesExist(ctx context.Context) error {
 				},
 			},
 		},
+		{
+			Name: db.IdentitiesTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("identity"), KeyType: types.KeyTypeHash},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("identity"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
 		{
 			Name: db.RoomsTable,
 			Key: []types.KeySchemaElement{
@@ -90,6 +126,24 @@ func (db *DynamoDB) EnsureTablesExist(ctx context.Context) error {
 			},
 			Attr: []types.AttributeDefinition{
 				{AttributeName: aws.String("roomId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("listing"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("lastActivity"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			GSI: []types.GlobalSecondaryIndex{
+				{
+					IndexName: aws.String("PublicRoomsIndex"),
+					KeySchema: []types.KeySchemaElement{
+						{AttributeName: aws.String("listing"), KeyType: types.KeyTypeHash},
+						{AttributeName: aws.String("lastActivity"), KeyType: types.KeyTypeRange},
+					},
+					Projection: &types.Projection{
+						ProjectionType: types.ProjectionTypeAll,
+					},
+					ProvisionedThroughput: &types.ProvisionedThroughput{
+						ReadCapacityUnits:  aws.Int64(1),
+						WriteCapacityUnits: aws.Int64(1),
+					},
+				},
 			},
 		},
 		{
@@ -112,6 +166,110 @@ func (db *DynamoDB) EnsureTablesExist(ctx context.Context) error {
 				{AttributeName: aws.String("roomId"), AttributeType: types.ScalarAttributeTypeS},
 			},
 		},
+		{
+			Name: db.VersionsTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("roomId"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("versionId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("roomId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("versionId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.FilesTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("roomId"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("fileId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("roomId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("fileId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.InvitesTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("roomId"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("inviteId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("roomId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("inviteId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.SessionsTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("userId"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("sessionId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("userId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("sessionId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.RevokedTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("jti"), KeyType: types.KeyTypeHash},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("jti"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.UserTokensTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("tokenHash"), KeyType: types.KeyTypeHash},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("tokenHash"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.AttemptsTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("attemptKey"), KeyType: types.KeyTypeHash},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("attemptKey"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.AuditTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("scope"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("entryId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("scope"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("entryId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.APITokensTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("userId"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("tokenId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("userId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("tokenId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
+		{
+			Name: db.UserRoomsTable,
+			Key: []types.KeySchemaElement{
+				{AttributeName: aws.String("userId"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("roomId"), KeyType: types.KeyTypeRange},
+			},
+			Attr: []types.AttributeDefinition{
+				{AttributeName: aws.String("userId"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("roomId"), AttributeType: types.ScalarAttributeTypeS},
+			},
+		},
 	}
 
 	listTables, err := db.Client.ListTables(ctx, &dynamodb.ListTablesInput{})
@@ -124,9 +282,13 @@ func (db *DynamoDB) EnsureTablesExist(ctx context.Context) error {
 		existingTables[name] = true
 	}
 
+	db.created = make(map[string]bool)
 	for _, table := range tables {
 		if existingTables[table.Name] {
 			log.Printf("Table %s already exists", table.Name)
+			if err := db.ensureIndexes(ctx, table.Name, table.Attr, table.GSI); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -144,8 +306,63 @@ func (db *DynamoDB) EnsureTablesExist(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
+		db.created[table.Name] = true
 		log.Printf("Table %s created successfully", table.Name)
 	}
 
 	return nil
 }
+
+// Created reports whether the last EnsureTablesExist created table, as
+// opposed to finding it already there.
+func (db *DynamoDB) Created(table string) bool {
+	return db.created[table]
+}
+
+func (db *DynamoDB) ensureIndexes(ctx context.Context, table string, attrs []types.AttributeDefinition, indexes []types.GlobalSecondaryIndex) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	described, err := db.Client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(table),
+	})
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, index := range described.Table.GlobalSecondaryIndexes {
+		existing[aws.ToString(index.IndexName)] = true
+	}
+	for _, index := range indexes {
+		if existing[aws.ToString(index.IndexName)] {
+			continue
+		}
+
+		log.Printf("📦 Adding index %s to table %s...", aws.ToString(index.IndexName), table)
+		// DynamoDB accepts one new index per call.
+		_, err := db.Client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            aws.String(table),
+			AttributeDefinitions: attrs,
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+				{Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:             index.IndexName,
+					KeySchema:             index.KeySchema,
+					Projection:            index.Projection,
+					ProvisionedThroughput: index.ProvisionedThroughput,
+				}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/mail"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+// VerifyEmail marks the email of the user a verification token was sent
+// to as verified.
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token, ok := h.consumeUserToken(w, req.Token, models.TokenPurposeVerifyEmail)
+	if !ok {
+		return
+	}
+	if err := h.Users.SetEmailVerified(context.TODO(), token.UserID); err != nil {
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s verified their email", token.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendVerification mails the caller a new verification link.
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	user, err := h.Users.GetUser(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+	if err := h.sendVerification(user); err != nil {
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ForgotPassword mails a password reset link. It answers the same whether
+// or not the email belongs to an account, so it cannot be used to find
+// out who has signed up.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.Users.GetUserByEmail(context.TODO(), req.Email)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		err = h.sendUserToken(user, models.TokenPurposeResetPassword, resetPasswordTTL, "reset-password",
+			"Reset your password",
+			"Someone asked to reset the password for your account. If it was you, set a new password here:\n\n%s\n\nThe link expires in 1 hour. If you did not ask for this, you can ignore this email.")
+		if err != nil {
+			http.Error(w, "Error sending reset email", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password using a reset token. Every session of
+// the user is ended, since whoever knew the old password may be logged in.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "Password is required", http.StatusBadRequest)
+		return
+	}
+
+	token, ok := h.consumeUserToken(w, req.Token, models.TokenPurposeResetPassword)
+	if !ok {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error processing password", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Users.UpdatePassword(context.TODO(), token.UserID, string(hashedPassword)); err != nil {
+		http.Error(w, "Error saving password", http.StatusInternalServerError)
+		return
+	}
+	// The reset link arrived by email, which proves the address works.
+	h.Users.SetEmailVerified(context.TODO(), token.UserID)
+	if err := h.Sessions.DeleteUserSessions(context.TODO(), token.UserID); err != nil {
+		log.Printf("Error ending sessions after password reset: %v", err)
+	}
+
+	log.Printf("User %s reset their password", token.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentUser loads the caller, writing the error response if that fails.
+func (h *AuthHandler) currentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	user, err := h.Users.GetUser(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// confirmPassword checks the password a signed in user re-entered for a
+// sensitive change, writing the error response if it is wrong. Wrong
+// guesses are throttled like failed logins.
+func (h *AuthHandler) confirmPassword(w http.ResponseWriter, r *http.Request, user *models.User, password string) bool {
+	keys := loginKeys(r, user.Email)
+	wait, err := h.loginWait(keys)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password)); err != nil {
+		if wait := h.recordLoginFailure(r, keys, user.UserID); wait > 0 {
+			setRetryAfter(w, wait)
+		}
+		http.Error(w, "Incorrect password", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// consumeUserToken redeems a token for purpose, writing the error response
+// if it is unknown, already used, expired or meant for something else.
+func (h *AuthHandler) consumeUserToken(w http.ResponseWriter, raw, purpose string) (*models.UserToken, bool) {
+	if raw == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	token, err := h.UserTokens.ConsumeUserToken(context.TODO(), auth.HashUserToken(raw))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Invalid or already used token", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if token.Purpose != purpose || !time.Now().Before(token.ExpiresAt) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return nil, false
+	}
+	return token, true
+}
+
+func (h *AuthHandler) sendVerification(user *models.User) error {
+	return h.sendUserToken(user, models.TokenPurposeVerifyEmail, verifyEmailTTL, "verify-email",
+		"Verify your email",
+		"Welcome! Please confirm your email address by opening this link:\n\n%s\n\nThe link expires in 48 hours.")
+}
+
+// sendUserToken stores a new single-use token and mails the user a link to
+// page on the frontend carrying it. The body is a format string for the
+// link. Mail is sent in the background so responses do not wait on the
+// mail server.
+func (h *AuthHandler) sendUserToken(user *models.User, purpose string, ttl time.Duration, page, subject, body string) error {
+	raw, hash, err := auth.NewUserToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	token := models.UserToken{
+		TokenHash: hash,
+		Purpose:   purpose,
+		UserID:    user.UserID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := h.UserTokens.CreateUserToken(context.TODO(), &token); err != nil {
+		return err
+	}
+
+	link := h.AppURL + "/" + page + "?" + url.Values{"token": {raw}}.Encode()
+	msg := mail.Message{To: user.Email, Subject: subject, Body: fmt.Sprintf(body, link)}
+	go func() {
+		if err := h.Mailer.Send(context.Background(), msg); err != nil {
+			log.Printf("Error sending %s email to user %s: %v", purpose, user.UserID, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAPITokenExpiry = 90 * 24 * time.Hour
+	maxAPITokenExpiry     = 365 * 24 * time.Hour
+	maxAPITokenName       = 100
+)
+
+// APITokenHandler manages the caller's personal API tokens.
+type APITokenHandler struct {
+	APITokens store.APITokenStore
+}
+
+func NewAPITokenHandler(s *store.Store) *APITokenHandler {
+	return &APITokenHandler{APITokens: s.APITokens}
+}
+
+// CreateAPIToken issues a token. Its secret is in the response and cannot
+// be retrieved again.
+func (h *APITokenHandler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	var req models.CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenName {
+		http.Error(w, "name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APITokenScopes, scope) {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	expiry := defaultAPITokenExpiry
+	if req.ExpiresIn != 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+		if expiry <= 0 || expiry > maxAPITokenExpiry {
+			http.Error(w, "expiresIn must be between 1 second and 365 days", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	tokenID := uuid.New().String()
+	raw, hash, err := auth.NewAPIToken(userID, tokenID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	token := models.APIToken{
+		UserID:    userID,
+		TokenID:   tokenID,
+		Name:      req.Name,
+		Scopes:    scopes,
+		TokenHash: hash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiry),
+	}
+	if err := h.APITokens.CreateAPIToken(context.TODO(), &token); err != nil {
+		http.Error(w, "Error saving token", http.StatusInternalServerError)
+		return
+	}
+	token.Token = raw
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// ListAPITokens returns the caller's tokens, oldest first, without their
+// secrets.
+func (h *APITokenHandler) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	tokens, err := h.APITokens.ListAPITokens(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, "Error fetching tokens", http.StatusInternalServerError)
+		return
+	}
+	if tokens == nil {
+		tokens = []models.APIToken{}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *APITokenHandler) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	err := h.APITokens.DeleteAPIToken(context.TODO(), userID, chi.URLParam(r, "tokenId"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
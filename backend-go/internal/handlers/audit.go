@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/google/uuid"
+)
+
+// recordAudit stores an audit entry, stamping its ID and time. Failures are
+// logged rather than failing the request being audited.
+func recordAudit(audit store.AuditStore, entry models.AuditEntry) {
+	now := time.Now()
+	entry.EntryID = fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.New().String()[:8])
+	entry.CreatedAt = now
+	if err := audit.AddAuditEntry(context.TODO(), &entry); err != nil {
+		log.Printf("Error writing audit entry %s: %v", entry.Action, err)
+	}
+}
@@ -3,26 +3,43 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	netmail "net/mail"
+	"strings"
 	"time"
 
 	"github.com/anant/realtime-pair-programming/internal/auth"
-	"github.com/anant/realtime-pair-programming/internal/db"
+	"github.com/anant/realtime-pair-programming/internal/mail"
 	"github.com/anant/realtime-pair-programming/internal/models"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/anant/realtime-pair-programming/internal/store"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
-	"github.com/aws/aws-sdk-go-v2/aws"
 )
 
+// AuthHandler handles accounts and sessions. Links in the emails it sends
+// point at pages under AppURL, the frontend's address.
 type AuthHandler struct {
-	DB *db.DynamoDB
+	Users      store.UserStore
+	Sessions   store.SessionStore
+	UserTokens store.UserTokenStore
+	Attempts   store.LoginAttemptStore
+	Audit      store.AuditStore
+	Mailer     mail.Mailer
+	AppURL     string
 }
 
-func NewAuthHandler(database *db.DynamoDB) *AuthHandler {
-	return &AuthHandler{DB: database}
+func NewAuthHandler(s *store.Store, mailer mail.Mailer, appURL string) *AuthHandler {
+	return &AuthHandler{
+		Users:      s.Users,
+		Sessions:   s.Sessions,
+		UserTokens: s.UserTokens,
+		Attempts:   s.Attempts,
+		Audit:      s.Audit,
+		Mailer:     mailer,
+		AppURL:     strings.TrimSuffix(appURL, "/"),
+	}
 }
 
 func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
@@ -36,23 +53,20 @@ func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Email, username and password are required", http.StatusBadRequest)
 		return
 	}
-
-	result, err := h.DB.Client.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(h.DB.UsersTable),
-		IndexName:              aws.String("EmailIndex"),
-		KeyConditionExpression: aws.String("email = :email"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":email": &types.AttributeValueMemberS{Value: req.Email},
-		},
-	})
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	if address, err := netmail.ParseAddress(req.Email); err != nil || address.Address != req.Email {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
 		return
 	}
-	if result.Count > 0 {
+
+	_, err := h.Users.GetUserByEmail(context.TODO(), req.Email)
+	if err == nil {
 		http.Error(w, "User with this email already exists", http.StatusConflict)
 		return
 	}
+	if !errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -69,97 +83,252 @@ func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 		LastSeen:       time.Now(),
 	}
 
-	item, err := attributevalue.MarshalMap(user)
+	err = h.Users.CreateUser(context.TODO(), &user)
+	if errors.Is(err, store.ErrConflict) {
+		http.Error(w, "User with this email already exists", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		http.Error(w, "Error saving user", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = h.DB.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(h.DB.UsersTable),
-		Item:      item,
-	})
+	if err := h.sendVerification(&user); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
+	h.startSession(w, &user)
+}
+
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var req models.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	keys := loginKeys(r, req.Email)
+	wait, err := h.loginWait(keys)
 	if err != nil {
-		http.Error(w, "Error saving user", http.StatusInternalServerError)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
 		return
 	}
 
-	token, err := auth.GenerateToken(user.UserID, user.Username, user.Email)
+	user, err := h.Users.GetUserByEmail(context.TODO(), req.Email)
+	if errors.Is(err, store.ErrNotFound) {
+		h.rejectLogin(w, r, keys, "")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	response := models.AuthResponse{
-		Token:  token,
-		UserID: user.UserID,
-		User:   user,
+	err = bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(req.Password))
+	if err != nil {
+		h.rejectLogin(w, r, keys, user.UserID)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// With 2FA on, the account's failures are only cleared once the code is
+	// right too, so guessing codes stays throttled.
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		h.challengeTwoFactor(w, user)
+		return
+	}
+
+	// Only the account's count is cleared. Clearing the IP's would let an
+	// attacker reset it by logging in to an account of their own.
+	h.Attempts.ClearLoginAttempts(context.TODO(), keys[0].key)
+	h.Users.UpdateLastSeen(context.TODO(), user.UserID, time.Now())
+
+	h.startSession(w, user)
 }
 
-func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
-	var req models.LoginRequest
+// rejectLogin answers a failed login, telling the client when it may try
+// again if the failure triggered a backoff or lockout.
+func (h *AuthHandler) rejectLogin(w http.ResponseWriter, r *http.Request, keys []loginKey, userID string) {
+	if wait := h.recordLoginFailure(r, keys, userID); wait > 0 {
+		setRetryAfter(w, wait)
+	}
+	http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+}
+
+// Refresh trades a refresh token for a new access token and a new refresh
+// token. A refresh token that was already traded in means it leaked, so
+// the whole session is ended.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	result, err := h.DB.Client.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(h.DB.UsersTable),
-		IndexName:              aws.String("EmailIndex"),
-		KeyConditionExpression: aws.String("email = :email"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":email": &types.AttributeValueMemberS{Value: req.Email},
-		},
-	})
+	userID, sessionID, hash, err := auth.ParseRefreshToken(req.RefreshToken)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := h.Sessions.GetSession(context.TODO(), userID, sessionID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	if result.Count == 0 {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	if !time.Now().Before(session.ExpiresAt) {
+		h.Sessions.DeleteSession(context.TODO(), userID, sessionID)
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	if !auth.SameHash(session.TokenHash, hash) {
+		log.Printf("Refresh token reused for session %s of user %s, ending session", sessionID, userID)
+		h.Sessions.DeleteSession(context.TODO(), userID, sessionID)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
 	}
 
-	var user models.User
-	err = attributevalue.UnmarshalMap(result.Items[0], &user)
+	user, err := h.Users.GetUser(context.TODO(), userID)
 	if err != nil {
-		http.Error(w, "Error processing user data", http.StatusInternalServerError)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(req.Password))
+	refreshToken, newHash, err := auth.NewRefreshToken(userID, sessionID)
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
+	now := time.Now()
+	session.TokenHash = newHash
+	session.RefreshedAt = now
+	session.ExpiresAt = now.Add(auth.RefreshTokenTTL)
+	err = h.Sessions.RotateSession(context.TODO(), session, hash)
+	if errors.Is(err, store.ErrConflict) || errors.Is(err, store.ErrNotFound) {
+		// Another request traded the same token in first.
+		log.Printf("Refresh token reused for session %s of user %s, ending session", sessionID, userID)
+		h.Sessions.DeleteSession(context.TODO(), userID, sessionID)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error saving session", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeTokens(w, user, sessionID, refreshToken)
+}
 
-	_, err = h.DB.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String(h.DB.UsersTable),
-		Key: map[string]types.AttributeValue{
-			"userId": &types.AttributeValueMemberS{Value: user.UserID},
-		},
-		UpdateExpression: aws.String("SET lastSeen = :now"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":now": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
-		},
-	})
+// Logout ends the caller's session and revokes the access token it used.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(auth.ClaimsKey).(*auth.Claims)
+
+	if claims.ID != "" {
+		if err := h.Sessions.RevokeToken(context.TODO(), claims.ID, tokenExpiry(claims)); err != nil {
+			http.Error(w, "Error revoking token", http.StatusInternalServerError)
+			return
+		}
+	}
+	if claims.SessionID != "" {
+		if err := h.Sessions.DeleteSession(context.TODO(), claims.UserID, claims.SessionID); err != nil {
+			http.Error(w, "Error ending session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll ends every session of the caller, which also invalidates all
+// access tokens issued for them.
+func (h *AuthHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(auth.ClaimsKey).(*auth.Claims)
+
+	if claims.ID != "" {
+		if err := h.Sessions.RevokeToken(context.TODO(), claims.ID, tokenExpiry(claims)); err != nil {
+			http.Error(w, "Error revoking token", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := h.Sessions.DeleteUserSessions(context.TODO(), claims.UserID); err != nil {
+		http.Error(w, "Error ending sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	token, err := auth.GenerateToken(user.UserID, user.Username, user.Email)
+// JWKS publishes the public keys tokens are signed with.
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(auth.PublicKeys())
+}
+
+func (h *AuthHandler) startSession(w http.ResponseWriter, user *models.User) {
+	response, err := h.newSession(user)
 	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		http.Error(w, "Error starting session", http.StatusInternalServerError)
 		return
 	}
 
-	response := models.AuthResponse{
-		Token:  token,
-		UserID: user.UserID,
-		User:   user,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// newSession logs the user in on a new session and returns its tokens.
+func (h *AuthHandler) newSession(user *models.User) (*models.AuthResponse, error) {
+	sessionID := uuid.New().String()
+	refreshToken, hash, err := auth.NewRefreshToken(user.UserID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:      user.UserID,
+		SessionID:   sessionID,
+		TokenHash:   hash,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(auth.RefreshTokenTTL),
+	}
+	if err := h.Sessions.CreateSession(context.TODO(), &session); err != nil {
+		return nil, err
+	}
+
+	return issueTokens(user, sessionID, refreshToken)
+}
+
+func (h *AuthHandler) writeTokens(w http.ResponseWriter, user *models.User, sessionID, refreshToken string) {
+	response, err := issueTokens(user, sessionID, refreshToken)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+func issueTokens(user *models.User, sessionID, refreshToken string) (*models.AuthResponse, error) {
+	token, expiresAt, err := auth.GenerateToken(user.UserID, user.Username, user.Email, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.AuthResponse{
+		Token:        token,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+		UserID:       user.UserID,
+		User:         *user,
+	}, nil
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultInviteExpiry = 7 * 24 * time.Hour
+	maxInviteExpiry     = auth.MaxTokenLifetime
+)
+
+type InviteHandler struct {
+	Rooms   store.RoomStore
+	Invites store.InviteStore
+}
+
+func NewInviteHandler(s *store.Store) *InviteHandler {
+	return &InviteHandler{Rooms: s.Rooms, Invites: s.Invites}
+}
+
+func (h *InviteHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	var req models.CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.RoleEditor
+	}
+	if req.Role != models.RoleEditor && req.Role != models.RoleViewer {
+		http.Error(w, "role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses < 0 {
+		http.Error(w, "maxUses cannot be negative", http.StatusBadRequest)
+		return
+	}
+	expiry := defaultInviteExpiry
+	if req.ExpiresIn != 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+		if expiry <= 0 || expiry > maxInviteExpiry {
+			http.Error(w, "expiresIn must be between 1 second and 30 days", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	invite := models.Invite{
+		RoomID:    room.RoomID,
+		InviteID:  uuid.New().String(),
+		Role:      req.Role,
+		MaxUses:   req.MaxUses,
+		ExpiresAt: now.Add(expiry),
+		CreatedBy: userID,
+		CreatedAt: now,
+	}
+	if err := h.Invites.CreateInvite(context.TODO(), &invite); err != nil {
+		http.Error(w, "Error saving invite", http.StatusInternalServerError)
+		return
+	}
+	if err := signInvite(&invite); err != nil {
+		http.Error(w, "Error signing invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+// ListInvites returns the invites that can still be redeemed, oldest first.
+func (h *InviteHandler) ListInvites(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	invites, err := h.Invites.ListInvites(context.TODO(), room.RoomID)
+	if err != nil {
+		http.Error(w, "Error fetching invites", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	outstanding := []models.Invite{}
+	for _, invite := range invites {
+		if !now.Before(invite.ExpiresAt) || (invite.MaxUses > 0 && invite.Uses >= invite.MaxUses) {
+			continue
+		}
+		if err := signInvite(&invite); err != nil {
+			http.Error(w, "Error signing invite", http.StatusInternalServerError)
+			return
+		}
+		outstanding = append(outstanding, invite)
+	}
+	sort.Slice(outstanding, func(i, j int) bool {
+		return outstanding[i].CreatedAt.Before(outstanding[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outstanding)
+}
+
+func (h *InviteHandler) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	err := h.Invites.DeleteInvite(context.TODO(), room.RoomID, chi.URLParam(r, "inviteId"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvite adds the caller to the invite's room with the role it
+// grants. Members who accept again keep their role and use up nothing.
+func (h *InviteHandler) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	claims, err := auth.ValidateInviteToken(chi.URLParam(r, "token"))
+	if err != nil {
+		http.Error(w, "Invalid or expired invite", http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.Rooms.GetRoom(context.TODO(), claims.RoomID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error fetching room", http.StatusInternalServerError)
+		return
+	}
+	if isRoomMember(room, userID) {
+		fillRoles(room)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Already in room",
+			"room":    room,
+		})
+		return
+	}
+	if !requireUnarchived(w, room) || !requireUnbanned(w, room, userID) {
+		return
+	}
+
+	invite, err := h.Invites.UseInvite(context.TODO(), claims.RoomID, claims.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Invite has been revoked", http.StatusGone)
+		return
+	}
+	if errors.Is(err, store.ErrExhausted) {
+		http.Error(w, "Invite has been used up", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error redeeming invite", http.StatusInternalServerError)
+		return
+	}
+
+	room, err = h.Rooms.AddRoomUser(context.TODO(), room.RoomID, userID, invite.Role)
+	if err != nil {
+		log.Printf("Error adding user to room: %v", err)
+		http.Error(w, "Error joining room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+
+	log.Printf("User %s joined room %s with invite %s", userID, room.RoomID, invite.InviteID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Successfully joined room",
+		"room":    room,
+	})
+}
+
+func signInvite(invite *models.Invite) error {
+	token, err := auth.GenerateInviteToken(invite.RoomID, invite.InviteID, invite.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	invite.Token = token
+	return nil
+}
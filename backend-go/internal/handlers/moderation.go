@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/services"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxMuteDuration     = 7 * 24 * time.Hour
+	maxModerationReason = 500
+	defaultAuditLimit   = 50
+	maxAuditLimit       = 200
+)
+
+// ModerationHandler lets room owners kick, ban and mute members, over REST
+// or WebSocket. Every action is recorded in the room's audit scope.
+type ModerationHandler struct {
+	RoomManager *services.RoomManager
+	Users       store.UserStore
+	Rooms       store.RoomStore
+	Audit       store.AuditStore
+}
+
+func NewModerationHandler(rm *services.RoomManager, s *store.Store) *ModerationHandler {
+	return &ModerationHandler{RoomManager: rm, Users: s.Users, Rooms: s.Rooms, Audit: s.Audit}
+}
+
+// moderationError is a moderation action that was refused, with the status
+// and message to answer it with.
+type moderationError struct {
+	status  int
+	message string
+}
+
+func (e *moderationError) Error() string {
+	return e.message
+}
+
+func refuse(status int, message string) error {
+	return &moderationError{status: status, message: message}
+}
+
+// moderationStatus maps an error from a moderation action to a response.
+func moderationStatus(err error) (int, string) {
+	var refused *moderationError
+	if errors.As(err, &refused) {
+		return refused.status, refused.message
+	}
+	log.Printf("Error moderating room: %v", err)
+	return http.StatusInternalServerError, "Error moderating room"
+}
+
+func checkModerationTarget(actorID string, req *models.ModerationRequest) error {
+	if req.UserID == "" {
+		return refuse(http.StatusBadRequest, "userId is required")
+	}
+	if req.UserID == actorID {
+		return refuse(http.StatusBadRequest, "You cannot moderate yourself")
+	}
+	if len(req.Reason) > maxModerationReason {
+		return refuse(http.StatusBadRequest, "reason must be at most 500 characters")
+	}
+	return nil
+}
+
+// kick closes the member's connections to the room. They stay a member and
+// can reconnect.
+func (h *ModerationHandler) kick(room *models.Room, actorID, ip string, req *models.ModerationRequest) error {
+	if err := checkModerationTarget(actorID, req); err != nil {
+		return err
+	}
+	if !isRoomMember(room, req.UserID) {
+		return refuse(http.StatusNotFound, "Member not found")
+	}
+
+	h.RoomManager.KickUser(room.RoomID, req.UserID, "kicked")
+	h.audit(room, models.AuditActionRoomKick, actorID, req.UserID, ip, reasonDetails(req.Reason))
+	return nil
+}
+
+// ban removes the user from the room, if they are in it, and keeps them
+// from joining again until they are unbanned.
+func (h *ModerationHandler) ban(room *models.Room, actorID, ip string, req *models.ModerationRequest) (*models.BannedUser, error) {
+	if err := checkModerationTarget(actorID, req); err != nil {
+		return nil, err
+	}
+	user, err := h.Users.GetUser(context.TODO(), req.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, refuse(http.StatusNotFound, "User not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if room.Banned(req.UserID) {
+		return nil, refuse(http.StatusConflict, "User is already banned")
+	}
+
+	ban := models.RoomBan{BannedBy: actorID, Reason: req.Reason, CreatedAt: time.Now()}
+	if _, err := h.Rooms.SetRoomBan(context.TODO(), room.RoomID, req.UserID, &ban); err != nil {
+		return nil, err
+	}
+	if isRoomMember(room, req.UserID) {
+		if _, err := h.Rooms.RemoveRoomUser(context.TODO(), room.RoomID, req.UserID); err != nil {
+			return nil, err
+		}
+		h.RoomManager.DisconnectUser(room.RoomID, req.UserID, "banned")
+	}
+
+	h.audit(room, models.AuditActionRoomBan, actorID, req.UserID, ip, reasonDetails(req.Reason))
+	return &models.BannedUser{UserID: user.UserID, Username: user.Username, RoomBan: ban}, nil
+}
+
+func (h *ModerationHandler) unban(room *models.Room, actorID, ip, userID string) error {
+	if !room.Banned(userID) {
+		return refuse(http.StatusNotFound, "User is not banned")
+	}
+	if _, err := h.Rooms.SetRoomBan(context.TODO(), room.RoomID, userID, nil); err != nil {
+		return err
+	}
+	h.audit(room, models.AuditActionRoomUnban, actorID, userID, ip, nil)
+	return nil
+}
+
+// mute stops the member from chatting, editing or both for the requested
+// duration, replacing any mute they already have.
+func (h *ModerationHandler) mute(room *models.Room, actorID, ip string, req *models.ModerationRequest) (*models.RoomMute, error) {
+	if err := checkModerationTarget(actorID, req); err != nil {
+		return nil, err
+	}
+	if !isRoomMember(room, req.UserID) {
+		return nil, refuse(http.StatusNotFound, "Member not found")
+	}
+	duration := time.Duration(req.Duration) * time.Second
+	if duration <= 0 || duration > maxMuteDuration {
+		return nil, refuse(http.StatusBadRequest, "duration must be between 1 second and 7 days")
+	}
+
+	mute := models.RoomMute{
+		Chat:    req.Chat || !req.Edit,
+		Edit:    req.Edit || !req.Chat,
+		Until:   time.Now().Add(duration),
+		MutedBy: actorID,
+	}
+	if _, err := h.Rooms.SetRoomMute(context.TODO(), room.RoomID, req.UserID, &mute); err != nil {
+		return nil, err
+	}
+	h.RoomManager.SetMute(room.RoomID, req.UserID, &mute)
+
+	details := reasonDetails(req.Reason)
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["chat"] = strconv.FormatBool(mute.Chat)
+	details["edit"] = strconv.FormatBool(mute.Edit)
+	details["until"] = mute.Until.UTC().Format(time.RFC3339)
+	h.audit(room, models.AuditActionRoomMute, actorID, req.UserID, ip, details)
+	return &mute, nil
+}
+
+func (h *ModerationHandler) unmute(room *models.Room, actorID, ip, userID string) error {
+	if room.MuteOf(userID, time.Now()) == nil {
+		return refuse(http.StatusNotFound, "Member is not muted")
+	}
+	if _, err := h.Rooms.SetRoomMute(context.TODO(), room.RoomID, userID, nil); err != nil {
+		return err
+	}
+	h.RoomManager.SetMute(room.RoomID, userID, nil)
+	h.audit(room, models.AuditActionRoomUnmute, actorID, userID, ip, nil)
+	return nil
+}
+
+func (h *ModerationHandler) audit(room *models.Room, action, actorID, targetID, ip string, details map[string]string) {
+	recordAudit(h.Audit, models.AuditEntry{
+		Scope:    models.AuditScopeRoom(room.RoomID),
+		Action:   action,
+		ActorID:  actorID,
+		TargetID: targetID,
+		IP:       ip,
+		Details:  details,
+	})
+}
+
+func reasonDetails(reason string) map[string]string {
+	if reason == "" {
+		return nil
+	}
+	return map[string]string{"reason": reason}
+}
+
+// decodeModeration reads an optional moderation request body, taking the
+// target from the URL when it names one.
+func decodeModeration(w http.ResponseWriter, r *http.Request) (*models.ModerationRequest, bool) {
+	var req models.ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	if userID := chi.URLParam(r, "userId"); userID != "" {
+		req.UserID = userID
+	}
+	return &req, true
+}
+
+func writeModerationError(w http.ResponseWriter, err error) {
+	status, message := moderationStatus(err)
+	http.Error(w, message, status)
+}
+
+// KickMember closes a member's connections to the room.
+func (h *ModerationHandler) KickMember(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	if err := h.kick(room, userID, clientIP(r), req); err != nil {
+		writeModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListBans shows the owner who is banned from the room.
+func (h *ModerationHandler) ListBans(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	bans := make([]models.BannedUser, 0, len(room.Bans))
+	for uid, ban := range room.Bans {
+		banned := models.BannedUser{UserID: uid, RoomBan: ban}
+		if user, err := h.Users.GetUser(context.TODO(), uid); err == nil {
+			banned.Username = user.Username
+		}
+		bans = append(bans, banned)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].CreatedAt.After(bans[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
+
+// BanUser bans the user in the body from the room.
+func (h *ModerationHandler) BanUser(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	banned, err := h.ban(room, userID, clientIP(r), req)
+	if err != nil {
+		writeModerationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(banned)
+}
+
+// UnbanUser lifts a ban. The user has to join the room again.
+func (h *ModerationHandler) UnbanUser(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	if err := h.unban(room, userID, clientIP(r), chi.URLParam(r, "userId")); err != nil {
+		writeModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MuteMember mutes a member for the duration in the body.
+func (h *ModerationHandler) MuteMember(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+	req, ok := decodeModeration(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	mute, err := h.mute(room, userID, clientIP(r), req)
+	if err != nil {
+		writeModerationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.MuteChangedPayload{UserID: req.UserID, Mute: mute})
+}
+
+// UnmuteMember lifts a member's mute before it runs out.
+func (h *ModerationHandler) UnmuteMember(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	if err := h.unmute(room, userID, clientIP(r), chi.URLParam(r, "userId")); err != nil {
+		writeModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListAudit shows the owner the room's moderation history, newest first.
+func (h *ModerationHandler) ListAudit(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	limit := defaultAuditLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := h.Audit.ListAuditEntries(context.TODO(), models.AuditScopeRoom(room.RoomID), limit)
+	if err != nil {
+		http.Error(w, "Error fetching audit log", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []models.AuditEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleWS runs a moderation action sent over WebSocket by the room owner.
+func (h *ModerationHandler) handleWS(client *services.Client, msg *models.WSMessage) error {
+	if client.Role() != models.RoleOwner {
+		return refuse(http.StatusForbidden, "Only the room owner can do this")
+	}
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var req models.ModerationRequest
+	if err := json.Unmarshal(payloadBytes, &req); err != nil {
+		return refuse(http.StatusBadRequest, "Invalid moderation payload")
+	}
+	room, err := h.Rooms.GetRoom(context.TODO(), client.RoomID)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case "kick":
+		return h.kick(room, client.UserID, "", &req)
+	case "ban":
+		_, err = h.ban(room, client.UserID, "", &req)
+	case "unban":
+		err = h.unban(room, client.UserID, "", req.UserID)
+	case "mute":
+		_, err = h.mute(room, client.UserID, "", &req)
+	case "unmute":
+		err = h.unmute(room, client.UserID, "", req.UserID)
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/oidc"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/google/uuid"
+)
+
+// oidcCookie carries the signed login state from OIDCLogin to OIDCCallback.
+const oidcCookie = "oidc_login"
+
+// OIDCHandler logs users in through an external OpenID Connect provider.
+// Once the provider vouches for them they get the same session and tokens
+// as a password login, delivered to the frontend in the URL fragment of
+// PostLoginURL.
+type OIDCHandler struct {
+	Auth         *AuthHandler
+	Provider     *oidc.Provider
+	PostLoginURL string
+}
+
+func NewOIDCHandler(authHandler *AuthHandler, provider *oidc.Provider, postLoginURL string) *OIDCHandler {
+	return &OIDCHandler{Auth: authHandler, Provider: provider, PostLoginURL: postLoginURL}
+}
+
+// Login redirects to the provider. The state, nonce and PKCE verifier are
+// kept in a short-lived signed cookie for the callback.
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	state, nonce := oidc.RandomString(), oidc.RandomString()
+	authURL, verifier, err := h.Provider.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		log.Printf("Error contacting OIDC provider: %v", err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	stateToken, err := auth.GenerateOIDCStateToken(state, nonce, verifier)
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	h.setCookie(w, r, stateToken, int(auth.OIDCStateTTL.Seconds()))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback finishes a login the provider sent back. Failures are reported
+// to the frontend as an error in the fragment, since the user got here by
+// browser redirect.
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		h.fail(w, r, "Login expired, please try again")
+		return
+	}
+	h.setCookie(w, r, "", -1)
+
+	claims, err := auth.ValidateOIDCStateToken(cookie.Value)
+	if err != nil || params.Get("state") != claims.State {
+		h.fail(w, r, "Login expired, please try again")
+		return
+	}
+	if params.Get("error") != "" {
+		log.Printf("OIDC provider returned error %q: %s", params.Get("error"), params.Get("error_description"))
+		h.fail(w, r, "Login was cancelled or denied")
+		return
+	}
+	if params.Get("code") == "" {
+		h.fail(w, r, "Missing authorization code")
+		return
+	}
+
+	idToken, err := h.Provider.Exchange(r.Context(), params.Get("code"), claims.Verifier, claims.Nonce)
+	if err != nil {
+		log.Printf("Error completing OIDC login: %v", err)
+		h.fail(w, r, "Could not verify login with the identity provider")
+		return
+	}
+
+	user, message := h.resolveUser(idToken)
+	if user == nil {
+		h.fail(w, r, message)
+		return
+	}
+	// The provider stands in for the password only; accounts with 2FA on
+	// still finish at POST /api/auth/login/2fa.
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		token, expiresAt, err := auth.GenerateTwoFactorChallenge(user.UserID)
+		if err != nil {
+			h.fail(w, r, "Error generating challenge")
+			return
+		}
+		h.redirect(w, r, url.Values{
+			"twoFactorRequired": {"true"},
+			"challengeToken":    {token},
+			"expiresAt":         {expiresAt.Format(time.RFC3339)},
+		})
+		return
+	}
+	h.Auth.Users.UpdateLastSeen(context.TODO(), user.UserID, time.Now())
+
+	response, err := h.Auth.newSession(user)
+	if err != nil {
+		h.fail(w, r, "Error starting session")
+		return
+	}
+
+	fragment := url.Values{
+		"token":        {response.Token},
+		"expiresAt":    {response.ExpiresAt.Format(time.RFC3339)},
+		"refreshToken": {response.RefreshToken},
+		"userId":       {response.UserID},
+	}
+	h.redirect(w, r, fragment)
+}
+
+// resolveUser finds the user an ID token belongs to. Identities seen before
+// map straight to their user. Otherwise the identity is linked to the
+// account with the same email, but only if both the provider and the
+// account have verified that email, and failing that a new user is
+// created. On failure it returns a message for the user instead.
+func (h *OIDCHandler) resolveUser(idToken *oidc.IDToken) (*models.User, string) {
+	users := h.Auth.Users
+
+	user, err := users.GetUserByIdentity(context.TODO(), idToken.Issuer, idToken.Subject)
+	if err == nil {
+		return user, ""
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, "Database error"
+	}
+
+	if idToken.Email == "" {
+		return nil, "The identity provider did not share an email address"
+	}
+
+	user, err = users.GetUserByEmail(context.TODO(), idToken.Email)
+	switch {
+	case err == nil:
+		if !idToken.EmailVerified {
+			return nil, "An account with this email already exists, log in with your password"
+		}
+		if !user.EmailVerified {
+			// Anyone could have registered the address, and linking would
+			// leave their password working on the real owner's account.
+			return nil, "An account with this email already exists, verify your email before signing in with this provider"
+		}
+	case errors.Is(err, store.ErrNotFound):
+		now := time.Now()
+		user = &models.User{
+			UserID:        uuid.New().String(),
+			Username:      oidcUsername(idToken),
+			Email:         idToken.Email,
+			EmailVerified: idToken.EmailVerified,
+			CreatedAt:     now,
+			LastSeen:      now,
+		}
+		if err := users.CreateUser(context.TODO(), user); err != nil {
+			log.Printf("Error creating user from OIDC login: %v", err)
+			return nil, "Error saving user"
+		}
+		log.Printf("Created user %s for %s at %s", user.UserID, idToken.Subject, idToken.Issuer)
+	default:
+		return nil, "Database error"
+	}
+
+	err = users.LinkIdentity(context.TODO(), &models.UserIdentity{
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		UserID:   user.UserID,
+		Email:    idToken.Email,
+		LinkedAt: time.Now(),
+	})
+	if errors.Is(err, store.ErrConflict) {
+		// A concurrent login linked it first.
+		if linked, err := users.GetUserByIdentity(context.TODO(), idToken.Issuer, idToken.Subject); err == nil {
+			return linked, ""
+		}
+	}
+	if err != nil {
+		log.Printf("Error linking OIDC identity: %v", err)
+		return nil, "Error linking account"
+	}
+	return user, ""
+}
+
+func (h *OIDCHandler) fail(w http.ResponseWriter, r *http.Request, message string) {
+	h.redirect(w, r, url.Values{"error": {message}})
+}
+
+func (h *OIDCHandler) redirect(w http.ResponseWriter, r *http.Request, fragment url.Values) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, h.PostLoginURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// setCookie sets the login state cookie, or clears it when maxAge is
+// negative. It must be sent on the provider's redirect back to us, which
+// SameSite=Lax allows since that is a top-level GET.
+func (h *OIDCHandler) setCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/api/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// oidcUsername picks a display name for a user created from an ID token.
+func oidcUsername(idToken *oidc.IDToken) string {
+	if idToken.PreferredUsername != "" {
+		return idToken.PreferredUsername
+	}
+	if idToken.Name != "" {
+		return idToken.Name
+	}
+	local, _, _ := strings.Cut(idToken.Email, "@")
+	return local
+}
@@ -2,28 +2,57 @@ package handlers
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anant/realtime-pair-programming/internal/auth"
-	"github.com/anant/realtime-pair-programming/internal/db"
 	"github.com/anant/realtime-pair-programming/internal/models"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/anant/realtime-pair-programming/internal/services"
+	"github.com/anant/realtime-pair-programming/internal/store"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultMessagePage = 50
+	maxMessagePage     = 100
+	defaultRoomPage    = 20
+	maxRoomPage        = 100
+	maxRoomName        = 100
+	maxRoomDescription = 1000
+	minRoomPassword    = 4
+	maxRoomEditors     = 100
+	maxRotateMinutes   = 240
 )
 
 type RoomHandler struct {
-	DB *db.DynamoDB
+	RoomManager *services.RoomManager
+	Users       store.UserStore
+	Rooms       store.RoomStore
+	Messages    store.MessageStore
+	Code        store.CodeStore
+	Files       store.FileStore
 }
 
-func NewRoomHandler(database *db.DynamoDB) *RoomHandler {
-	return &RoomHandler{DB: database}
+func NewRoomHandler(rm *services.RoomManager, s *store.Store) *RoomHandler {
+	return &RoomHandler{
+		RoomManager: rm,
+		Users:       s.Users,
+		Rooms:       s.Rooms,
+		Messages:    s.Messages,
+		Code:        s.Code,
+		Files:       s.Files,
+	}
 }
 
 func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
@@ -39,42 +68,63 @@ func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	if req.Name == "" {
 		req.Name = "Untitled Room"
 	}
-
-	room := models.Room{
-		RoomID:    uuid.New().String(),
-		Name:      req.Name,
-		CreatedBy: userID,
-		Users:     []string{userID},
-		CreatedAt: time.Now(),
+	if req.SyncMode == "" {
+		req.SyncMode = models.SyncModeOT
 	}
-
-	item, err := attributevalue.MarshalMap(room)
-	if err != nil {
-		http.Error(w, "Error creating room", http.StatusInternalServerError)
+	if req.SyncMode != models.SyncModeOT && req.SyncMode != models.SyncModeCRDT {
+		http.Error(w, "syncMode must be ot or crdt", http.StatusBadRequest)
+		return
+	}
+	if req.Visibility == "" {
+		req.Visibility = models.VisibilityPublic
+	}
+	passwordHash, ok := roomPasswordHash(w, req.Visibility, req.Password)
+	if !ok {
+		return
+	}
+	if !validMaxEditors(w, req.MaxEditors) || !validRotation(w, req.RotateMinutes) {
 		return
 	}
+	if !req.DriverMode {
+		req.RotateMinutes = 0
+	}
 
-	_, err = h.DB.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(h.DB.RoomsTable),
-		Item:      item,
-	})
-	if err != nil {
+	room := models.Room{
+		RoomID:     uuid.New().String(),
+		Name:       req.Name,
+		CreatedBy:  userID,
+		Users:      []string{userID},
+		Roles:      map[string]string{userID: models.RoleOwner},
+		SyncMode:   req.SyncMode,
+		InviteOnly: req.InviteOnly,
+		CreatedAt:  time.Now(),
+	}
+	room.LastActivity = room.CreatedAt
+	room.Visibility = req.Visibility
+	room.PasswordHash = passwordHash
+	room.MaxEditors = req.MaxEditors
+	room.DriverMode = req.DriverMode
+	room.RotateMinutes = req.RotateMinutes
+
+	if err := h.Rooms.CreateRoom(context.TODO(), &room); err != nil {
 		http.Error(w, "Error saving room", http.StatusInternalServerError)
 		return
 	}
 
 	codeSync := models.CodeSync{
 		RoomID:    room.RoomID,
+		FileID:    models.MainFileID,
 		Code:      "// Welcome to the pair programming session!\n// Start coding here...\n",
 		Language:  "javascript",
 		UpdatedAt: time.Now(),
 	}
+	if room.SyncMode == models.SyncModeCRDT {
+		codeSync.Updates = services.SeedCRDTUpdates(codeSync.Code)
+	}
 
-	codeSyncItem, _ := attributevalue.MarshalMap(codeSync)
-	h.DB.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(h.DB.CodeSyncTable),
-		Item:      codeSyncItem,
-	})
+	h.Code.PutCode(context.TODO(), &codeSync)
+	main := mainFile(room.RoomID, codeSync.Language, userID, room.CreatedAt)
+	h.Files.PutFile(context.TODO(), &main)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -83,68 +133,138 @@ func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GetRooms lists the caller's rooms, or with ?visibility=public the rooms
+// anyone may join, most recently active first. ?q= filters by name, and
+// ?limit= and ?cursor= page through the results.
 func (h *RoomHandler) GetRooms(w http.ResponseWriter, r *http.Request) {
-	result, err := h.DB.Client.Scan(context.TODO(), &dynamodb.ScanInput{
-		TableName: aws.String(h.DB.RoomsTable),
-	})
-	if err != nil {
-		http.Error(w, "Error fetching rooms", http.StatusInternalServerError)
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	query := store.RoomQuery{Limit: defaultRoomPage}
+	params := r.URL.Query()
+	switch params.Get("visibility") {
+	case "", "member":
+		query.MemberID = userID
+	case "public":
+	default:
+		http.Error(w, "visibility must be member or public", http.StatusBadRequest)
 		return
 	}
+	query.Search = strings.TrimSpace(params.Get("q"))
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = min(limit, maxRoomPage)
+	}
+	if v := params.Get("cursor"); v != "" {
+		var ok bool
+		if query.AfterTime, query.AfterID, ok = parseRoomCursor(v); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
 
-	var rooms []models.Room
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &rooms)
+	pageSize := query.Limit
+	query.Limit++
+	rooms, err := h.Rooms.QueryRooms(context.TODO(), query)
 	if err != nil {
-		http.Error(w, "Error processing rooms", http.StatusInternalServerError)
+		http.Error(w, "Error fetching rooms", http.StatusInternalServerError)
 		return
 	}
 
+	response := models.RoomList{Rooms: []models.RoomSummary{}}
+	if len(rooms) > pageSize {
+		rooms = rooms[:pageSize]
+		last := rooms[pageSize-1]
+		response.Next = roomCursor(last.ActiveAt(), last.RoomID)
+	}
+	for _, room := range rooms {
+		fillRoles(&room)
+		room.LastActivity = room.ActiveAt()
+		if !isRoomMember(&room, userID) {
+			room = room.Listing()
+		}
+		response.Rooms = append(response.Rooms, models.RoomSummary{
+			Room:         room,
+			Participants: h.participants(room.RoomID),
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(rooms)
+	json.NewEncoder(w).Encode(response)
+}
+
+// participants counts the users connected to a room on any node.
+func (h *RoomHandler) participants(roomID string) int {
+	count, err := h.RoomManager.Participants(roomID)
+	if err != nil {
+		log.Printf("Error fetching room members: %v", err)
+	}
+	return count
+}
+
+// roomCursor is the opaque cursor for the page of rooms that follows the
+// room roomID, last active at activeAt.
+func roomCursor(activeAt time.Time, roomID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(activeAt.UTC().Format(time.RFC3339Nano) + " " + roomID))
+}
+
+func parseRoomCursor(cursor string) (time.Time, string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	at, roomID, ok := strings.Cut(string(raw), " ")
+	if !ok || roomID == "" {
+		return time.Time{}, "", false
+	}
+	activeAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return activeAt, roomID, true
 }
 
+// GetRoom returns a room with its main file. Private rooms look missing to
+// non-members, and password-protected ones have to be joined first.
 func (h *RoomHandler) GetRoom(w http.ResponseWriter, r *http.Request) {
 	roomID := chi.URLParam(r, "roomId")
+	userID := r.Context().Value(auth.UserIDKey).(string)
 
-	result, err := h.DB.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(h.DB.RoomsTable),
-		Key: map[string]types.AttributeValue{
-			"roomId": &types.AttributeValueMemberS{Value: roomID},
-		},
-	})
+	room, err := h.Rooms.GetRoom(context.TODO(), roomID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && roomHidden(room, userID)) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error fetching room", http.StatusInternalServerError)
 		return
 	}
-	if result.Item == nil {
-		http.Error(w, "Room not found", http.StatusNotFound)
+	if room.EffectiveVisibility() == models.VisibilityPassword && !isRoomMember(room, userID) {
+		http.Error(w, "This room requires a password", http.StatusForbidden)
 		return
 	}
+	fillRoles(room)
 
-	var room models.Room
-	err = attributevalue.UnmarshalMap(result.Item, &room)
-	if err != nil {
-		http.Error(w, "Error processing room", http.StatusInternalServerError)
-		return
+	codeSync := &models.CodeSync{}
+	if stored, err := h.Code.GetCode(context.TODO(), roomID, models.MainFileID); err == nil {
+		codeSync = stored
 	}
 
-	codeSyncResult, _ := h.DB.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(h.DB.CodeSyncTable),
-		Key: map[string]types.AttributeValue{
-			"roomId": &types.AttributeValueMemberS{Value: roomID},
-		},
-	})
-
-	var codeSync models.CodeSync
-	if codeSyncResult.Item != nil {
-		attributevalue.UnmarshalMap(codeSyncResult.Item, &codeSync)
+	response := map[string]interface{}{
+		"room":     room,
+		"codeSync": codeSync,
+	}
+	if room.SyncMode == models.SyncModeCRDT {
+		// Built from storage rather than the live document, which is only
+		// kept while someone on this node is connected.
+		codeSync.Code, response["stateVector"] = services.NewCRDTDocument(codeSync.Updates).Snapshot()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"room":     room,
-		"codeSync": codeSync,
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *RoomHandler) JoinRoom(w http.ResponseWriter, r *http.Request) {
@@ -153,31 +273,25 @@ func (h *RoomHandler) JoinRoom(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("JoinRoom called: roomID=%s, userID=%s", roomID, userID)
 
-	result, err := h.DB.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(h.DB.RoomsTable),
-		Key: map[string]types.AttributeValue{
-			"roomId": &types.AttributeValueMemberS{Value: roomID},
-		},
-	})
-	if err != nil {
-		log.Printf("Error fetching room: %v", err)
-		http.Error(w, "Error fetching room", http.StatusInternalServerError)
+	var req models.JoinRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if result.Item == nil {
+
+	room, err := h.Rooms.GetRoom(context.TODO(), roomID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && roomHidden(room, userID)) {
 		log.Printf("Room not found: %s", roomID)
 		http.Error(w, "Room not found", http.StatusNotFound)
 		return
 	}
-
-	var room models.Room
-	err = attributevalue.UnmarshalMap(result.Item, &room)
 	if err != nil {
-		log.Printf("Error unmarshaling room: %v", err)
-		http.Error(w, "Error processing room", http.StatusInternalServerError)
+		log.Printf("Error fetching room: %v", err)
+		http.Error(w, "Error fetching room", http.StatusInternalServerError)
 		return
 	}
 
+	fillRoles(room)
 	for _, uid := range room.Users {
 		if uid == userID {
 			log.Printf("User %s already in room %s", userID, roomID)
@@ -190,50 +304,659 @@ func (h *RoomHandler) JoinRoom(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	_, err = h.DB.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String(h.DB.RoomsTable),
-		Key: map[string]types.AttributeValue{
-			"roomId": &types.AttributeValueMemberS{Value: roomID},
-		},
-		UpdateExpression: aws.String("SET #users = list_append(if_not_exists(#users, :empty_list), :user)"),
-		ExpressionAttributeNames: map[string]string{
-			"#users": "users",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":user":       &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberS{Value: userID}}},
-			":empty_list": &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
-		},
-	})
+	if !requireUnarchived(w, room) || !requireUnbanned(w, room, userID) {
+		return
+	}
+	if room.InviteOnly {
+		http.Error(w, "This room is invite-only", http.StatusForbidden)
+		return
+	}
+	if room.EffectiveVisibility() == models.VisibilityPassword {
+		if req.Password == "" {
+			http.Error(w, "This room requires a password", http.StatusForbidden)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(room.PasswordHash), []byte(req.Password)) != nil {
+			http.Error(w, "Incorrect room password", http.StatusForbidden)
+			return
+		}
+	}
+
+	room, err = h.Rooms.AddRoomUser(context.TODO(), roomID, userID, models.RoleEditor)
 	if err != nil {
 		log.Printf("Error adding user to room: %v", err)
 		http.Error(w, "Error joining room", http.StatusInternalServerError)
 		return
 	}
+	fillRoles(room)
+
+	log.Printf("User %s successfully joined room %s", userID, roomID)
 
-	result, err = h.DB.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(h.DB.RoomsTable),
-		Key: map[string]types.AttributeValue{
-			"roomId": &types.AttributeValueMemberS{Value: roomID},
-		},
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Successfully joined room",
+		"room":    room,
 	})
+}
+
+func (h *RoomHandler) GetMessages(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomId")
+	if requireRoomMember(w, r, h.Rooms) == nil {
+		return
+	}
+
+	var err error
+	query := store.MessageQuery{Limit: defaultMessagePage}
+	params := r.URL.Query()
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = min(limit, maxMessagePage)
+	}
+	if v := params.Get("before"); v != "" {
+		if query.Before, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "Invalid before cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("after"); v != "" {
+		if query.After, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "Invalid after cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if !query.Before.IsZero() && !query.After.IsZero() {
+		http.Error(w, "Use either before or after, not both", http.StatusBadRequest)
+		return
+	}
+
+	pageSize := query.Limit
+	query.Limit++
+	messages, err := h.Messages.ListMessages(context.TODO(), roomID, query)
 	if err != nil {
-		log.Printf("Error fetching updated room: %v", err)
-		http.Error(w, "Error fetching updated room", http.StatusInternalServerError)
+		http.Error(w, "Error fetching messages", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(messages) > pageSize
+	if hasMore {
+		if query.After.IsZero() {
+			messages = messages[1:]
+		} else {
+			messages = messages[:pageSize]
+		}
+	}
+
+	response := models.MessagePage{Messages: messages, HasMore: hasMore}
+	if len(messages) > 0 {
+		response.Before = messages[0].Timestamp.UTC().Format(time.RFC3339Nano)
+		response.After = messages[len(messages)-1].Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// PostMessage sends a chat message to the room as the caller, as if typed
+// into the chat over WebSocket.
+func (h *RoomHandler) PostMessage(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil || !requireUnarchived(w, room) || !requireUnmuted(w, r, room, false) {
+		return
+	}
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	username := r.Context().Value(auth.UsernameKey).(string)
+
+	var req models.PostMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "text is required", http.StatusBadRequest)
+		return
+	}
+
+	message := models.Message{
+		RoomID:    room.RoomID,
+		MessageID: uuid.New().String(),
+		UserID:    userID,
+		Username:  username,
+		Text:      req.Text,
+		Timestamp: time.Now(),
+	}
+	if err := h.Messages.SaveMessage(context.TODO(), &message); err != nil {
+		http.Error(w, "Error saving message", http.StatusInternalServerError)
+		return
+	}
+
+	broadcastData, _ := json.Marshal(models.WSMessage{Type: "chat", Payload: message})
+	h.RoomManager.BroadcastToRoom(room.RoomID, broadcastData, "")
+	touchRoom(h.RoomManager, h.Rooms, room.RoomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(message)
+}
+
+func (h *RoomHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
 		return
 	}
 
-	err = attributevalue.UnmarshalMap(result.Item, &room)
+	members := make([]models.RoomMember, 0, len(room.Users))
+	for _, uid := range room.Users {
+		members = append(members, h.member(room, uid))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// UpdateMemberRole lets the owner make a member an editor or a viewer.
+// Connected clients of that member pick up the new role immediately.
+func (h *RoomHandler) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+	memberID := chi.URLParam(r, "userId")
+
+	var req models.UpdateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role != models.RoleEditor && req.Role != models.RoleViewer {
+		http.Error(w, "role must be editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	switch room.RoleOf(memberID) {
+	case "":
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	case models.RoleOwner:
+		http.Error(w, "The owner's role cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.Rooms.SetRoomRole(context.TODO(), room.RoomID, memberID, req.Role)
 	if err != nil {
-		log.Printf("Error unmarshaling updated room: %v", err)
-		http.Error(w, "Error processing room", http.StatusInternalServerError)
+		http.Error(w, "Error updating role", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("User %s successfully joined room %s", userID, roomID)
+	member := h.member(room, memberID)
+	h.RoomManager.SetRole(room.RoomID, member)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "Successfully joined room",
-		"room":    room,
+	json.NewEncoder(w).Encode(member)
+}
+
+// SetInviteOnly lets the owner close the room to direct joins, leaving
+// invites as the only way in.
+func (h *RoomHandler) SetInviteOnly(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	var req models.InviteOnlyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.Rooms.SetInviteOnly(context.TODO(), room.RoomID, req.InviteOnly)
+	if err != nil {
+		http.Error(w, "Error updating room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.UpdateRoom(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// SetVisibility lets the owner make the room public, private or
+// password-protected. Members stay in the room whatever it changes to.
+func (h *RoomHandler) SetVisibility(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	var req models.VisibilityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash := room.PasswordHash
+	if req.Visibility != models.VisibilityPassword || req.Password != "" || passwordHash == "" {
+		var ok bool
+		if passwordHash, ok = roomPasswordHash(w, req.Visibility, req.Password); !ok {
+			return
+		}
+	}
+
+	room, err := h.Rooms.SetVisibility(context.TODO(), room.RoomID, req.Visibility, passwordHash)
+	if err != nil {
+		http.Error(w, "Error updating room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.UpdateRoom(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// SetCapacity lets the owner limit how many owners and editors can be
+// connected at once. Those over the limit wait in the lobby until a seat
+// frees up or the owner admits them.
+func (h *RoomHandler) SetCapacity(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	var req models.CapacityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validMaxEditors(w, req.MaxEditors) {
+		return
+	}
+
+	room, err := h.Rooms.SetMaxEditors(context.TODO(), room.RoomID, req.MaxEditors)
+	if err != nil {
+		http.Error(w, "Error updating room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.UpdateRoom(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// validMaxEditors answers 400 for editor limits out of range, 0 being no
+// limit.
+func validMaxEditors(w http.ResponseWriter, maxEditors int) bool {
+	if maxEditors < 0 || maxEditors > maxRoomEditors {
+		http.Error(w, "maxEditors must be between 0 and 100", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// SetDriverMode lets the owner turn driver mode on or off. In driver mode
+// only the driver edits code and, with rotateMinutes set, control passes on
+// every that many minutes.
+func (h *RoomHandler) SetDriverMode(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	var req models.DriverModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validRotation(w, req.RotateMinutes) {
+		return
+	}
+	if !req.Enabled {
+		req.RotateMinutes = 0
+	}
+
+	room, err := h.Rooms.SetDriverMode(context.TODO(), room.RoomID, req.Enabled, req.RotateMinutes)
+	if err != nil {
+		http.Error(w, "Error updating room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.UpdateRoom(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// validRotation answers 400 for driver rotation periods out of range, 0
+// being no rotation.
+func validRotation(w http.ResponseWriter, rotateMinutes int) bool {
+	if rotateMinutes < 0 || rotateMinutes > maxRotateMinutes {
+		http.Error(w, "rotateMinutes must be between 0 and 240", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// UpdateRoom lets the owner rename the room or change its description.
+func (h *RoomHandler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	var req models.UpdateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name, description := room.Name, room.Description
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > maxRoomName {
+			http.Error(w, "name must be between 1 and 100 characters", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Description != nil {
+		description = strings.TrimSpace(*req.Description)
+		if len(description) > maxRoomDescription {
+			http.Error(w, "description must be at most 1000 characters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	room, err := h.Rooms.UpdateRoomDetails(context.TODO(), room.RoomID, name, description)
+	if err != nil {
+		http.Error(w, "Error updating room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.UpdateRoom(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// ArchiveRoom lets the owner make the room read-only. Members can still
+// open it, but not edit, chat or let anyone new in.
+func (h *RoomHandler) ArchiveRoom(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, true)
+}
+
+func (h *RoomHandler) UnarchiveRoom(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, false)
+}
+
+func (h *RoomHandler) setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	room, err := h.Rooms.SetArchived(context.TODO(), room.RoomID, archived)
+	if err != nil {
+		http.Error(w, "Error updating room", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.UpdateRoom(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// DeleteRoom lets the owner delete the room along with its chat, code,
+// files and versions. Everyone connected is disconnected.
+func (h *RoomHandler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+
+	if err := h.Rooms.DeleteRoom(context.TODO(), room.RoomID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error deleting room %s: %v", room.RoomID, err)
+		http.Error(w, "Error deleting room", http.StatusInternalServerError)
+		return
+	}
+	h.RoomManager.CloseRoom(room.RoomID)
+
+	log.Printf("Room %s deleted by %s", room.RoomID, r.Context().Value(auth.UserIDKey).(string))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LeaveRoom removes the caller from the room and closes their connections
+// to it. The owner has to hand the room over or delete it instead.
+func (h *RoomHandler) LeaveRoom(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
+		return
+	}
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	if room.RoleOf(userID) == models.RoleOwner {
+		http.Error(w, "The owner cannot leave, transfer ownership or delete the room instead", http.StatusConflict)
+		return
+	}
+
+	if _, err := h.Rooms.RemoveRoomUser(context.TODO(), room.RoomID, userID); err != nil {
+		http.Error(w, "Error leaving room", http.StatusInternalServerError)
+		return
+	}
+	h.RoomManager.DisconnectUser(room.RoomID, userID, "left the room")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TransferOwnership lets the owner hand the room to another member, staying
+// on as an editor.
+func (h *RoomHandler) TransferOwnership(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner)
+	if room == nil {
+		return
+	}
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	var req models.TransferOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == userID {
+		http.Error(w, "You already own this room", http.StatusBadRequest)
+		return
+	}
+	if !isRoomMember(room, req.UserID) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	// Promote first so the room is never left without an owner.
+	if _, err := h.Rooms.SetRoomRole(context.TODO(), room.RoomID, req.UserID, models.RoleOwner); err != nil {
+		http.Error(w, "Error transferring ownership", http.StatusInternalServerError)
+		return
+	}
+	room, err := h.Rooms.SetRoomRole(context.TODO(), room.RoomID, userID, models.RoleEditor)
+	if err != nil {
+		http.Error(w, "Error transferring ownership", http.StatusInternalServerError)
+		return
+	}
+	fillRoles(room)
+	h.RoomManager.TransferOwnership(room.RoomID, h.member(room, userID), h.member(room, req.UserID))
+
+	log.Printf("User %s transferred room %s to %s", userID, room.RoomID, req.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+func (h *RoomHandler) member(room *models.Room, userID string) models.RoomMember {
+	member := models.RoomMember{UserID: userID, Role: room.RoleOf(userID)}
+	if user, err := h.Users.GetUser(context.TODO(), userID); err == nil {
+		member.Username = user.Username
+	}
+	return member
+}
+
+// fillRoles writes the effective role of every member into the room, so
+// clients see complete roles for rooms created before roles existed. It
+// fills in the visibility of such old rooms too, and drops mutes that have
+// run out.
+func fillRoles(room *models.Room) {
+	roles := make(map[string]string, len(room.Users))
+	for _, uid := range room.Users {
+		roles[uid] = room.RoleOf(uid)
+	}
+	room.Roles = roles
+	room.Visibility = room.EffectiveVisibility()
+	now := time.Now()
+	maps.DeleteFunc(room.Mutes, func(_ string, mute models.RoomMute) bool {
+		return !mute.Active(now)
 	})
 }
+
+// roomHidden reports whether room should look missing to userID, as
+// private rooms do to everyone but their members.
+func roomHidden(room *models.Room, userID string) bool {
+	return room.EffectiveVisibility() == models.VisibilityPrivate && !isRoomMember(room, userID)
+}
+
+// roomPasswordHash checks a requested visibility and hashes the passphrase
+// that password-protected rooms need, writing the error response if either
+// is not acceptable. The hash is empty for other visibilities.
+func roomPasswordHash(w http.ResponseWriter, visibility, password string) (string, bool) {
+	switch visibility {
+	case models.VisibilityPublic, models.VisibilityPrivate:
+		return "", true
+	case models.VisibilityPassword:
+	default:
+		http.Error(w, "visibility must be public, private or password", http.StatusBadRequest)
+		return "", false
+	}
+
+	if len(password) < minRoomPassword {
+		http.Error(w, "password must be at least 4 characters", http.StatusBadRequest)
+		return "", false
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return "", false
+	}
+	return string(hash), true
+}
+
+// requireRoomRole is requireRoomMember for endpoints limited to some roles.
+func requireRoomRole(w http.ResponseWriter, r *http.Request, rooms store.RoomStore, allowed ...string) *models.Room {
+	room := requireRoomMember(w, r, rooms)
+	if room == nil {
+		return nil
+	}
+	role := room.RoleOf(r.Context().Value(auth.UserIDKey).(string))
+	if slices.Contains(allowed, role) {
+		return room
+	}
+	if slices.Contains(allowed, models.RoleEditor) {
+		http.Error(w, "Viewers cannot edit this room", http.StatusForbidden)
+	} else {
+		http.Error(w, "Only the room owner can do this", http.StatusForbidden)
+	}
+	return nil
+}
+
+// touchRoom records activity in a room, at most once per interval set by
+// the RoomManager.
+func touchRoom(rm *services.RoomManager, rooms store.RoomStore, roomID string) {
+	if !rm.MarkActive(roomID) {
+		return
+	}
+	if err := rooms.TouchRoom(context.TODO(), roomID, time.Now()); err != nil {
+		log.Printf("Error recording activity in room %s: %v", roomID, err)
+	}
+}
+
+// requireUnarchived answers 409 for archived rooms, which are read-only.
+func requireUnarchived(w http.ResponseWriter, room *models.Room) bool {
+	if room.Archived {
+		http.Error(w, "This room is archived", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// requireUnbanned answers 403 if userID is banned from the room.
+func requireUnbanned(w http.ResponseWriter, room *models.Room, userID string) bool {
+	if room.Banned(userID) {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireUnmuted answers 403 if the caller is muted from editing the room,
+// or from chatting in it when edit is false.
+func requireUnmuted(w http.ResponseWriter, r *http.Request, room *models.Room, edit bool) bool {
+	mute := room.MuteOf(r.Context().Value(auth.UserIDKey).(string), time.Now())
+	if mute == nil {
+		return true
+	}
+	if edit && mute.Edit {
+		http.Error(w, "You are muted from editing", http.StatusForbidden)
+		return false
+	}
+	if !edit && mute.Chat {
+		http.Error(w, "You are muted from chat", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireDriver answers 403 if the room is in driver mode and someone else
+// drives it.
+func requireDriver(w http.ResponseWriter, r *http.Request, rm *services.RoomManager, room *models.Room) bool {
+	if !room.DriverMode {
+		return true
+	}
+	ok, err := rm.MayDrive(room.RoomID, r.Context().Value(auth.UserIDKey).(string))
+	if err != nil {
+		log.Printf("Error fetching driver state: %v", err)
+		http.Error(w, "Error fetching driver state", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Only the driver can edit in driver mode", http.StatusForbidden)
+	}
+	return ok
+}
+
+// requireRoomMember loads the room named in the URL and checks the caller
+// belongs to it, writing the error response and returning nil otherwise.
+// Private rooms are not found for anyone outside them.
+func requireRoomMember(w http.ResponseWriter, r *http.Request, rooms store.RoomStore) *models.Room {
+	roomID := chi.URLParam(r, "roomId")
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	room, err := rooms.GetRoom(context.TODO(), roomID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, "Error fetching room", http.StatusInternalServerError)
+		return nil
+	}
+	if roomHidden(room, userID) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil
+	}
+	if !isRoomMember(room, userID) {
+		http.Error(w, "Not a member of this room", http.StatusForbidden)
+		return nil
+	}
+	if room.SyncMode == "" {
+		room.SyncMode = models.SyncModeOT
+	}
+	fillRoles(room)
+	return room
+}
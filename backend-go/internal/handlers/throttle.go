@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+)
+
+// loginFailureWindow is how long failed logins are remembered after the
+// most recent one.
+const loginFailureWindow = time.Hour
+
+// loginLimit throttles failed logins for one kind of key. The first free
+// failures cost nothing. Each one after that doubles the wait before the
+// next attempt, and lockoutAfter failures lock the key for lockout.
+type loginLimit struct {
+	prefix       string
+	free         int
+	lockoutAfter int
+	lockout      time.Duration
+}
+
+// The per-IP limit is looser since many users can share an address.
+var (
+	accountLoginLimit = loginLimit{prefix: "email:", free: 3, lockoutAfter: 10, lockout: 15 * time.Minute}
+	ipLoginLimit      = loginLimit{prefix: "ip:", free: 10, lockoutAfter: 50, lockout: 15 * time.Minute}
+)
+
+func (l loginLimit) retryAt(attempts *models.LoginAttempts) time.Time {
+	switch {
+	case attempts.Failures >= l.lockoutAfter:
+		return attempts.LastFailure.Add(l.lockout)
+	case attempts.Failures > l.free:
+		backoff := time.Second << min(attempts.Failures-l.free-1, 20)
+		return attempts.LastFailure.Add(min(backoff, l.lockout))
+	default:
+		return time.Time{}
+	}
+}
+
+type loginKey struct {
+	limit loginLimit
+	key   string
+}
+
+func loginKeys(r *http.Request, email string) []loginKey {
+	return []loginKey{
+		{accountLoginLimit, accountLoginLimit.prefix + strings.ToLower(email)},
+		{ipLoginLimit, ipLoginLimit.prefix + clientIP(r)},
+	}
+}
+
+// loginWait returns how long until a login may be tried again for all of
+// keys, or zero if it may be tried now.
+func (h *AuthHandler) loginWait(keys []loginKey) (time.Duration, error) {
+	var wait time.Duration
+	now := time.Now()
+	for _, k := range keys {
+		attempts, err := h.Attempts.GetLoginAttempts(context.TODO(), k.key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, k.limit.retryAt(attempts).Sub(now))
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login against keys, audits any lockout
+// it causes and returns how long until the next attempt is allowed.
+// userID is empty when the email matched no account.
+func (h *AuthHandler) recordLoginFailure(r *http.Request, keys []loginKey, userID string) time.Duration {
+	var wait time.Duration
+	now := time.Now()
+	for _, k := range keys {
+		attempts, err := h.Attempts.RecordLoginFailure(context.TODO(), k.key, now, loginFailureWindow)
+		if err != nil {
+			log.Printf("Error recording failed login for %s: %v", k.key, err)
+			continue
+		}
+		retryAt := k.limit.retryAt(attempts)
+		wait = max(wait, retryAt.Sub(now))
+
+		if attempts.Failures >= k.limit.lockoutAfter {
+			log.Printf("Locked out %s after %d failed logins", k.key, attempts.Failures)
+			recordAudit(h.Audit, models.AuditEntry{
+				Scope:    models.AuditScopeAuth,
+				Action:   models.AuditActionLoginLockout,
+				TargetID: userID,
+				IP:       clientIP(r),
+				Details: map[string]string{
+					"key":         k.key,
+					"failures":    strconv.Itoa(attempts.Failures),
+					"lockedUntil": retryAt.UTC().Format(time.RFC3339),
+				},
+			})
+		}
+	}
+	return wait
+}
+
+// tooManyAttempts rejects a request that must wait before trying again.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	setRetryAfter(w, wait)
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+}
+
+// clientIP is the address the request came from. Behind a proxy it is only
+// the client's if TRUST_PROXY_HEADERS is set, which makes chi's RealIP
+// middleware rewrite RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+)
+
+func TestLoginLimitRetryAt(t *testing.T) {
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	capped := loginLimit{free: 0, lockoutAfter: 100, lockout: time.Minute}
+
+	tests := []struct {
+		name     string
+		limit    loginLimit
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", accountLoginLimit, 0, 0},
+		{"last free failure", accountLoginLimit, 3, 0},
+		{"first throttled failure", accountLoginLimit, 4, time.Second},
+		{"second throttled failure", accountLoginLimit, 5, 2 * time.Second},
+		{"last failure before lockout", accountLoginLimit, 9, 32 * time.Second},
+		{"lockout", accountLoginLimit, 10, 15 * time.Minute},
+		{"past lockout", accountLoginLimit, 25, 15 * time.Minute},
+		{"per-IP allowance", ipLoginLimit, 10, 0},
+		{"backoff capped at lockout", capped, 7, time.Minute},
+		{"backoff shift capped", capped, 99, time.Minute},
+	}
+	for _, tt := range tests {
+		got := tt.limit.retryAt(&models.LoginAttempts{Failures: tt.failures, LastFailure: last})
+		want := time.Time{}
+		if tt.want > 0 {
+			want = last.Add(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestRecordLoginFailureLocksOut(t *testing.T) {
+	h := NewAuthHandler(store.NewMemory(), nil, "")
+	r := httptest.NewRequest("POST", "/api/auth/login", nil)
+	r.RemoteAddr = "203.0.113.9:4321"
+	keys := loginKeys(r, "Alice@Example.com")
+
+	var wait time.Duration
+	for i := 0; i < accountLoginLimit.lockoutAfter; i++ {
+		wait = h.recordLoginFailure(r, keys, "u1")
+	}
+	if wait < accountLoginLimit.lockout-time.Second || wait > accountLoginLimit.lockout {
+		t.Errorf("got a wait of %v after %d failures, want about %v", wait, accountLoginLimit.lockoutAfter, accountLoginLimit.lockout)
+	}
+
+	wait, err := h.loginWait(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < accountLoginLimit.lockout-time.Minute {
+		t.Errorf("got a wait of %v before the next login, want about %v", wait, accountLoginLimit.lockout)
+	}
+
+	entries, err := h.Audit.ListAuditEntries(context.Background(), models.AuditScopeAuth, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Details["key"] != "email:alice@example.com" || entries[0].TargetID != "u1" {
+		t.Errorf("got audit entries %+v, want one lockout of email:alice@example.com", entries)
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		0:                       "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+		15 * time.Minute:        "900",
+	} {
+		w := httptest.NewRecorder()
+		setRetryAfter(w, wait)
+		if got := w.Header().Get("Retry-After"); got != want {
+			t.Errorf("wait of %v: got Retry-After %q, want %q", wait, got, want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/store"
+)
+
+// totpIssuer names the app in authenticator apps.
+const totpIssuer = "Pair Programming"
+
+// TwoFactorStatus tells the caller whether 2FA is on and how many recovery
+// codes they have left.
+func (h *AuthHandler) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	status := models.TwoFactorStatus{}
+	if tf := user.TwoFactor; tf != nil && tf.Enabled {
+		status.Enabled = true
+		status.RecoveryCodesLeft = len(tf.RecoveryCodes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// SetupTwoFactor starts enrolling an authenticator. The new secret stays
+// pending, and logins unchanged, until EnableTwoFactor confirms it.
+func (h *AuthHandler) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Users.SetTwoFactor(context.TODO(), user.UserID, &models.TwoFactor{Secret: secret}); err != nil {
+		http.Error(w, "Error saving secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.TwoFactorSetupResponse{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(totpIssuer, user.Email, secret),
+	})
+}
+
+// EnableTwoFactor turns 2FA on once the caller enters a code from the
+// authenticator they set up, and returns their recovery codes. They are
+// only shown this once.
+func (h *AuthHandler) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	tf := user.TwoFactor
+	if tf == nil {
+		http.Error(w, "Set up an authenticator first", http.StatusBadRequest)
+		return
+	}
+	if tf.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	step, valid := auth.ValidateTOTP(tf.Secret, req.Code, time.Now())
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+	enabled := models.TwoFactor{Secret: tf.Secret, Enabled: true, RecoveryCodes: hashes, LastStep: step}
+	if err := h.Users.SetTwoFactor(context.TODO(), user.UserID, &enabled); err != nil {
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s enabled two-factor authentication", user.UserID)
+	h.auditTwoFactor(r, models.AuditActionTwoFactorEnable, user.UserID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor turns 2FA off. The caller must enter their password
+// again, and wrong guesses count as failed logins.
+func (h *AuthHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.PasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	if !h.confirmPassword(w, r, user, req.Password) {
+		return
+	}
+
+	if err := h.Users.SetTwoFactor(context.TODO(), user.UserID, nil); err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s disabled two-factor authentication", user.UserID)
+	h.auditTwoFactor(r, models.AuditActionTwoFactorDisable, user.UserID, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginTwoFactor finishes a login that Login answered with a challenge,
+// given a code from the authenticator or an unused recovery code. Wrong
+// codes are throttled like wrong passwords.
+func (h *AuthHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req models.TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := auth.ValidateTwoFactorChallenge(req.ChallengeToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge, log in again", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.Users.GetUser(context.TODO(), claims.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Invalid or expired challenge, log in again", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		http.Error(w, "Invalid or expired challenge, log in again", http.StatusUnauthorized)
+		return
+	}
+
+	keys := loginKeys(r, user.Email)
+	wait, err := h.loginWait(keys)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	valid, err := h.checkSecondFactor(r, user, req)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		h.rejectLogin(w, r, keys, user.UserID)
+		return
+	}
+
+	h.Attempts.ClearLoginAttempts(context.TODO(), keys[0].key)
+	h.Users.UpdateLastSeen(context.TODO(), user.UserID, time.Now())
+
+	h.startSession(w, user)
+}
+
+// challengeTwoFactor answers a correct password for a user with 2FA on.
+func (h *AuthHandler) challengeTwoFactor(w http.ResponseWriter, user *models.User) {
+	token, expiresAt, err := auth.GenerateTwoFactorChallenge(user.UserID)
+	if err != nil {
+		http.Error(w, "Error generating challenge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.TwoFactorChallenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresAt:         expiresAt,
+	})
+}
+
+// checkSecondFactor redeems the code or recovery code of a 2FA login.
+// Each code works only once: a TOTP code's time step is recorded and a
+// recovery code is removed.
+func (h *AuthHandler) checkSecondFactor(r *http.Request, user *models.User, req models.TwoFactorLoginRequest) (bool, error) {
+	if req.RecoveryCode != "" {
+		err := h.Users.UseRecoveryCode(context.TODO(), user.UserID, auth.HashRecoveryCode(req.RecoveryCode))
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		left := len(user.TwoFactor.RecoveryCodes) - 1
+		log.Printf("User %s logged in with a recovery code, %d left", user.UserID, left)
+		h.auditTwoFactor(r, models.AuditActionRecoveryCodeUsed, user.UserID, map[string]string{
+			"remaining": strconv.Itoa(left),
+		})
+		return true, nil
+	}
+
+	step, valid := auth.ValidateTOTP(user.TwoFactor.Secret, req.Code, time.Now())
+	if !valid {
+		return false, nil
+	}
+	err := h.Users.UseTOTPStep(context.TODO(), user.UserID, step)
+	if errors.Is(err, store.ErrConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *AuthHandler) auditTwoFactor(r *http.Request, action, userID string, details map[string]string) {
+	recordAudit(h.Audit, models.AuditEntry{
+		Scope:    models.AuditScopeAuth,
+		Action:   action,
+		ActorID:  userID,
+		TargetID: userID,
+		IP:       clientIP(r),
+		Details:  details,
+	})
+}
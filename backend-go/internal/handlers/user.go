@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/services"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxUsername    = 50
+	maxDisplayName = 100
+	maxAvatarURL   = 2048
+)
+
+// UserHandler lets users manage their own profile and account. Password
+// checks and sessions go through Auth.
+type UserHandler struct {
+	Auth        *AuthHandler
+	RoomManager *services.RoomManager
+	Rooms       store.RoomStore
+	APITokens   store.APITokenStore
+}
+
+func NewUserHandler(authHandler *AuthHandler, rm *services.RoomManager, s *store.Store) *UserHandler {
+	return &UserHandler{
+		Auth:        authHandler,
+		RoomManager: rm,
+		Rooms:       s.Rooms,
+		APITokens:   s.APITokens,
+	}
+}
+
+func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.Auth.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// UpdateMe changes the caller's profile. A new username shows up right
+// away for everyone in the rooms the caller is connected to.
+func (h *UserHandler) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.Auth.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if message := applyProfile(user, &req); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	renamed := req.Username != nil && *req.Username != r.Context().Value(auth.UsernameKey).(string)
+
+	if err := h.Auth.Users.UpdateProfile(context.TODO(), user); err != nil {
+		http.Error(w, "Error saving profile", http.StatusInternalServerError)
+		return
+	}
+
+	if renamed {
+		rooms, err := h.Rooms.QueryRooms(context.TODO(), store.RoomQuery{MemberID: user.UserID})
+		if err != nil {
+			log.Printf("Error finding rooms of renamed user %s: %v", user.UserID, err)
+		}
+		for _, room := range rooms {
+			h.RoomManager.RenameUser(room.RoomID, user.UserID, user.Username)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// session is ended, and the response carries tokens for a new one in
+// place of the caller's.
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.Auth.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == "" {
+		http.Error(w, "newPassword is required", http.StatusBadRequest)
+		return
+	}
+	if user.HashedPassword == "" {
+		http.Error(w, "This account has no password yet, use password reset to set one", http.StatusBadRequest)
+		return
+	}
+	if !h.Auth.confirmPassword(w, r, user, req.CurrentPassword) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error processing password", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Auth.Users.UpdatePassword(context.TODO(), user.UserID, string(hashedPassword)); err != nil {
+		http.Error(w, "Error saving password", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Auth.Sessions.DeleteUserSessions(context.TODO(), user.UserID); err != nil {
+		log.Printf("Error ending sessions after password change: %v", err)
+	}
+
+	log.Printf("User %s changed their password", user.UserID)
+	h.Auth.startSession(w, user)
+}
+
+// DeleteMe deletes the caller's account, after they re-enter their
+// password if they have one. They leave every room, handing rooms they
+// own to the next member, and lose their sessions and API tokens. Chat
+// messages they sent stay behind.
+func (h *UserHandler) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.Auth.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.PasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if user.HashedPassword != "" && !h.Auth.confirmPassword(w, r, user, req.Password) {
+		return
+	}
+
+	rooms, err := h.Rooms.QueryRooms(context.TODO(), store.RoomQuery{MemberID: user.UserID})
+	if err != nil {
+		http.Error(w, "Error fetching rooms", http.StatusInternalServerError)
+		return
+	}
+	for _, room := range rooms {
+		if err := h.leaveRoom(&room, user.UserID); err != nil {
+			log.Printf("Error removing user %s from room %s: %v", user.UserID, room.RoomID, err)
+			http.Error(w, "Error leaving rooms", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tokens, err := h.APITokens.ListAPITokens(context.TODO(), user.UserID)
+	if err != nil {
+		http.Error(w, "Error fetching API tokens", http.StatusInternalServerError)
+		return
+	}
+	for _, token := range tokens {
+		if err := h.APITokens.DeleteAPIToken(context.TODO(), user.UserID, token.TokenID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Error revoking API tokens", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := h.Auth.Sessions.DeleteUserSessions(context.TODO(), user.UserID); err != nil {
+		http.Error(w, "Error ending sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Auth.Users.DeleteUser(context.TODO(), user.UserID); err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s deleted their account", user.UserID)
+	recordAudit(h.Auth.Audit, models.AuditEntry{
+		Scope:    models.AuditScopeAuth,
+		Action:   models.AuditActionAccountDeleted,
+		ActorID:  user.UserID,
+		TargetID: user.UserID,
+		IP:       clientIP(r),
+		Details:  map[string]string{"email": user.Email},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetUser returns the public profile of any user.
+func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.Auth.Users.GetUser(context.TODO(), chi.URLParam(r, "userId"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.PublicProfile{
+		UserID:      user.UserID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		CreatedAt:   user.CreatedAt,
+	})
+}
+
+// leaveRoom removes a departing user from a room and closes their
+// connections to it. If they owned it, the longest standing remaining
+// member becomes the owner.
+func (h *UserHandler) leaveRoom(room *models.Room, userID string) error {
+	wasOwner := room.RoleOf(userID) == models.RoleOwner
+	updated, err := h.Rooms.RemoveRoomUser(context.TODO(), room.RoomID, userID)
+	if err != nil {
+		return err
+	}
+	h.RoomManager.DisconnectUser(room.RoomID, userID, "account deleted")
+
+	if wasOwner && len(updated.Users) > 0 {
+		heir := updated.Users[0]
+		if _, err := h.Rooms.SetRoomRole(context.TODO(), room.RoomID, heir, models.RoleOwner); err != nil {
+			return err
+		}
+		member := models.RoomMember{UserID: heir, Role: models.RoleOwner}
+		if user, err := h.Auth.Users.GetUser(context.TODO(), heir); err == nil {
+			member.Username = user.Username
+		}
+		h.RoomManager.SetRole(room.RoomID, member)
+		log.Printf("User %s took over room %s from deleted user %s", heir, room.RoomID, userID)
+	}
+	return nil
+}
+
+// applyProfile copies the fields set in req onto user, returning a message
+// for the client if one is invalid.
+func applyProfile(user *models.User, req *models.UpdateProfileRequest) string {
+	if req.Username != nil {
+		username := strings.TrimSpace(*req.Username)
+		if username == "" || len(username) > maxUsername {
+			return "username must be between 1 and 50 characters"
+		}
+		user.Username = username
+	}
+	if req.DisplayName != nil {
+		displayName := strings.TrimSpace(*req.DisplayName)
+		if len(displayName) > maxDisplayName {
+			return "displayName must be at most 100 characters"
+		}
+		user.DisplayName = displayName
+	}
+	if req.AvatarURL != nil {
+		if *req.AvatarURL != "" && !validAvatarURL(*req.AvatarURL) {
+			return "avatarUrl must be an http or https URL"
+		}
+		user.AvatarURL = *req.AvatarURL
+	}
+	if prefs := req.Preferences; prefs != nil {
+		if prefs.EditorTheme != nil {
+			if *prefs.EditorTheme != "" && !slices.Contains(models.EditorThemes, *prefs.EditorTheme) {
+				return "editorTheme must be one of " + strings.Join(models.EditorThemes, ", ")
+			}
+			user.Preferences.EditorTheme = *prefs.EditorTheme
+		}
+		if prefs.Keybindings != nil {
+			if *prefs.Keybindings != "" && !slices.Contains(models.Keybindings, *prefs.Keybindings) {
+				return "keybindings must be one of " + strings.Join(models.Keybindings, ", ")
+			}
+			user.Preferences.Keybindings = *prefs.Keybindings
+		}
+	}
+	return ""
+}
+
+func validAvatarURL(raw string) bool {
+	if len(raw) > maxAvatarURL {
+		return false
+	}
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/services"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultVersionPage = 20
+	maxVersionPage     = 100
+)
+
+type VersionHandler struct {
+	RoomManager *services.RoomManager
+	Snapshots   *services.SnapshotScheduler
+	Rooms       store.RoomStore
+	Code        store.CodeStore
+	Versions    store.VersionStore
+}
+
+func NewVersionHandler(rm *services.RoomManager, snapshots *services.SnapshotScheduler, s *store.Store) *VersionHandler {
+	return &VersionHandler{
+		RoomManager: rm,
+		Snapshots:   snapshots,
+		Rooms:       s.Rooms,
+		Code:        s.Code,
+		Versions:    s.Versions,
+	}
+}
+
+func (h *VersionHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
+		return
+	}
+
+	limit := defaultVersionPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxVersionPage)
+	}
+
+	versions, err := h.Versions.ListVersions(context.TODO(), room.RoomID, r.URL.Query().Get("before"), limit)
+	if err != nil {
+		http.Error(w, "Error fetching versions", http.StatusInternalServerError)
+		return
+	}
+	for i := range versions {
+		versions[i].Code = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+func (h *VersionHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
+		return
+	}
+
+	version, ok := h.loadVersion(w, room.RoomID, chi.URLParam(r, "versionId"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// DiffVersions diffs version from against version to, or against the
+// room's current code when to is omitted.
+func (h *VersionHandler) DiffVersions(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
+		return
+	}
+
+	params := r.URL.Query()
+	if params.Get("from") == "" {
+		http.Error(w, "Missing from version", http.StatusBadRequest)
+		return
+	}
+	from, ok := h.loadVersion(w, room.RoomID, params.Get("from"))
+	if !ok {
+		return
+	}
+
+	var to *models.CodeVersion
+	if params.Get("to") != "" {
+		if to, ok = h.loadVersion(w, room.RoomID, params.Get("to")); !ok {
+			return
+		}
+	} else {
+		fileID := fileIDOrMain(from.FileID)
+		codeSync, err := codeLoader(h.Code, room.RoomID, fileID)()
+		if err != nil {
+			writeLoadError(w, err)
+			return
+		}
+		to = &models.CodeVersion{
+			RoomID:    room.RoomID,
+			VersionID: "current",
+			FileID:    fileID,
+			Code:      codeSync.Code,
+			Language:  codeSync.Language,
+			Revision:  codeSync.Revision,
+			CreatedAt: codeSync.UpdatedAt,
+		}
+	}
+
+	lines := services.DiffLines(from.Code, to.Code)
+	from.Code, to.Code = "", ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.VersionDiff{From: *from, To: *to, Lines: lines})
+}
+
+// RestoreVersion makes an old version the room's current code. The restore
+// goes through the live document like any other edit so connected editors
+// stay in sync, and is itself recorded as a new version.
+func (h *VersionHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner, models.RoleEditor)
+	if room == nil || !requireUnarchived(w, room) || !requireUnmuted(w, r, room, true) {
+		return
+	}
+	if !requireDriver(w, r, h.RoomManager, room) {
+		return
+	}
+	userID := r.Context().Value(auth.UserIDKey).(string)
+	username := r.Context().Value(auth.UsernameKey).(string)
+
+	version, ok := h.loadVersion(w, room.RoomID, chi.URLParam(r, "versionId"))
+	if !ok {
+		return
+	}
+	fileID := fileIDOrMain(version.FileID)
+
+	if room.SyncMode == models.SyncModeCRDT {
+		doc, err := h.RoomManager.GetCRDTDocument(room.RoomID, fileID, codeLoader(h.Code, room.RoomID, fileID))
+		if err != nil {
+			writeLoadError(w, err)
+			return
+		}
+		updates := doc.Replace(h.RoomManager.CRDTClient(), version.Code)
+		if err := h.Code.AppendCRDTUpdates(context.TODO(), room.RoomID, fileID, doc.Text(), updates); err != nil {
+			http.Error(w, "Error saving code", http.StatusInternalServerError)
+			return
+		}
+
+		broadcastMsg, _ := json.Marshal(models.WSMessage{
+			Type: "crdt_update",
+			Payload: models.CRDTUpdatePayload{
+				RoomID:   room.RoomID,
+				FileID:   fileID,
+				UserID:   userID,
+				Username: username,
+				Updates:  updates,
+			},
+		})
+		h.RoomManager.BroadcastToRoom(room.RoomID, broadcastMsg, "")
+	} else {
+		doc, err := h.RoomManager.GetDocument(room.RoomID, fileID, codeLoader(h.Code, room.RoomID, fileID))
+		if err != nil {
+			writeLoadError(w, err)
+			return
+		}
+		ops, applied, err := doc.Replace(userID, version.Code, version.Language)
+		if err != nil {
+			log.Printf("Error restoring version: %v", err)
+			if errors.Is(err, services.ErrEditsGone) {
+				h.RoomManager.DropDocument(room.RoomID, fileID)
+			}
+			http.Error(w, "Error restoring version", http.StatusInternalServerError)
+			return
+		}
+		code, language, current := doc.Snapshot()
+		if err := h.Code.UpdateCode(context.TODO(), room.RoomID, fileID, code, language, current); err != nil {
+			http.Error(w, "Error saving code", http.StatusInternalServerError)
+			return
+		}
+
+		broadcastMsg, _ := json.Marshal(models.WSMessage{
+			Type: "code_change",
+			Payload: models.CodeChangePayload{
+				RoomID:   room.RoomID,
+				FileID:   fileID,
+				UserID:   userID,
+				Username: username,
+				Code:     applied.Code,
+				Language: applied.Language,
+				Revision: applied.Revision,
+				Changes:  ops,
+			},
+		})
+		h.RoomManager.BroadcastToRoom(room.RoomID, broadcastMsg, "")
+	}
+
+	restored, err := snapshotCode(h.Code, h.Versions, room.RoomID, fileID, models.VersionReasonRestore, "Restored "+version.VersionID, userID, username)
+	if err != nil {
+		log.Printf("Error saving restore version: %v", err)
+		http.Error(w, "Error saving version", http.StatusInternalServerError)
+		return
+	}
+	h.Snapshots.Taken(room.RoomID+"/"+fileID, restored.CreatedAt)
+
+	restoredMsg, _ := json.Marshal(models.WSMessage{
+		Type: "version_restored",
+		Payload: map[string]interface{}{
+			"version":      restored,
+			"restoredFrom": version.VersionID,
+		},
+	})
+	h.RoomManager.BroadcastToRoom(room.RoomID, restoredMsg, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restored)
+}
+
+func (h *VersionHandler) loadVersion(w http.ResponseWriter, roomID, versionID string) (*models.CodeVersion, bool) {
+	version, err := h.Versions.GetVersion(context.TODO(), roomID, versionID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Error fetching version", http.StatusInternalServerError)
+		return nil, false
+	}
+	return version, true
+}
+
+func writeLoadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Error loading document", http.StatusInternalServerError)
+}
+
+// snapshotCode records a file's stored code as a new version. Callers
+// persist their edit first so the snapshot matches what clients see.
+func snapshotCode(code store.CodeStore, versions store.VersionStore, roomID, fileID, reason, label, authorID, authorName string) (*models.CodeVersion, error) {
+	codeSync, err := codeLoader(code, roomID, fileID)()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	version := &models.CodeVersion{
+		RoomID:     roomID,
+		VersionID:  services.NewVersionID(now),
+		FileID:     fileID,
+		Code:       codeSync.Code,
+		Language:   codeSync.Language,
+		Revision:   codeSync.Revision,
+		Reason:     reason,
+		Label:      label,
+		AuthorID:   authorID,
+		AuthorName: authorName,
+		CreatedAt:  now,
+	}
+	if err := versions.SaveVersion(context.TODO(), version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
@@ -3,17 +3,16 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"slices"
 	"time"
 
-	"github.com/anant/realtime-pair-programming/internal/db"
+	"github.com/anant/realtime-pair-programming/internal/auth"
 	"github.com/anant/realtime-pair-programming/internal/models"
 	"github.com/anant/realtime-pair-programming/internal/services"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/anant/realtime-pair-programming/internal/store"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -23,45 +22,120 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		return true 
+		return true
 	},
 }
 
 type WebSocketHandler struct {
 	RoomManager *services.RoomManager
-	DB          *db.DynamoDB
+	Rooms       store.RoomStore
+	Messages    store.MessageStore
+	Code        store.CodeStore
+	Files       store.FileStore
+	Versions    store.VersionStore
+	Verifier    *auth.Verifier
+	Snapshots   *services.SnapshotScheduler
+	Moderation  *ModerationHandler
 }
 
-func NewWebSocketHandler(rm *services.RoomManager, database *db.DynamoDB) *WebSocketHandler {
+func NewWebSocketHandler(rm *services.RoomManager, snapshots *services.SnapshotScheduler, s *store.Store) *WebSocketHandler {
 	return &WebSocketHandler{
 		RoomManager: rm,
-		DB:          database,
+		Rooms:       s.Rooms,
+		Messages:    s.Messages,
+		Code:        s.Code,
+		Files:       s.Files,
+		Versions:    s.Versions,
+		Verifier:    auth.NewVerifier(s.Sessions, s.APITokens, s.Users),
+		Snapshots:   snapshots,
+		Moderation:  NewModerationHandler(rm, s),
 	}
 }
 
+const (
+	chatHistorySize   = 50
+	authTimeout       = 10 * time.Second
+	reauthWarning     = 2 * time.Minute
+	tokenProtocol     = "access_token"
+	closeUnauthorized = 4001
+	closeForbidden    = 4003
+	closeNotFound     = 4004
+	maxDeviceID       = 100
+)
+
 func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	roomID := chi.URLParam(r, "roomId")
-	userID := r.URL.Query().Get("userId")
-	username := r.URL.Query().Get("username")
-
-	if roomID == "" || userID == "" || username == "" {
-		http.Error(w, "Missing roomId, userId, or username", http.StatusBadRequest)
+	if roomID == "" {
+		http.Error(w, "Missing roomId", http.StatusBadRequest)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// The room is only looked up once the caller is known, so private rooms
+	// look missing to non-members however they authenticate.
+	var claims *auth.Claims
+	var scopes []string
+	var room *models.Room
+	var status int
+	var reason string
+	token, viaProtocol := tokenFromRequest(r)
+	if token != "" {
+		var err error
+		if claims, scopes, err = h.validateToken(token); err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if room, status, reason = h.roomFor(roomID, claims.UserID); room == nil {
+			http.Error(w, reason, status)
+			return
+		}
+	}
+
+	var responseHeader http.Header
+	if viaProtocol {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": []string{tokenProtocol}}
+	}
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
+	if claims == nil {
+		claims, scopes, err = h.readAuthFrame(conn)
+		if err != nil {
+			closeConn(conn, closeUnauthorized, "authentication required")
+			return
+		}
+		if room, status, reason = h.roomFor(roomID, claims.UserID); room == nil {
+			closeConn(conn, closeCode(status), reason)
+			return
+		}
+	}
+
 	client := &services.Client{
-		ConnID:   uuid.New().String(),
-		UserID:   userID,
-		Username: username,
-		RoomID:   roomID,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
+		ConnID:        uuid.New().String(),
+		UserID:        claims.UserID,
+		RoomID:        roomID,
+		SyncMode:      room.SyncMode,
+		MaxEditors:    room.MaxEditors,
+		DriverMode:    room.DriverMode,
+		RotateMinutes: room.RotateMinutes,
+		Scopes:        scopes,
+		ExpiresAt:     tokenExpiry(claims),
+		Reauth:        make(chan time.Time, 1),
+		Disconnect:    make(chan string, 1),
+		Conn:          conn,
+		Send:          make(chan []byte, 256),
+	}
+	client.SetRole(room.RoleOf(claims.UserID))
+	client.SetUsername(claims.Username)
+	client.SetArchived(room.Archived)
+	client.SetMute(room.MuteOf(claims.UserID, time.Now()))
+
+	client.OnAdmit = func() {
+		h.sendChatHistory(client)
+		h.sendFileTree(client)
+		h.sendDriverState(client)
 	}
 
 	h.RoomManager.RegisterClient(client)
@@ -70,6 +144,190 @@ func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reques
 	go h.readPump(client)
 }
 
+func (h *WebSocketHandler) sendChatHistory(client *services.Client) {
+	messages, err := h.Messages.ListMessages(context.TODO(), client.RoomID, store.MessageQuery{Limit: chatHistorySize})
+	if err != nil {
+		log.Printf("Error loading chat history: %v", err)
+		return
+	}
+
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "chat_history",
+		Payload: messages,
+	})
+	h.RoomManager.SendToClient(client, data)
+}
+
+func (h *WebSocketHandler) sendFileTree(client *services.Client) {
+	files, err := loadWorkspace(h.Files, h.Code, client.RoomID)
+	if err != nil {
+		log.Printf("Error loading file tree: %v", err)
+		return
+	}
+
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "file_tree",
+		Payload: files,
+	})
+	h.RoomManager.SendToClient(client, data)
+}
+
+// roomFor loads the room userID is connecting to. When the user may not
+// connect it returns nil with the HTTP status and reason to refuse with.
+func (h *WebSocketHandler) roomFor(roomID, userID string) (*models.Room, int, string) {
+	room, err := h.loadRoom(roomID)
+	switch {
+	case err != nil:
+		log.Printf("Error fetching room: %v", err)
+		return nil, http.StatusInternalServerError, "Error fetching room"
+	case room == nil || roomHidden(room, userID):
+		return nil, http.StatusNotFound, "Room not found"
+	case room.Banned(userID):
+		return nil, http.StatusForbidden, "You are banned from this room"
+	case !isRoomMember(room, userID):
+		return nil, http.StatusForbidden, "Not a member of this room"
+	}
+	return room, 0, ""
+}
+
+// closeCode is the WebSocket close code for refusing a connection that
+// authenticated after the upgrade with an HTTP status.
+func closeCode(status int) int {
+	switch status {
+	case http.StatusNotFound:
+		return closeNotFound
+	case http.StatusForbidden:
+		return closeForbidden
+	default:
+		return websocket.CloseInternalServerErr
+	}
+}
+
+func (h *WebSocketHandler) loadRoom(roomID string) (*models.Room, error) {
+	room, err := h.Rooms.GetRoom(context.TODO(), roomID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if room.SyncMode == "" {
+		room.SyncMode = models.SyncModeOT
+	}
+	return room, nil
+}
+
+// tokenFromRequest looks for a JWT in the token query parameter or in the
+// subprotocol list as "access_token, <jwt>", which browsers can set where
+// they cannot set an Authorization header.
+func tokenFromRequest(r *http.Request) (string, bool) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, false
+	}
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == tokenProtocol && i+1 < len(protocols) {
+			return protocols[i+1], true
+		}
+	}
+	return "", false
+}
+
+func (h *WebSocketHandler) readAuthFrame(conn *websocket.Conn) (*auth.Claims, []string, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var msg models.WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return nil, nil, err
+	}
+	if msg.Type != "auth" {
+		return nil, nil, errors.New("first message must be auth")
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload models.AuthPayload
+	json.Unmarshal(payloadBytes, &payload)
+	return h.validateToken(payload.Token)
+}
+
+// validateToken checks a token like auth.Middleware does, including
+// against the revocation list, and returns the scopes of an API token.
+// API tokens need the ws:connect scope.
+func (h *WebSocketHandler) validateToken(token string) (*auth.Claims, []string, error) {
+	claims, scopes, err := h.Verifier.Verify(context.TODO(), token)
+	if err != nil {
+		if !errors.Is(err, auth.ErrInvalidToken) && !errors.Is(err, auth.ErrRevoked) {
+			log.Printf("Error verifying token: %v", err)
+		}
+		return nil, nil, err
+	}
+	if scopes != nil && !slices.Contains(scopes, models.ScopeWSConnect) {
+		return nil, nil, errors.New("API token lacks the ws:connect scope")
+	}
+	return claims, scopes, nil
+}
+
+// messageScopes are the API token scopes WebSocket messages need on top of
+// ws:connect, the same ones as the REST routes that do the same things.
+var messageScopes = map[string]string{
+	"chat":            models.ScopeChatWrite,
+	"code_change":     models.ScopeRoomsWrite,
+	"crdt_update":     models.ScopeRoomsWrite,
+	"checkpoint":      models.ScopeRoomsWrite,
+	"admit":           models.ScopeRoomsWrite,
+	"request_control": models.ScopeRoomsWrite,
+	"grant_control":   models.ScopeRoomsWrite,
+	"release_control": models.ScopeRoomsWrite,
+	"kick":            models.ScopeRoomsWrite,
+	"ban":             models.ScopeRoomsWrite,
+	"unban":           models.ScopeRoomsWrite,
+	"mute":            models.ScopeRoomsWrite,
+	"unmute":          models.ScopeRoomsWrite,
+}
+
+// sameScopes reports whether a token used to reauthenticate grants what
+// the connection's first one did, so reauth never changes its scopes.
+func sameScopes(a, b []string) bool {
+	if (a == nil) != (b == nil) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+func isRoomMember(room *models.Room, userID string) bool {
+	for _, uid := range room.Users {
+		if uid == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenExpiry(claims *auth.Claims) time.Time {
+	if claims.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt.Time
+}
+
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	conn.Close()
+}
+
 func (h *WebSocketHandler) readPump(client *services.Client) {
 	defer func() {
 		h.RoomManager.UnregisterClient(client)
@@ -103,13 +361,60 @@ func (h *WebSocketHandler) readPump(client *services.Client) {
 
 func (h *WebSocketHandler) writePump(client *services.Client) {
 	ticker := time.NewTicker(54 * time.Second)
+	warn := time.NewTimer(time.Hour)
+	expire := time.NewTimer(time.Hour)
+	expiresAt := client.ExpiresAt
+	resetExpiry := func() {
+		stopTimer(warn)
+		stopTimer(expire)
+		if expiresAt.IsZero() {
+			return
+		}
+		warn.Reset(time.Until(expiresAt.Add(-reauthWarning)))
+		expire.Reset(time.Until(expiresAt))
+	}
+	resetExpiry()
 	defer func() {
 		ticker.Stop()
+		warn.Stop()
+		expire.Stop()
 		client.Conn.Close()
 	}()
 
 	for {
 		select {
+		case expiresAt = <-client.Reauth:
+			resetExpiry()
+
+		case <-warn.C:
+			data, _ := json.Marshal(models.WSMessage{
+				Type:    "reauth_required",
+				Payload: map[string]interface{}{"expiresAt": expiresAt},
+			})
+			client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := client.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+
+		case <-expire.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			client.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeUnauthorized, "token expired"))
+			return
+
+		case reason := <-client.Disconnect:
+			client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			// Deliver what is already queued first, such as the message
+			// saying why the connection is being closed.
+			for len(client.Send) > 0 {
+				message, ok := <-client.Send
+				if !ok {
+					break
+				}
+				client.Conn.WriteMessage(websocket.TextMessage, message)
+			}
+			client.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeForbidden, reason))
+			return
+
 		case message, ok := <-client.Send:
 			client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
@@ -131,43 +436,386 @@ func (h *WebSocketHandler) writePump(client *services.Client) {
 }
 
 func (h *WebSocketHandler) handleMessage(client *services.Client, msg *models.WSMessage) {
+	if client.Waiting() && msg.Type != "reauth" {
+		h.sendError(client, "You are waiting in the lobby")
+		return
+	}
+	if scope := messageScopes[msg.Type]; scope != "" && !client.HasScope(scope) {
+		h.sendError(client, "API token lacks the "+scope+" scope")
+		return
+	}
+	switch msg.Type {
+	case "code_change", "crdt_update", "checkpoint", "chat":
+		if client.Archived() {
+			h.sendError(client, "This room is archived")
+			return
+		}
+	}
+	switch msg.Type {
+	case "code_change", "crdt_update", "checkpoint":
+		if !models.CanEdit(client.Role()) {
+			h.sendError(client, "Viewers cannot edit this room")
+			return
+		}
+		if mute := client.Mute(); mute != nil && mute.Edit {
+			h.sendError(client, "You are muted from editing")
+			return
+		}
+		if msg.Type != "checkpoint" && !h.RoomManager.CanDrive(client) {
+			h.sendError(client, "Only the driver can edit in driver mode")
+			return
+		}
+	case "chat":
+		if mute := client.Mute(); mute != nil && mute.Chat {
+			h.sendError(client, "You are muted from chat")
+			return
+		}
+	}
+
 	switch msg.Type {
+	case "reauth":
+		h.handleReauth(client, msg)
 	case "code_change":
+		if client.SyncMode != models.SyncModeOT {
+			h.sendError(client, "Room uses "+client.SyncMode+" sync, send crdt_update instead")
+			return
+		}
 		h.handleCodeChange(client, msg)
+	case "crdt_update", "crdt_sync":
+		if client.SyncMode != models.SyncModeCRDT {
+			h.sendError(client, "Room uses "+client.SyncMode+" sync, send code_change instead")
+			return
+		}
+		if msg.Type == "crdt_update" {
+			h.handleCRDTUpdate(client, msg)
+		} else {
+			h.handleCRDTSync(client, msg)
+		}
+	case "checkpoint":
+		h.handleCheckpoint(client, msg)
 	case "chat":
 		h.handleChat(client, msg)
 	case "cursor":
 		h.handleCursor(client, msg)
+	case "admit":
+		h.handleAdmit(client, msg)
+	case "request_control", "grant_control", "release_control":
+		h.handleControl(client, msg)
+	case "kick", "ban", "unban", "mute", "unmute":
+		if err := h.Moderation.handleWS(client, msg); err != nil {
+			_, message := moderationStatus(err)
+			h.sendError(client, message)
+		}
 	default:
 		log.Printf("Unknown message type: %s", msg.Type)
 	}
 }
 
+// handleAdmit lets the owner admit a user from the lobby ahead of their
+// turn, even when the room is full.
+func (h *WebSocketHandler) handleAdmit(client *services.Client, msg *models.WSMessage) {
+	if client.Role() != models.RoleOwner {
+		h.sendError(client, "Only the room owner can do this")
+		return
+	}
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload models.LobbyEntry
+	json.Unmarshal(payloadBytes, &payload)
+	if payload.UserID == "" {
+		h.sendError(client, "userId is required")
+		return
+	}
+	h.RoomManager.Admit(client.RoomID, payload.UserID)
+}
+
+// handleControl passes control of a room in driver mode between its
+// members.
+func (h *WebSocketHandler) handleControl(client *services.Client, msg *models.WSMessage) {
+	var err error
+	switch msg.Type {
+	case "request_control":
+		err = h.RoomManager.RequestControl(client)
+	case "grant_control":
+		payloadBytes, _ := json.Marshal(msg.Payload)
+		var payload models.ControlPayload
+		json.Unmarshal(payloadBytes, &payload)
+		err = h.RoomManager.GrantControl(client, payload.UserID)
+	case "release_control":
+		err = h.RoomManager.ReleaseControl(client)
+	}
+
+	switch {
+	case errors.Is(err, services.ErrDriverModeOff):
+		h.sendError(client, "Driver mode is off in this room")
+	case errors.Is(err, services.ErrNotDriver):
+		h.sendError(client, "Only the driver can do this")
+	case errors.Is(err, services.ErrCannotDrive):
+		h.sendError(client, "Viewers cannot drive")
+	case errors.Is(err, services.ErrNoRequest):
+		h.sendError(client, "That user has not asked for control")
+	}
+}
+
+func (h *WebSocketHandler) sendDriverState(client *services.Client) {
+	state := h.RoomManager.DriverState(client.RoomID)
+	if state == nil {
+		return
+	}
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "driver_state",
+		Payload: state,
+	})
+	h.RoomManager.SendToClient(client, data)
+}
+
+func (h *WebSocketHandler) handleReauth(client *services.Client, msg *models.WSMessage) {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload models.AuthPayload
+	json.Unmarshal(payloadBytes, &payload)
+
+	claims, scopes, err := h.validateToken(payload.Token)
+	if err != nil || claims.UserID != client.UserID || !sameScopes(scopes, client.Scopes) {
+		h.sendError(client, "Invalid token")
+		return
+	}
+
+	expiresAt := tokenExpiry(claims)
+	select {
+	case <-client.Reauth:
+	default:
+	}
+	client.Reauth <- expiresAt
+
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "reauth_ok",
+		Payload: map[string]interface{}{"expiresAt": expiresAt},
+	})
+	h.RoomManager.SendToClient(client, data)
+}
+
 func (h *WebSocketHandler) handleCodeChange(client *services.Client, msg *models.WSMessage) {
 	payloadBytes, _ := json.Marshal(msg.Payload)
 	var payload models.CodeChangePayload
 	json.Unmarshal(payloadBytes, &payload)
-	_, err := h.DB.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String(h.DB.CodeSyncTable),
-		Key: map[string]types.AttributeValue{
-			"roomId": &types.AttributeValueMemberS{Value: client.RoomID},
+	fileID := fileIDOrMain(payload.FileID)
+
+	doc, err := h.RoomManager.GetDocument(client.RoomID, fileID, codeLoader(h.Code, client.RoomID, fileID))
+	if err != nil {
+		h.sendLoadError(client, err)
+		return
+	}
+
+	var ops []models.TextOp
+	var applied services.OTSnapshot
+	if payload.Changes != nil {
+		ops, applied, err = doc.Apply(client.UserID, payload.Revision, payload.Changes, payload.Language)
+	} else {
+		ops, applied, err = doc.Replace(client.UserID, payload.Code, payload.Language)
+	}
+	if err != nil {
+		log.Printf("Rejected code change from %s at revision %d: %v", client.UserID, payload.Revision, err)
+		if errors.Is(err, services.ErrEditsGone) {
+			// Too far behind the other nodes to catch up from the log.
+			h.RoomManager.DropDocument(client.RoomID, fileID)
+			if doc, err = h.RoomManager.GetDocument(client.RoomID, fileID, codeLoader(h.Code, client.RoomID, fileID)); err != nil {
+				h.sendLoadError(client, err)
+				return
+			}
+		}
+		h.sendResync(client, fileID, doc)
+		return
+	}
+
+	// Saved as of the latest revision, which may already be past this edit.
+	code, language, current := doc.Snapshot()
+	if err := h.Code.UpdateCode(context.TODO(), client.RoomID, fileID, code, language, current); err != nil {
+		log.Printf("Error updating code: %v", err)
+	}
+	touchRoom(h.RoomManager, h.Rooms, client.RoomID)
+
+	ackData, _ := json.Marshal(models.WSMessage{
+		Type:    "code_ack",
+		Payload: models.CodeAckPayload{FileID: fileID, Revision: applied.Revision},
+	})
+	h.RoomManager.SendToClient(client, ackData)
+	h.autoSnapshot(client, fileID)
+
+	broadcastMsg, _ := json.Marshal(models.WSMessage{
+		Type: "code_change",
+		Payload: models.CodeChangePayload{
+			RoomID:   client.RoomID,
+			FileID:   fileID,
+			UserID:   client.UserID,
+			Username: client.Username(),
+			Code:     applied.Code,
+			Language: applied.Language,
+			Revision: applied.Revision,
+			Changes:  ops,
 		},
-		UpdateExpression: aws.String("SET code = :code, updatedAt = :now, #lang = :lang"),
-		ExpressionAttributeNames: map[string]string{
-			"#lang": "language",
+	})
+	h.RoomManager.BroadcastFromConn(client.RoomID, broadcastMsg, client.ConnID)
+}
+
+func (h *WebSocketHandler) handleCRDTUpdate(client *services.Client, msg *models.WSMessage) {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload models.CRDTUpdatePayload
+	json.Unmarshal(payloadBytes, &payload)
+	fileID := fileIDOrMain(payload.FileID)
+
+	doc, err := h.RoomManager.GetCRDTDocument(client.RoomID, fileID, codeLoader(h.Code, client.RoomID, fileID))
+	if err != nil {
+		h.sendLoadError(client, err)
+		return
+	}
+
+	applied, err := doc.ApplyFrom(client.CRDTClientID(), payload.Updates)
+	if err != nil {
+		h.sendError(client, "Rejected CRDT update: "+err.Error())
+		return
+	}
+	if len(applied) == 0 {
+		return
+	}
+
+	if err := h.Code.AppendCRDTUpdates(context.TODO(), client.RoomID, fileID, doc.Text(), applied); err != nil {
+		log.Printf("Error updating code: %v", err)
+	}
+	touchRoom(h.RoomManager, h.Rooms, client.RoomID)
+	h.autoSnapshot(client, fileID)
+
+	broadcastMsg, _ := json.Marshal(models.WSMessage{
+		Type: "crdt_update",
+		Payload: models.CRDTUpdatePayload{
+			RoomID:   client.RoomID,
+			FileID:   fileID,
+			UserID:   client.UserID,
+			Username: client.Username(),
+			Updates:  applied,
 		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":code": &types.AttributeValueMemberS{Value: payload.Code},
-			":now":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
-			":lang": &types.AttributeValueMemberS{Value: payload.Language},
+	})
+	h.RoomManager.BroadcastFromConn(client.RoomID, broadcastMsg, client.ConnID)
+}
+
+func (h *WebSocketHandler) handleCRDTSync(client *services.Client, msg *models.WSMessage) {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload models.CRDTSyncPayload
+	json.Unmarshal(payloadBytes, &payload)
+	fileID := fileIDOrMain(payload.FileID)
+	if len(payload.DeviceID) > maxDeviceID {
+		h.sendError(client, "deviceId must be at most 100 characters")
+		return
+	}
+	if payload.DeviceID != "" {
+		client.DeviceID = payload.DeviceID
+	}
+
+	doc, err := h.RoomManager.GetCRDTDocument(client.RoomID, fileID, codeLoader(h.Code, client.RoomID, fileID))
+	if err != nil {
+		h.sendLoadError(client, err)
+		return
+	}
+
+	data, _ := json.Marshal(models.WSMessage{
+		Type: "crdt_sync",
+		Payload: models.CRDTSyncPayload{
+			FileID:      fileID,
+			ClientID:    client.CRDTClientID(),
+			StateVector: doc.StateVector(),
+			Updates:     doc.UpdatesSince(payload.StateVector),
 		},
 	})
+	h.RoomManager.SendToClient(client, data)
+}
+
+func (h *WebSocketHandler) handleCheckpoint(client *services.Client, msg *models.WSMessage) {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload models.CheckpointPayload
+	json.Unmarshal(payloadBytes, &payload)
+
+	fileID := fileIDOrMain(payload.FileID)
+
+	version, err := snapshotCode(h.Code, h.Versions, client.RoomID, fileID, models.VersionReasonCheckpoint, payload.Label, client.UserID, client.Username())
 	if err != nil {
-		log.Printf("Error updating code: %v", err)
+		log.Printf("Error saving checkpoint: %v", err)
+		h.sendError(client, "Error saving checkpoint")
+		return
 	}
+	h.Snapshots.Taken(client.RoomID+"/"+fileID, version.CreatedAt)
+	h.broadcastVersion(version)
+}
 
-	broadcastMsg, _ := json.Marshal(msg)
-	h.RoomManager.BroadcastToRoom(client.RoomID, broadcastMsg, client.UserID)
+func (h *WebSocketHandler) autoSnapshot(client *services.Client, fileID string) {
+	if !h.Snapshots.Due(client.RoomID+"/"+fileID, time.Now()) {
+		return
+	}
+	version, err := snapshotCode(h.Code, h.Versions, client.RoomID, fileID, models.VersionReasonAuto, "", client.UserID, client.Username())
+	if err != nil {
+		log.Printf("Error saving snapshot: %v", err)
+		return
+	}
+	h.broadcastVersion(version)
+}
+
+func (h *WebSocketHandler) broadcastVersion(version *models.CodeVersion) {
+	summary := *version
+	summary.Code = ""
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "version_created",
+		Payload: summary,
+	})
+	h.RoomManager.BroadcastToRoom(version.RoomID, data, "")
+}
+
+// codeLoader seeds a live document from storage. The main file starts
+// empty when the room has no stored code yet; any other file must exist.
+func codeLoader(code store.CodeStore, roomID, fileID string) func() (*models.CodeSync, error) {
+	return func() (*models.CodeSync, error) {
+		codeSync, err := code.GetCode(context.TODO(), roomID, fileID)
+		if errors.Is(err, store.ErrNotFound) && fileID == models.MainFileID {
+			return &models.CodeSync{RoomID: roomID, FileID: fileID}, nil
+		}
+		return codeSync, err
+	}
+}
+
+// fileIDOrMain lets clients that predate workspaces omit the fileId.
+func fileIDOrMain(fileID string) string {
+	if fileID == "" {
+		return models.MainFileID
+	}
+	return fileID
+}
+
+func (h *WebSocketHandler) sendLoadError(client *services.Client, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		h.sendError(client, "File not found")
+		return
+	}
+	log.Printf("Error loading document: %v", err)
+	h.sendError(client, "Error loading document")
+}
+
+func (h *WebSocketHandler) sendResync(client *services.Client, fileID string, doc *services.OTDocument) {
+	code, language, revision := doc.Snapshot()
+	data, _ := json.Marshal(models.WSMessage{
+		Type: "code_resync",
+		Payload: models.CodeSync{
+			RoomID:   client.RoomID,
+			FileID:   fileID,
+			Code:     code,
+			Language: language,
+			Revision: revision,
+		},
+	})
+	h.RoomManager.SendToClient(client, data)
+}
+
+func (h *WebSocketHandler) sendError(client *services.Client, message string) {
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "error",
+		Payload: models.ErrorResponse{Error: message},
+	})
+	h.RoomManager.SendToClient(client, data)
 }
 
 func (h *WebSocketHandler) handleChat(client *services.Client, msg *models.WSMessage) {
@@ -179,16 +827,12 @@ func (h *WebSocketHandler) handleChat(client *services.Client, msg *models.WSMes
 		RoomID:    client.RoomID,
 		MessageID: uuid.New().String(),
 		UserID:    client.UserID,
-		Username:  client.Username,
+		Username:  client.Username(),
 		Text:      payload.Text,
 		Timestamp: time.Now(),
 	}
 
-	item, _ := attributevalue.MarshalMap(message)
-	h.DB.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(h.DB.MessagesTable),
-		Item:      item,
-	})
+	h.Messages.SaveMessage(context.TODO(), &message)
 
 	responseMsg := models.WSMessage{
 		Type:    "chat",
@@ -196,6 +840,7 @@ func (h *WebSocketHandler) handleChat(client *services.Client, msg *models.WSMes
 	}
 	broadcastData, _ := json.Marshal(responseMsg)
 	h.RoomManager.BroadcastToRoom(client.RoomID, broadcastData, "")
+	touchRoom(h.RoomManager, h.Rooms, client.RoomID)
 }
 
 func (h *WebSocketHandler) handleCursor(client *services.Client, msg *models.WSMessage) {
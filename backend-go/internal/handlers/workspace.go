@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/auth"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/services"
+	"github.com/anant/realtime-pair-programming/internal/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	errFileName   = errors.New("Invalid file name")
+	errFileParent = errors.New("Parent folder not found")
+	errFileCycle  = errors.New("Cannot move a folder into itself")
+	errFileExists = errors.New("A file with that name already exists")
+)
+
+var languageExtensions = map[string]string{
+	".js":   "javascript",
+	".jsx":  "javascript",
+	".ts":   "typescript",
+	".tsx":  "typescript",
+	".py":   "python",
+	".go":   "go",
+	".java": "java",
+	".c":    "c",
+	".cpp":  "cpp",
+	".rs":   "rust",
+	".rb":   "ruby",
+	".html": "html",
+	".css":  "css",
+	".json": "json",
+	".md":   "markdown",
+}
+
+type WorkspaceHandler struct {
+	RoomManager *services.RoomManager
+	Rooms       store.RoomStore
+	Code        store.CodeStore
+	Files       store.FileStore
+}
+
+func NewWorkspaceHandler(rm *services.RoomManager, s *store.Store) *WorkspaceHandler {
+	return &WorkspaceHandler{
+		RoomManager: rm,
+		Rooms:       s.Rooms,
+		Code:        s.Code,
+		Files:       s.Files,
+	}
+}
+
+func (h *WorkspaceHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
+		return
+	}
+
+	files, err := loadWorkspace(h.Files, h.Code, room.RoomID)
+	if err != nil {
+		http.Error(w, "Error fetching files", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+func (h *WorkspaceHandler) GetFile(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomMember(w, r, h.Rooms)
+	if room == nil {
+		return
+	}
+
+	files, err := loadWorkspace(h.Files, h.Code, room.RoomID)
+	if err != nil {
+		http.Error(w, "Error fetching files", http.StatusInternalServerError)
+		return
+	}
+	file := findFile(files, chi.URLParam(r, "fileId"))
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{"file": file}
+	if file.Type == models.FileTypeFile {
+		codeSync, err := codeLoader(h.Code, room.RoomID, file.FileID)()
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Error fetching code", http.StatusInternalServerError)
+			return
+		}
+		if codeSync == nil {
+			codeSync = &models.CodeSync{RoomID: room.RoomID, FileID: file.FileID}
+		}
+		response["codeSync"] = codeSync
+		if room.SyncMode == models.SyncModeCRDT {
+			codeSync.Code, response["stateVector"] = services.NewCRDTDocument(codeSync.Updates).Snapshot()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *WorkspaceHandler) CreateFile(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner, models.RoleEditor)
+	if room == nil || !requireUnarchived(w, room) || !requireUnmuted(w, r, room, true) {
+		return
+	}
+	if !requireDriver(w, r, h.RoomManager, room) {
+		return
+	}
+	userID := r.Context().Value(auth.UserIDKey).(string)
+
+	var req models.CreateFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" {
+		req.Type = models.FileTypeFile
+	}
+	if req.Type != models.FileTypeFile && req.Type != models.FileTypeFolder {
+		http.Error(w, "type must be file or folder", http.StatusBadRequest)
+		return
+	}
+
+	files, err := loadWorkspace(h.Files, h.Code, room.RoomID)
+	if err != nil {
+		http.Error(w, "Error fetching files", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	file := models.WorkspaceFile{
+		RoomID:    room.RoomID,
+		FileID:    uuid.New().String(),
+		ParentID:  req.ParentID,
+		Name:      req.Name,
+		Type:      req.Type,
+		CreatedBy: userID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := validatePlacement(files, &file); err != nil {
+		writePlacementError(w, err)
+		return
+	}
+
+	if file.Type == models.FileTypeFile {
+		if req.Language == "" {
+			req.Language = languageForName(file.Name)
+		}
+		codeSync := models.CodeSync{
+			RoomID:    room.RoomID,
+			FileID:    file.FileID,
+			Code:      req.Content,
+			Language:  req.Language,
+			UpdatedAt: now,
+		}
+		if room.SyncMode == models.SyncModeCRDT {
+			codeSync.Updates = services.SeedCRDTUpdates(codeSync.Code)
+		}
+		if err := h.Code.PutCode(context.TODO(), &codeSync); err != nil {
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := h.Files.PutFile(context.TODO(), &file); err != nil {
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+
+	file.Path = filePath(append(files, file), file)
+	h.broadcastFileEvent(room.RoomID, "file_created", file)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// UpdateFile renames and/or moves a file or folder. Moving a folder carries
+// its contents along since children only reference their parent.
+func (h *WorkspaceHandler) UpdateFile(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner, models.RoleEditor)
+	if room == nil || !requireUnarchived(w, room) || !requireUnmuted(w, r, room, true) {
+		return
+	}
+	if !requireDriver(w, r, h.RoomManager, room) {
+		return
+	}
+
+	var req models.UpdateFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	files, err := loadWorkspace(h.Files, h.Code, room.RoomID)
+	if err != nil {
+		http.Error(w, "Error fetching files", http.StatusInternalServerError)
+		return
+	}
+	existing := findFile(files, chi.URLParam(r, "fileId"))
+	if existing == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	file := *existing
+	if req.Name != nil {
+		file.Name = *req.Name
+	}
+	if req.ParentID != nil {
+		file.ParentID = *req.ParentID
+	}
+	if err := validatePlacement(files, &file); err != nil {
+		writePlacementError(w, err)
+		return
+	}
+
+	file.UpdatedAt = time.Now()
+	if err := h.Files.PutFile(context.TODO(), &file); err != nil {
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+
+	*existing = file
+	file.Path = filePath(files, file)
+	h.broadcastFileEvent(room.RoomID, "file_updated", file)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// DeleteFile removes a file, or a folder together with everything in it.
+func (h *WorkspaceHandler) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	room := requireRoomRole(w, r, h.Rooms, models.RoleOwner, models.RoleEditor)
+	if room == nil || !requireUnarchived(w, room) || !requireUnmuted(w, r, room, true) {
+		return
+	}
+	if !requireDriver(w, r, h.RoomManager, room) {
+		return
+	}
+
+	files, err := loadWorkspace(h.Files, h.Code, room.RoomID)
+	if err != nil {
+		http.Error(w, "Error fetching files", http.StatusInternalServerError)
+		return
+	}
+	file := findFile(files, chi.URLParam(r, "fileId"))
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	deleted := append([]string{file.FileID}, descendantIDs(files, file.FileID)...)
+	for _, fileID := range deleted {
+		if err := h.Files.DeleteFile(context.TODO(), room.RoomID, fileID); err != nil {
+			log.Printf("Error deleting file %s: %v", fileID, err)
+			http.Error(w, "Error deleting file", http.StatusInternalServerError)
+			return
+		}
+		h.RoomManager.DropDocument(room.RoomID, fileID)
+	}
+
+	h.broadcastFileEvent(room.RoomID, "file_deleted", map[string]interface{}{"fileIds": deleted})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "File deleted",
+		"fileIds": deleted,
+	})
+}
+
+func (h *WorkspaceHandler) broadcastFileEvent(roomID, eventType string, payload interface{}) {
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    eventType,
+		Payload: payload,
+	})
+	h.RoomManager.BroadcastToRoom(roomID, data, "")
+	touchRoom(h.RoomManager, h.Rooms, roomID)
+}
+
+// loadWorkspace lists a room's files sorted by path. Rooms created before
+// workspaces existed have code but no tree; they get a main file entry the
+// first time the tree is read.
+func loadWorkspace(files store.FileStore, code store.CodeStore, roomID string) ([]models.WorkspaceFile, error) {
+	list, err := files.ListFiles(context.TODO(), roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 {
+		codeSync, err := code.GetCode(context.TODO(), roomID, models.MainFileID)
+		if errors.Is(err, store.ErrNotFound) {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		main := mainFile(roomID, codeSync.Language, "", codeSync.UpdatedAt)
+		if err := files.PutFile(context.TODO(), &main); err != nil {
+			return nil, err
+		}
+		list = append(list, main)
+	}
+
+	for i := range list {
+		list[i].Path = filePath(list, list[i])
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+	return list, nil
+}
+
+func mainFile(roomID, language, createdBy string, createdAt time.Time) models.WorkspaceFile {
+	ext := ""
+	for e, lang := range languageExtensions {
+		if lang == language && (ext == "" || len(e) < len(ext)) {
+			ext = e
+		}
+	}
+	return models.WorkspaceFile{
+		RoomID:    roomID,
+		FileID:    models.MainFileID,
+		Name:      "main" + ext,
+		Type:      models.FileTypeFile,
+		CreatedBy: createdBy,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+}
+
+func findFile(files []models.WorkspaceFile, fileID string) *models.WorkspaceFile {
+	for i := range files {
+		if files[i].FileID == fileID {
+			return &files[i]
+		}
+	}
+	return nil
+}
+
+func filePath(files []models.WorkspaceFile, file models.WorkspaceFile) string {
+	parts := []string{file.Name}
+	for parentID, depth := file.ParentID, 0; parentID != "" && depth < len(files); depth++ {
+		parent := findFile(files, parentID)
+		if parent == nil {
+			break
+		}
+		parts = append([]string{parent.Name}, parts...)
+		parentID = parent.ParentID
+	}
+	return strings.Join(parts, "/")
+}
+
+func descendantIDs(files []models.WorkspaceFile, folderID string) []string {
+	var ids []string
+	for _, f := range files {
+		if f.ParentID == folderID && f.FileID != folderID {
+			ids = append(ids, f.FileID)
+			ids = append(ids, descendantIDs(files, f.FileID)...)
+		}
+	}
+	return ids
+}
+
+// validatePlacement checks file's name and parent against the rest of the
+// tree before it is created, renamed or moved.
+func validatePlacement(files []models.WorkspaceFile, file *models.WorkspaceFile) error {
+	file.Name = strings.TrimSpace(file.Name)
+	if file.Name == "" || file.Name == "." || file.Name == ".." || strings.ContainsAny(file.Name, "/\\") {
+		return errFileName
+	}
+
+	for parentID := file.ParentID; parentID != ""; {
+		if parentID == file.FileID {
+			return errFileCycle
+		}
+		parent := findFile(files, parentID)
+		if parent == nil || parent.Type != models.FileTypeFolder {
+			return errFileParent
+		}
+		parentID = parent.ParentID
+	}
+
+	for _, f := range files {
+		if f.FileID != file.FileID && f.ParentID == file.ParentID && f.Name == file.Name {
+			return errFileExists
+		}
+	}
+	return nil
+}
+
+func writePlacementError(w http.ResponseWriter, err error) {
+	if err == errFileExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func languageForName(name string) string {
+	if lang, ok := languageExtensions[strings.ToLower(path.Ext(name))]; ok {
+		return lang
+	}
+	return "plaintext"
+}
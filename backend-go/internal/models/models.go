@@ -3,20 +3,311 @@ package models
 import "time"
 
 type User struct {
-	UserID         string    `json:"userId" dynamodbav:"userId"`
-	Username       string    `json:"username" dynamodbav:"username"`
-	Email          string    `json:"email" dynamodbav:"email"`
-	HashedPassword string    `json:"-" dynamodbav:"hashedPassword"`
-	CreatedAt      time.Time `json:"createdAt" dynamodbav:"createdAt"`
-	LastSeen       time.Time `json:"lastSeen" dynamodbav:"lastSeen"`
+	UserID         string          `json:"userId" dynamodbav:"userId"`
+	Username       string          `json:"username" dynamodbav:"username"`
+	Email          string          `json:"email" dynamodbav:"email"`
+	HashedPassword string          `json:"-" dynamodbav:"hashedPassword"`
+	EmailVerified  bool            `json:"emailVerified" dynamodbav:"emailVerified"`
+	DisplayName    string          `json:"displayName,omitempty" dynamodbav:"displayName,omitempty"`
+	AvatarURL      string          `json:"avatarUrl,omitempty" dynamodbav:"avatarUrl,omitempty"`
+	Preferences    UserPreferences `json:"preferences" dynamodbav:"preferences"`
+	TwoFactor      *TwoFactor      `json:"-" dynamodbav:"twoFactor,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt" dynamodbav:"createdAt"`
+	LastSeen       time.Time       `json:"lastSeen" dynamodbav:"lastSeen"`
 }
 
+// UserPreferences are editor settings that follow a user across devices.
+// Empty values leave the choice to the frontend.
+type UserPreferences struct {
+	EditorTheme string `json:"editorTheme,omitempty" dynamodbav:"editorTheme,omitempty"`
+	Keybindings string `json:"keybindings,omitempty" dynamodbav:"keybindings,omitempty"`
+}
+
+var (
+	EditorThemes = []string{"vs", "vs-dark", "hc-black", "hc-light"}
+	Keybindings  = []string{"default", "vim", "emacs"}
+)
+
+// PublicProfile is what anyone signed in may see of a user.
+type PublicProfile struct {
+	UserID      string    `json:"userId"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName,omitempty"`
+	AvatarURL   string    `json:"avatarUrl,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// TwoFactor is a user's TOTP authenticator. It stays pending until Enabled,
+// once the user has entered a code from it. RecoveryCodes holds the hashes
+// of the unused recovery codes and LastStep the time step of the last code
+// accepted, so that no code works twice.
+type TwoFactor struct {
+	Secret        string   `dynamodbav:"secret"`
+	Enabled       bool     `dynamodbav:"enabled"`
+	RecoveryCodes []string `dynamodbav:"recoveryCodes,stringset,omitempty"`
+	LastStep      int64    `dynamodbav:"lastStep"`
+}
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// UserToken is a single-use token mailed to a user, such as an email
+// verification or password reset link. Only its hash is stored.
+type UserToken struct {
+	TokenHash string    `json:"-" dynamodbav:"tokenHash"`
+	Purpose   string    `json:"purpose" dynamodbav:"purpose"`
+	UserID    string    `json:"userId" dynamodbav:"userId"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt" dynamodbav:"expiresAt,unixtime"`
+}
+
+// LoginAttempts counts recent failed logins for one key, such as an email
+// address or a client IP. The count is forgotten once ExpiresAt passes
+// without another failure.
+type LoginAttempts struct {
+	Key         string    `json:"key" dynamodbav:"attemptKey"`
+	Failures    int       `json:"failures" dynamodbav:"failures"`
+	LastFailure time.Time `json:"lastFailure" dynamodbav:"lastFailure,unixtime"`
+	ExpiresAt   time.Time `json:"expiresAt" dynamodbav:"expiresAt,unixtime"`
+}
+
+const (
+	AuditScopeAuth = "auth"
+
+	AuditActionLoginLockout     = "login_lockout"
+	AuditActionTwoFactorEnable  = "2fa_enabled"
+	AuditActionTwoFactorDisable = "2fa_disabled"
+	AuditActionRecoveryCodeUsed = "recovery_code_used"
+	AuditActionAccountDeleted   = "account_deleted"
+
+	AuditActionRoomKick   = "room_kick"
+	AuditActionRoomBan    = "room_ban"
+	AuditActionRoomUnban  = "room_unban"
+	AuditActionRoomMute   = "room_mute"
+	AuditActionRoomUnmute = "room_unmute"
+)
+
+// AuditScopeRoom is the audit scope of moderation in a room.
+func AuditScopeRoom(roomID string) string {
+	return "room:" + roomID
+}
+
+// AuditEntry records a security relevant event. Scope groups entries, such
+// as AuditScopeAuth for account events, and entry IDs sort by time within
+// a scope.
+type AuditEntry struct {
+	Scope     string            `json:"scope" dynamodbav:"scope"`
+	EntryID   string            `json:"entryId" dynamodbav:"entryId"`
+	Action    string            `json:"action" dynamodbav:"action"`
+	ActorID   string            `json:"actorId,omitempty" dynamodbav:"actorId,omitempty"`
+	TargetID  string            `json:"targetId,omitempty" dynamodbav:"targetId,omitempty"`
+	IP        string            `json:"ip,omitempty" dynamodbav:"ip,omitempty"`
+	Details   map[string]string `json:"details,omitempty" dynamodbav:"details,omitempty"`
+	CreatedAt time.Time         `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+const (
+	ScopeRoomsRead  = "rooms:read"
+	ScopeRoomsWrite = "rooms:write"
+	ScopeChatWrite  = "chat:write"
+	ScopeWSConnect  = "ws:connect"
+)
+
+var APITokenScopes = []string{ScopeRoomsRead, ScopeRoomsWrite, ScopeChatWrite, ScopeWSConnect}
+
+// APIToken lets scripts act as a user, limited to Scopes. Only the hash of
+// its secret is stored; Token is only set in the response creating it.
+type APIToken struct {
+	UserID     string     `json:"userId" dynamodbav:"userId"`
+	TokenID    string     `json:"tokenId" dynamodbav:"tokenId"`
+	Name       string     `json:"name" dynamodbav:"name"`
+	Scopes     []string   `json:"scopes" dynamodbav:"scopes"`
+	TokenHash  string     `json:"-" dynamodbav:"tokenHash"`
+	CreatedAt  time.Time  `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt" dynamodbav:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt" dynamodbav:"lastUsedAt,omitempty"`
+	Token      string     `json:"token,omitempty" dynamodbav:"-"`
+}
+
+// UserIdentity links an account at an external OpenID Connect provider,
+// named by issuer and subject, to a user.
+type UserIdentity struct {
+	Issuer   string    `json:"issuer" dynamodbav:"issuer"`
+	Subject  string    `json:"subject" dynamodbav:"subject"`
+	UserID   string    `json:"userId" dynamodbav:"userId"`
+	Email    string    `json:"email" dynamodbav:"email"`
+	LinkedAt time.Time `json:"linkedAt" dynamodbav:"linkedAt"`
+}
+
+// Session is one login. Its refresh token is rotated on every use and only
+// the hash of the current one is stored; access tokens name their session
+// and stop working once it is deleted.
+type Session struct {
+	UserID      string    `json:"userId" dynamodbav:"userId"`
+	SessionID   string    `json:"sessionId" dynamodbav:"sessionId"`
+	TokenHash   string    `json:"-" dynamodbav:"tokenHash"`
+	CreatedAt   time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	RefreshedAt time.Time `json:"refreshedAt" dynamodbav:"refreshedAt"`
+	ExpiresAt   time.Time `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+const (
+	SyncModeOT   = "ot"
+	SyncModeCRDT = "crdt"
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Visibility decides who can see and join a room. Public rooms are listed
+// for everyone; private rooms are hidden from non-members, who can only get
+// in with an invite; password-protected rooms are listed, but joining them
+// takes the passphrase.
+const (
+	VisibilityPublic   = "public"
+	VisibilityPrivate  = "private"
+	VisibilityPassword = "password"
+)
+
+// Room is a shared workspace. Archived rooms are read-only: nobody can edit
+// their code or files, chat or join them. PasswordHash is the bcrypt hash
+// of the passphrase of a password-protected room. Bans and Mutes are keyed
+// by user ID; bans are only shown to the owner. MaxEditors caps how many
+// owners and editors can be connected at once, with 0 for no limit. In
+// DriverMode only the current driver can edit code, and the driver rotates
+// every RotateMinutes unless that is 0.
 type Room struct {
+	RoomID      string            `json:"roomId" dynamodbav:"roomId"`
+	Name        string            `json:"name" dynamodbav:"name"`
+	Description string            `json:"description" dynamodbav:"description,omitempty"`
+	CreatedBy   string            `json:"createdBy" dynamodbav:"createdBy"`
+	Users       []string          `json:"users" dynamodbav:"users"`
+	Roles       map[string]string `json:"roles" dynamodbav:"roles,omitempty"`
+	SyncMode    string            `json:"syncMode" dynamodbav:"syncMode"`
+	InviteOnly  bool              `json:"inviteOnly" dynamodbav:"inviteOnly"`
+	Archived    bool              `json:"archived" dynamodbav:"archived"`
+	CreatedAt   time.Time         `json:"createdAt" dynamodbav:"createdAt"`
+	// LastActivity is when someone last chatted or edited in the room,
+	// recorded about once a minute while it is busy.
+	LastActivity time.Time `json:"lastActivity" dynamodbav:"lastActivity"`
+	Visibility   string    `json:"visibility" dynamodbav:"visibility,omitempty"`
+	PasswordHash string    `json:"-" dynamodbav:"passwordHash,omitempty"`
+
+	Bans  map[string]RoomBan  `json:"-" dynamodbav:"bans,omitempty"`
+	Mutes map[string]RoomMute `json:"mutes,omitempty" dynamodbav:"mutes,omitempty"`
+
+	MaxEditors int `json:"maxEditors,omitempty" dynamodbav:"maxEditors,omitempty"`
+
+	DriverMode    bool `json:"driverMode,omitempty" dynamodbav:"driverMode,omitempty"`
+	RotateMinutes int  `json:"rotateMinutes,omitempty" dynamodbav:"rotateMinutes,omitempty"`
+}
+
+// RoomBan keeps a user out of a room until the owner lifts it.
+type RoomBan struct {
+	BannedBy  string    `json:"bannedBy" dynamodbav:"bannedBy"`
+	Reason    string    `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// RoomMute stops a member from chatting, editing or both until Until.
+type RoomMute struct {
+	Chat    bool      `json:"chat" dynamodbav:"chat"`
+	Edit    bool      `json:"edit" dynamodbav:"edit"`
+	Until   time.Time `json:"until" dynamodbav:"until"`
+	MutedBy string    `json:"mutedBy" dynamodbav:"mutedBy"`
+}
+
+// Active reports whether the mute is still in force at now.
+func (m *RoomMute) Active(now time.Time) bool {
+	return m != nil && now.Before(m.Until)
+}
+
+// Banned reports whether userID is banned from the room.
+func (r *Room) Banned(userID string) bool {
+	_, ok := r.Bans[userID]
+	return ok
+}
+
+// MuteOf returns userID's mute if it is in force at now, or nil.
+func (r *Room) MuteOf(userID string, now time.Time) *RoomMute {
+	mute, ok := r.Mutes[userID]
+	if !ok || !mute.Active(now) {
+		return nil
+	}
+	return &mute
+}
+
+// ActiveAt is LastActivity, or the creation time for rooms from before
+// activity was recorded.
+func (r *Room) ActiveAt() time.Time {
+	if r.LastActivity.IsZero() {
+		return r.CreatedAt
+	}
+	return r.LastActivity
+}
+
+// Listing is the room as listed to users who are not in it: its settings,
+// without who its members are, what roles they have or who is muted.
+func (r Room) Listing() Room {
+	r.Users = []string{}
+	r.Roles = map[string]string{}
+	r.Mutes = nil
+	r.Bans = nil
+	r.PasswordHash = ""
+	return r
+}
+
+// EffectiveVisibility is the room's visibility, with rooms from before
+// visibility existed being public.
+func (r *Room) EffectiveVisibility() string {
+	if r.Visibility == "" {
+		return VisibilityPublic
+	}
+	return r.Visibility
+}
+
+// RoleOf returns a member's role, or "" for non-members. Rooms created
+// before roles existed have no entries: their creator is the owner and
+// everyone else an editor.
+func (r *Room) RoleOf(userID string) string {
+	if role, ok := r.Roles[userID]; ok {
+		return role
+	}
+	for _, uid := range r.Users {
+		if uid != userID {
+			continue
+		}
+		if uid == r.CreatedBy {
+			return RoleOwner
+		}
+		return RoleEditor
+	}
+	return ""
+}
+
+// CanEdit reports whether a role may change the room's code and files.
+func CanEdit(role string) bool {
+	return role == RoleOwner || role == RoleEditor
+}
+
+// Invite lets whoever holds its token join a room with Role. MaxUses of 0
+// means unlimited. The token is not stored: it is signed from the invite
+// whenever it is handed out.
+type Invite struct {
 	RoomID    string    `json:"roomId" dynamodbav:"roomId"`
-	Name      string    `json:"name" dynamodbav:"name"`
+	InviteID  string    `json:"inviteId" dynamodbav:"inviteId"`
+	Role      string    `json:"role" dynamodbav:"role"`
+	MaxUses   int       `json:"maxUses" dynamodbav:"maxUses"`
+	Uses      int       `json:"uses" dynamodbav:"uses"`
+	ExpiresAt time.Time `json:"expiresAt" dynamodbav:"expiresAt"`
 	CreatedBy string    `json:"createdBy" dynamodbav:"createdBy"`
-	Users     []string  `json:"users" dynamodbav:"users"`
 	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	Token     string    `json:"token,omitempty" dynamodbav:"-"`
 }
 
 type Message struct {
@@ -29,24 +320,168 @@ type Message struct {
 }
 
 type CodeSync struct {
+	RoomID    string       `json:"roomId" dynamodbav:"roomId"`
+	FileID    string       `json:"fileId" dynamodbav:"fileId,omitempty"`
+	Code      string       `json:"code" dynamodbav:"code"`
+	Language  string       `json:"language" dynamodbav:"language"`
+	Revision  int          `json:"revision" dynamodbav:"revision"`
+	Updates   []CRDTUpdate `json:"-" dynamodbav:"crdtUpdates,omitempty"`
+	UpdatedAt time.Time    `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// MainFileID is the file every room starts with. Rooms created before
+// workspaces existed keep their code under it.
+const MainFileID = "main"
+
+const (
+	FileTypeFile   = "file"
+	FileTypeFolder = "folder"
+)
+
+// WorkspaceFile is a file or folder in a room's workspace. The tree is
+// stored flat, each entry pointing at its parent folder ("" for the root);
+// Path is filled in when the tree is listed.
+type WorkspaceFile struct {
 	RoomID    string    `json:"roomId" dynamodbav:"roomId"`
-	Code      string    `json:"code" dynamodbav:"code"`
-	Language  string    `json:"language" dynamodbav:"language"`
+	FileID    string    `json:"fileId" dynamodbav:"fileId"`
+	ParentID  string    `json:"parentId" dynamodbav:"parentId"`
+	Name      string    `json:"name" dynamodbav:"name"`
+	Type      string    `json:"type" dynamodbav:"type"`
+	Path      string    `json:"path" dynamodbav:"-"`
+	CreatedBy string    `json:"createdBy" dynamodbav:"createdBy"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
 }
 
+type CreateFileRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	Type     string `json:"type"`
+	Language string `json:"language"`
+	Content  string `json:"content"`
+}
+
+// UpdateFileRequest renames and/or moves a file; nil fields are left alone.
+type UpdateFileRequest struct {
+	Name     *string `json:"name"`
+	ParentID *string `json:"parentId"`
+}
+
+const (
+	VersionReasonAuto       = "auto"
+	VersionReasonCheckpoint = "checkpoint"
+	VersionReasonRestore    = "restore"
+)
+
+// CodeVersion is an immutable snapshot of a room's code. VersionIDs sort
+// in creation order.
+type CodeVersion struct {
+	RoomID     string    `json:"roomId" dynamodbav:"roomId"`
+	VersionID  string    `json:"versionId" dynamodbav:"versionId"`
+	FileID     string    `json:"fileId" dynamodbav:"fileId,omitempty"`
+	Code       string    `json:"code,omitempty" dynamodbav:"code"`
+	Language   string    `json:"language" dynamodbav:"language"`
+	Revision   int       `json:"revision" dynamodbav:"revision"`
+	Reason     string    `json:"reason" dynamodbav:"reason"`
+	Label      string    `json:"label,omitempty" dynamodbav:"label,omitempty"`
+	AuthorID   string    `json:"authorId" dynamodbav:"authorId"`
+	AuthorName string    `json:"authorName" dynamodbav:"authorName"`
+	CreatedAt  time.Time `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+type DiffLine struct {
+	Op      string `json:"op"`
+	Text    string `json:"text"`
+	OldLine int    `json:"oldLine,omitempty"`
+	NewLine int    `json:"newLine,omitempty"`
+}
+
+type VersionDiff struct {
+	From  CodeVersion `json:"from"`
+	To    CodeVersion `json:"to"`
+	Lines []DiffLine  `json:"lines"`
+}
+
+type CheckpointPayload struct {
+	FileID string `json:"fileId"`
+	Label  string `json:"label"`
+}
+
 type WSMessage struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
 }
 
+const (
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+// TextOp is a single insert or delete against the document. Position is a
+// character offset; ops in a list apply in order, each against the result
+// of the previous one.
+type TextOp struct {
+	Type     string `json:"type"`
+	Position int    `json:"position"`
+	Text     string `json:"text,omitempty"`
+	Length   int    `json:"length,omitempty"`
+}
+
 type CodeChangePayload struct {
-	RoomID   string `json:"roomId"`
-	UserID   string `json:"userId"`
-	Username string `json:"username"`
-	Code     string `json:"code"`
-	Language string `json:"language"`
-	Changes  string `json:"changes"` 
+	RoomID   string   `json:"roomId"`
+	FileID   string   `json:"fileId"`
+	UserID   string   `json:"userId"`
+	Username string   `json:"username"`
+	Code     string   `json:"code"`
+	Language string   `json:"language"`
+	Revision int      `json:"revision"`
+	Changes  []TextOp `json:"changes,omitempty"`
+}
+
+type CodeAckPayload struct {
+	FileID   string `json:"fileId"`
+	Revision int    `json:"revision"`
+}
+
+// CRDTID identifies a character (or a delete) by the replica that created it
+// and that replica's Lamport clock at the time.
+type CRDTID struct {
+	Client string `json:"client" dynamodbav:"client"`
+	Clock  int    `json:"clock" dynamodbav:"clock"`
+}
+
+// CRDTUpdate inserts Value after Origin (nil means the start of the
+// document) or tombstones Target. A multi-character Value occupies the
+// clocks ID.Clock through ID.Clock+len(Value)-1.
+type CRDTUpdate struct {
+	Type   string  `json:"type" dynamodbav:"type"`
+	ID     CRDTID  `json:"id" dynamodbav:"id"`
+	Origin *CRDTID `json:"origin,omitempty" dynamodbav:"origin,omitempty"`
+	Target *CRDTID `json:"target,omitempty" dynamodbav:"target,omitempty"`
+	Value  string  `json:"value,omitempty" dynamodbav:"value,omitempty"`
+}
+
+type CRDTUpdatePayload struct {
+	RoomID   string       `json:"roomId"`
+	FileID   string       `json:"fileId"`
+	UserID   string       `json:"userId"`
+	Username string       `json:"username"`
+	Updates  []CRDTUpdate `json:"updates"`
+}
+
+// CRDTSyncPayload asks for the updates a replica is missing, naming the
+// device the replica lives on. The reply also carries the clientId the
+// connection must author its updates as.
+type CRDTSyncPayload struct {
+	FileID      string         `json:"fileId"`
+	DeviceID    string         `json:"deviceId,omitempty"`
+	ClientID    string         `json:"clientId,omitempty"`
+	StateVector map[string]int `json:"stateVector"`
+	Updates     []CRDTUpdate   `json:"updates,omitempty"`
+}
+
+type AuthPayload struct {
+	Token string `json:"token"`
 }
 
 type ChatPayload struct {
@@ -59,6 +494,7 @@ type ChatPayload struct {
 
 type CursorPayload struct {
 	RoomID   string `json:"roomId"`
+	FileID   string `json:"fileId"`
 	UserID   string `json:"userId"`
 	Username string `json:"username"`
 	Position struct {
@@ -67,10 +503,103 @@ type CursorPayload struct {
 	} `json:"position"`
 }
 
+// MessagePage is one page of chat history, oldest first. Before and After
+// are the cursors for the neighbouring older and newer pages.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+}
+
+type UserRenamedPayload struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// MemberRemovedPayload tells a room that a user's connections to it were
+// closed, and why.
+type MemberRemovedPayload struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// MuteChangedPayload tells a room that a member was muted, or unmuted when
+// Mute is nil.
+type MuteChangedPayload struct {
+	UserID string    `json:"userId"`
+	Mute   *RoomMute `json:"mute"`
+}
+
+// LobbyEntry is a user waiting for a free editor seat in a room. Position
+// counts from 1.
+type LobbyEntry struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username,omitempty"`
+	Position int    `json:"position,omitempty"`
+}
+
+// LobbyPositionPayload tells a waiting client where it is in the queue.
+type LobbyPositionPayload struct {
+	Position   int `json:"position"`
+	MaxEditors int `json:"maxEditors"`
+}
+
+// DriverState is who drives a room in driver mode, who asked to drive next
+// in order, and when the driver rotates. NextRotation is unset while the
+// room has no driver or does not rotate. Version counts the changes, so a
+// state older than one already seen can be told apart.
+type DriverState struct {
+	DriverID      string     `json:"driverId"`
+	Requests      []string   `json:"requests"`
+	RotateMinutes int        `json:"rotateMinutes"`
+	NextRotation  *time.Time `json:"nextRotation,omitempty"`
+	Version       int        `json:"version"`
+}
+
+// ControlPayload names who grant_control hands control to, the first user
+// who asked for it when empty.
+type ControlPayload struct {
+	UserID string `json:"userId"`
+}
+
+// BannedUser is an entry in a room's ban list.
+type BannedUser struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username,omitempty"`
+	RoomBan
+}
+
+// RoomSummary is a room in a listing, with how many people are connected
+// to it right now.
+type RoomSummary struct {
+	Room
+	Participants int `json:"participants"`
+}
+
+// RoomList is one page of a room listing. Next is the cursor for the
+// following page and is empty on the last one.
+type RoomList struct {
+	Rooms []RoomSummary `json:"rooms"`
+	Next  string        `json:"next,omitempty"`
+}
+
+// RoomDeletedPayload tells a room's clients it was deleted, just before
+// their connections are closed.
+type RoomDeletedPayload struct {
+	RoomID string `json:"roomId"`
+}
+
+type OwnershipTransferredPayload struct {
+	PreviousOwner RoomMember `json:"previousOwner"`
+	Owner         RoomMember `json:"owner"`
+}
+
 type UserPresence struct {
 	UserID   string `json:"userId"`
 	Username string `json:"username"`
-	Status   string `json:"status"` 
+	Role     string `json:"role,omitempty"`
+	Status   string `json:"status"`
 }
 
 type SignupRequest struct {
@@ -84,18 +613,174 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// TwoFactorChallenge answers a correct password for an account with 2FA
+// enabled. The challenge token is traded for tokens with a code from the
+// authenticator or a recovery code.
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool      `json:"twoFactorRequired"`
+	ChallengeToken    string    `json:"challengeToken"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+type TwoFactorSetupResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthUri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// UpdateProfileRequest changes the fields that are set, and within
+// Preferences the preferences that are set. Empty strings clear the
+// display name, avatar and preferences.
+type UpdateProfileRequest struct {
+	Username    *string                   `json:"username"`
+	DisplayName *string                   `json:"displayName"`
+	AvatarURL   *string                   `json:"avatarUrl"`
+	Preferences *UpdatePreferencesRequest `json:"preferences"`
+}
+
+type UpdatePreferencesRequest struct {
+	EditorTheme *string `json:"editorTheme"`
+	Keybindings *string `json:"keybindings"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
 type AuthResponse struct {
-	Token  string `json:"token"`
-	UserID string `json:"userId"`
-	User   User   `json:"user"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+	UserID       string    `json:"userId"`
+	User         User      `json:"user"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// CreateAPITokenRequest asks for a token lasting ExpiresIn seconds.
+type CreateAPITokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expiresIn"`
+}
+
+type PostMessageRequest struct {
+	Text string `json:"text"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
 }
 
 type CreateRoomRequest struct {
-	Name string `json:"name"`
+	Name          string `json:"name"`
+	SyncMode      string `json:"syncMode"`
+	InviteOnly    bool   `json:"inviteOnly"`
+	Visibility    string `json:"visibility"`
+	Password      string `json:"password"`
+	MaxEditors    int    `json:"maxEditors"`
+	DriverMode    bool   `json:"driverMode"`
+	RotateMinutes int    `json:"rotateMinutes"`
+}
+
+// DriverModeRequest turns driver mode on or off and sets how often the
+// driver rotates.
+type DriverModeRequest struct {
+	Enabled       bool `json:"enabled"`
+	RotateMinutes int  `json:"rotateMinutes"`
+}
+
+// CapacityRequest sets a room's MaxEditors.
+type CapacityRequest struct {
+	MaxEditors int `json:"maxEditors"`
+}
+
+// VisibilityRequest changes a room's visibility. Password may be left out
+// when a password-protected room is to keep its passphrase.
+type VisibilityRequest struct {
+	Visibility string `json:"visibility"`
+	Password   string `json:"password"`
 }
 
 type JoinRoomRequest struct {
-	RoomID string `json:"roomId"`
+	RoomID   string `json:"roomId"`
+	Password string `json:"password"`
+}
+
+type InviteOnlyRequest struct {
+	InviteOnly bool `json:"inviteOnly"`
+}
+
+// UpdateRoomRequest changes the fields that are set.
+type UpdateRoomRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"userId"`
+}
+
+// CreateInviteRequest describes a new invite. ExpiresIn is in seconds.
+type CreateInviteRequest struct {
+	Role      string `json:"role"`
+	MaxUses   int    `json:"maxUses"`
+	ExpiresIn int    `json:"expiresIn"`
+}
+
+type RoomMember struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// ModerationRequest carries the options of kicks, bans and mutes, which
+// are also sent over WebSocket with UserID naming the member. A mute lasts
+// Duration seconds and covers chat and editing unless only one is set.
+type ModerationRequest struct {
+	UserID   string `json:"userId"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"`
+	Chat     bool   `json:"chat"`
+	Edit     bool   `json:"edit"`
 }
 
 type ErrorResponse struct {
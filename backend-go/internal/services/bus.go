@@ -0,0 +1,160 @@
+package services
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+// BusMessage is a room broadcast on its way to the other backend nodes.
+type BusMessage struct {
+	RoomID      string          `json:"roomId"`
+	Message     json.RawMessage `json:"message"`
+	Exclude     string          `json:"exclude,omitempty"`
+	ExcludeConn string          `json:"excludeConn,omitempty"`
+	Close       string          `json:"close,omitempty"`
+}
+
+// Bus connects the RoomManagers of every backend node so a room can be
+// spread across several of them. Publish reaches the other nodes only, the
+// publishing node delivers to its own clients itself. Presence is tracked
+// per connection: Join reports whether it is the user's first connection
+// to the room anywhere and Leave whether it was the last.
+//
+// The bus also keeps the log that orders the OT edits of each document, so
+// every node gives an edit the same revision. AppendEdit logs an edit only
+// if it directly follows the last one logged, reporting whether it did,
+// and EditsSince returns the edits logged after revision, or ErrEditsGone
+// once some of them are no longer kept.
+//
+// Each room's driver state lives on the bus as well, so every node decides
+// who drives on the same state. Driver returns it, or nil if the room has
+// none. UpdateDriver changes it in one step: update gets the current state
+// and returns the new one, nil to remove it or the one it got to leave it
+// be. It may run more than once, so it must not change what it is given.
+type Bus interface {
+	Publish(msg BusMessage) error
+	Subscribe(deliver func(BusMessage))
+	Join(roomID, connID string, user models.UserPresence) (bool, error)
+	Leave(roomID, connID string) (bool, error)
+	Members(roomID string) ([]models.UserPresence, error)
+	AppendEdit(roomID, fileID string, edit Edit) (bool, error)
+	EditsSince(roomID, fileID string, revision int) ([]Edit, error)
+	Driver(roomID string) (*models.DriverState, error)
+	UpdateDriver(roomID string, update func(*models.DriverState) (*models.DriverState, error)) (*models.DriverState, error)
+	Close() error
+}
+
+// LocalBus is the Bus for a single node: there is nobody to publish to and
+// presence and driver state live in memory.
+type LocalBus struct {
+	presence map[string]map[string]models.UserPresence
+	drivers  map[string]models.DriverState
+	mu       sync.Mutex
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{
+		presence: make(map[string]map[string]models.UserPresence),
+		drivers:  make(map[string]models.DriverState),
+	}
+}
+
+func (b *LocalBus) Publish(msg BusMessage) error {
+	return nil
+}
+
+func (b *LocalBus) Subscribe(deliver func(BusMessage)) {}
+
+func (b *LocalBus) Join(roomID, connID string, user models.UserPresence) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.presence[roomID] == nil {
+		b.presence[roomID] = make(map[string]models.UserPresence)
+	}
+	b.presence[roomID][connID] = user
+	return countConnections(b.presence[roomID], user.UserID) == 1, nil
+}
+
+func (b *LocalBus) Leave(roomID, connID string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	user, ok := b.presence[roomID][connID]
+	if !ok {
+		return false, nil
+	}
+	delete(b.presence[roomID], connID)
+	if len(b.presence[roomID]) == 0 {
+		delete(b.presence, roomID)
+	}
+	return countConnections(b.presence[roomID], user.UserID) == 0, nil
+}
+
+func (b *LocalBus) Members(roomID string) ([]models.UserPresence, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	members := []models.UserPresence{}
+	for _, user := range b.presence[roomID] {
+		members = append(members, user)
+	}
+	return members, nil
+}
+
+// AppendEdit accepts every edit, since the node's own document is the only
+// copy and already orders them.
+func (b *LocalBus) AppendEdit(roomID, fileID string, edit Edit) (bool, error) {
+	return true, nil
+}
+
+func (b *LocalBus) EditsSince(roomID, fileID string, revision int) ([]Edit, error) {
+	return nil, nil
+}
+
+func (b *LocalBus) Driver(roomID string) (*models.DriverState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.drivers[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (b *LocalBus) UpdateDriver(roomID string, update func(*models.DriverState) (*models.DriverState, error)) (*models.DriverState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var current *models.DriverState
+	if state, ok := b.drivers[roomID]; ok {
+		current = &state
+	}
+	next, err := update(current)
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		delete(b.drivers, roomID)
+	} else {
+		b.drivers[roomID] = *next
+	}
+	return next, nil
+}
+
+func (b *LocalBus) Close() error {
+	return nil
+}
+
+func countConnections(conns map[string]models.UserPresence, userID string) int {
+	n := 0
+	for _, user := range conns {
+		if user.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+// CRDTServerClient authors the updates that seed a document from stored
+// code, which every node seeds the same way.
+const CRDTServerClient = "server"
+
+var (
+	ErrForeignCRDTClient = errors.New("update IDs must use the connection's clientId")
+	ErrStaleCRDTClock    = errors.New("update clocks must keep increasing")
+)
+
+type crdtElement struct {
+	id      models.CRDTID
+	value   rune
+	deleted bool
+}
+
+// CRDTDocument is an RGA sequence. Every character keeps its ID and a
+// tombstone once deleted, so replicas that apply the same set of updates
+// converge regardless of order and no central transform is needed.
+type CRDTDocument struct {
+	elements    []*crdtElement
+	log         []models.CRDTUpdate
+	pending     []models.CRDTUpdate
+	applied     map[models.CRDTID]bool
+	stateVector map[string]int
+	mu          sync.Mutex
+}
+
+func NewCRDTDocument(updates []models.CRDTUpdate) *CRDTDocument {
+	doc := &CRDTDocument{
+		applied:     make(map[models.CRDTID]bool),
+		stateVector: make(map[string]int),
+	}
+	doc.Apply(updates)
+	return doc
+}
+
+// SeedCRDTUpdates expresses initial code as a single server-authored run so
+// a freshly created room starts with content every replica agrees on.
+func SeedCRDTUpdates(code string) []models.CRDTUpdate {
+	if code == "" {
+		return nil
+	}
+	return []models.CRDTUpdate{{
+		Type:  models.OpInsert,
+		ID:    models.CRDTID{Client: CRDTServerClient, Clock: 1},
+		Value: code,
+	}}
+}
+
+// Apply integrates updates and returns the ones that were new to this
+// replica. Updates whose dependencies have not arrived yet are held back
+// and retried on later calls.
+func (d *CRDTDocument) Apply(updates []models.CRDTUpdate) []models.CRDTUpdate {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.apply(updates)
+}
+
+// ApplyFrom is Apply for updates a client authored. Each must carry the
+// client's own ID and a clock past everything it sent before, so no client
+// can shadow another's characters or reuse a clock.
+func (d *CRDTDocument) ApplyFrom(client string, updates []models.CRDTUpdate) ([]models.CRDTUpdate, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	clock := d.stateVector[client]
+	for _, p := range d.pending {
+		if p.ID.Client == client {
+			clock = max(clock, lastClock(p))
+		}
+	}
+	for _, update := range updates {
+		if update.ID.Client != client {
+			return nil, ErrForeignCRDTClient
+		}
+		if update.ID.Clock <= clock {
+			return nil, ErrStaleCRDTClock
+		}
+		clock = lastClock(update)
+	}
+	return d.apply(updates), nil
+}
+
+func (d *CRDTDocument) apply(updates []models.CRDTUpdate) []models.CRDTUpdate {
+	applied := []models.CRDTUpdate{}
+	for _, update := range updates {
+		if d.seen(update) {
+			continue
+		}
+		if d.hasPending(update.ID.Client) || !d.integrate(update) {
+			d.hold(update)
+			continue
+		}
+		applied = append(applied, update)
+	}
+
+	for progress := true; progress && len(d.pending) > 0; {
+		progress = false
+		blocked := make(map[string]bool)
+		remaining := d.pending[:0]
+		for _, update := range d.pending {
+			if blocked[update.ID.Client] || !d.integrate(update) {
+				blocked[update.ID.Client] = true
+				remaining = append(remaining, update)
+				continue
+			}
+			applied = append(applied, update)
+			progress = true
+		}
+		d.pending = remaining
+	}
+
+	return applied
+}
+
+// Replace authors updates as client that tombstone every visible character
+// and insert text at the start, applies them and returns them.
+func (d *CRDTDocument) Replace(client, text string) []models.CRDTUpdate {
+	d.mu.Lock()
+	clock := 0
+	for _, c := range d.stateVector {
+		clock = max(clock, c)
+	}
+	updates := []models.CRDTUpdate{}
+	for _, el := range d.elements {
+		if el.deleted {
+			continue
+		}
+		clock++
+		target := el.id
+		updates = append(updates, models.CRDTUpdate{
+			Type:   models.OpDelete,
+			ID:     models.CRDTID{Client: client, Clock: clock},
+			Target: &target,
+		})
+	}
+	if text != "" {
+		updates = append(updates, models.CRDTUpdate{
+			Type:  models.OpInsert,
+			ID:    models.CRDTID{Client: client, Clock: clock + 1},
+			Value: text,
+		})
+	}
+	applied := d.apply(updates)
+	d.mu.Unlock()
+	return applied
+}
+
+func (d *CRDTDocument) Text() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.text()
+}
+
+func (d *CRDTDocument) StateVector() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.copyStateVector()
+}
+
+// Snapshot returns the text along with the state vector it reflects.
+func (d *CRDTDocument) Snapshot() (string, map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.text(), d.copyStateVector()
+}
+
+func (d *CRDTDocument) text() string {
+	var b strings.Builder
+	for _, el := range d.elements {
+		if !el.deleted {
+			b.WriteRune(el.value)
+		}
+	}
+	return b.String()
+}
+
+func (d *CRDTDocument) copyStateVector() map[string]int {
+	sv := make(map[string]int, len(d.stateVector))
+	for client, clock := range d.stateVector {
+		sv[client] = clock
+	}
+	return sv
+}
+
+// UpdatesSince returns every applied update the holder of stateVector has
+// not seen, in the order this replica applied them.
+func (d *CRDTDocument) UpdatesSince(stateVector map[string]int) []models.CRDTUpdate {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	missing := []models.CRDTUpdate{}
+	for _, update := range d.log {
+		if lastClock(update) > stateVector[update.ID.Client] {
+			missing = append(missing, update)
+		}
+	}
+	return missing
+}
+
+// seen reports whether the update was applied or is held back already.
+func (d *CRDTDocument) seen(update models.CRDTUpdate) bool {
+	if d.applied[update.ID] {
+		return true
+	}
+	for _, p := range d.pending {
+		if p.ID == update.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// hold keeps an update back until it can be integrated. Pending updates
+// stay in clock order, so a client's are retried in the order it made them
+// however they arrived.
+func (d *CRDTDocument) hold(update models.CRDTUpdate) {
+	i := sort.Search(len(d.pending), func(i int) bool { return d.pending[i].ID.Clock > update.ID.Clock })
+	d.pending = append(d.pending, models.CRDTUpdate{})
+	copy(d.pending[i+1:], d.pending[i:])
+	d.pending[i] = update
+}
+
+func (d *CRDTDocument) hasPending(client string) bool {
+	for _, p := range d.pending {
+		if p.ID.Client == client {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *CRDTDocument) integrate(update models.CRDTUpdate) bool {
+	switch update.Type {
+	case models.OpInsert:
+		idx := 0
+		if update.Origin != nil {
+			originIdx := d.indexOf(*update.Origin)
+			if originIdx < 0 {
+				return false
+			}
+			idx = originIdx + 1
+		}
+		id := update.ID
+		for _, r := range update.Value {
+			for idx < len(d.elements) && crdtIDGreater(d.elements[idx].id, id) {
+				idx++
+			}
+			el := &crdtElement{id: id, value: r}
+			d.elements = append(d.elements, nil)
+			copy(d.elements[idx+1:], d.elements[idx:])
+			d.elements[idx] = el
+			idx++
+			id.Clock++
+		}
+
+	case models.OpDelete:
+		if update.Target == nil {
+			return true
+		}
+		idx := d.indexOf(*update.Target)
+		if idx < 0 {
+			return false
+		}
+		d.elements[idx].deleted = true
+
+	default:
+		return true
+	}
+
+	d.log = append(d.log, update)
+	d.applied[update.ID] = true
+	if clock := lastClock(update); clock > d.stateVector[update.ID.Client] {
+		d.stateVector[update.ID.Client] = clock
+	}
+	return true
+}
+
+func (d *CRDTDocument) indexOf(id models.CRDTID) int {
+	for i, el := range d.elements {
+		if el.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func crdtIDGreater(a, b models.CRDTID) bool {
+	if a.Clock != b.Clock {
+		return a.Clock > b.Clock
+	}
+	return a.Client > b.Client
+}
+
+func lastClock(update models.CRDTUpdate) int {
+	if update.Type == models.OpInsert && update.Value != "" {
+		return update.ID.Clock + len([]rune(update.Value)) - 1
+	}
+	return update.ID.Clock
+}
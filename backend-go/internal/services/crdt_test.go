@@ -0,0 +1,160 @@
+package services
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+func crdtInsert(client string, clock int, origin *models.CRDTID, value string) models.CRDTUpdate {
+	return models.CRDTUpdate{Type: models.OpInsert, ID: models.CRDTID{Client: client, Clock: clock}, Origin: origin, Value: value}
+}
+
+func crdtDelete(client string, clock int, target models.CRDTID) models.CRDTUpdate {
+	return models.CRDTUpdate{Type: models.OpDelete, ID: models.CRDTID{Client: client, Clock: clock}, Target: &target}
+}
+
+func crdtAt(client string, clock int) *models.CRDTID {
+	return &models.CRDTID{Client: client, Clock: clock}
+}
+
+// concurrentEdits is alice and bob editing "ab" at the same time: both
+// insert after the "a", bob deletes the "b" and adds a line at the start,
+// and alice deletes bob's insert once she has seen it.
+func concurrentEdits() []models.CRDTUpdate {
+	return []models.CRDTUpdate{
+		crdtInsert("alice", 3, crdtAt(CRDTServerClient, 1), "X"),
+		crdtInsert("alice", 4, crdtAt("alice", 3), "Y"),
+		crdtInsert("bob", 3, crdtAt(CRDTServerClient, 1), "Z"),
+		crdtDelete("bob", 4, models.CRDTID{Client: CRDTServerClient, Clock: 2}),
+		crdtInsert("bob", 5, nil, "W"),
+		crdtDelete("alice", 5, models.CRDTID{Client: "bob", Clock: 3}),
+	}
+}
+
+func TestCRDTConvergesOutOfOrder(t *testing.T) {
+	want := NewCRDTDocument(SeedCRDTUpdates("ab"))
+	want.Apply(concurrentEdits())
+	wantText, wantVector := want.Snapshot()
+	if wantText != "WaXY" {
+		t.Fatalf("got %q in delivery order, want %q", wantText, "WaXY")
+	}
+
+	// Replicas receive the same updates one at a time in a different order,
+	// some of them twice.
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		updates := append(SeedCRDTUpdates("ab"), concurrentEdits()...)
+		updates = append(updates, updates[random.Intn(len(updates))])
+		random.Shuffle(len(updates), func(a, b int) { updates[a], updates[b] = updates[b], updates[a] })
+
+		doc := NewCRDTDocument(nil)
+		applied := 0
+		for _, update := range updates {
+			applied += len(doc.Apply([]models.CRDTUpdate{update}))
+		}
+
+		text, vector := doc.Snapshot()
+		if text != wantText || !reflect.DeepEqual(vector, wantVector) {
+			t.Fatalf("delivering %v: got %q with %v, want %q with %v", updates, text, vector, wantText, wantVector)
+		}
+		if applied != len(updates)-1 {
+			t.Fatalf("delivering %v: %d updates reported applied, want %d", updates, applied, len(updates)-1)
+		}
+	}
+}
+
+func TestCRDTUpdatesSinceCatchesUpReplica(t *testing.T) {
+	server := NewCRDTDocument(SeedCRDTUpdates("ab"))
+	replica := NewCRDTDocument(SeedCRDTUpdates("ab"))
+	edits := concurrentEdits()
+	server.Apply(edits)
+	replica.Apply(edits[:2])
+
+	replica.Apply(server.UpdatesSince(replica.StateVector()))
+	if got, want := replica.Text(), server.Text(); got != want {
+		t.Errorf("got %q after syncing, want %q", got, want)
+	}
+}
+
+func TestCRDTApplyFromChecksIDs(t *testing.T) {
+	doc := NewCRDTDocument(SeedCRDTUpdates("ab"))
+
+	if _, err := doc.ApplyFrom("alice", []models.CRDTUpdate{crdtInsert("bob", 3, nil, "x")}); err != ErrForeignCRDTClient {
+		t.Errorf("update as another client: got %v, want %v", err, ErrForeignCRDTClient)
+	}
+	if _, err := doc.ApplyFrom("alice", []models.CRDTUpdate{crdtInsert("alice", 3, nil, "xyz")}); err != nil {
+		t.Fatalf("applying own update: %v", err)
+	}
+	// "xyz" took clocks 3 through 5.
+	if _, err := doc.ApplyFrom("alice", []models.CRDTUpdate{crdtInsert("alice", 5, nil, "!")}); err != ErrStaleCRDTClock {
+		t.Errorf("reused clock: got %v, want %v", err, ErrStaleCRDTClock)
+	}
+	// Held back until its origin arrives, but its clock still counts.
+	if _, err := doc.ApplyFrom("alice", []models.CRDTUpdate{crdtInsert("alice", 7, crdtAt("bob", 1), "?")}); err != nil {
+		t.Fatalf("applying update with a missing origin: %v", err)
+	}
+	if _, err := doc.ApplyFrom("alice", []models.CRDTUpdate{crdtInsert("alice", 6, nil, "!")}); err != ErrStaleCRDTClock {
+		t.Errorf("clock behind a pending update: got %v, want %v", err, ErrStaleCRDTClock)
+	}
+	if got := doc.Text(); got != "xyzab" {
+		t.Errorf("got %q, want %q", got, "xyzab")
+	}
+}
+
+func TestCRDTOfflineEditsAfterReconnect(t *testing.T) {
+	server := NewCRDTDocument(SeedCRDTUpdates("ab"))
+	replica := NewCRDTDocument(SeedCRDTUpdates("ab"))
+	first := &Client{ConnID: "conn-1", UserID: "alice", DeviceID: "laptop"}
+	id := first.CRDTClientID()
+
+	online := []models.CRDTUpdate{crdtInsert(id, 3, nil, "x")}
+	if _, err := server.ApplyFrom(id, online); err != nil {
+		t.Fatalf("applying online edit: %v", err)
+	}
+	replica.Apply(online)
+
+	// The connection drops. Alice keeps editing while bob carries on.
+	offline := []models.CRDTUpdate{
+		crdtInsert(id, 4, crdtAt(id, 3), "y"),
+		crdtDelete(id, 5, models.CRDTID{Client: CRDTServerClient, Clock: 2}),
+	}
+	replica.Apply(offline)
+	server.Apply([]models.CRDTUpdate{crdtInsert("bob:phone", 1, crdtAt(CRDTServerClient, 2), "!")})
+
+	// Only the same user on the same device may send them.
+	for _, other := range []*Client{
+		{ConnID: "conn-2", UserID: "alice"},
+		{ConnID: "conn-2", UserID: "mallory", DeviceID: "laptop"},
+	} {
+		if _, err := server.ApplyFrom(other.CRDTClientID(), offline); err != ErrForeignCRDTClient {
+			t.Errorf("offline edits sent as %s: got %v, want %v", other.CRDTClientID(), err, ErrForeignCRDTClient)
+		}
+	}
+
+	second := &Client{ConnID: "conn-3", UserID: "alice", DeviceID: "laptop"}
+	if _, err := server.ApplyFrom(second.CRDTClientID(), replica.UpdatesSince(server.StateVector())); err != nil {
+		t.Fatalf("applying offline edits after reconnecting: %v", err)
+	}
+	replica.Apply(server.UpdatesSince(replica.StateVector()))
+	if got, want := replica.Text(), server.Text(); got != want || got != "xya!" {
+		t.Errorf("got %q on the replica and %q on the server, want %q", got, want, "xya!")
+	}
+}
+
+func TestCRDTRestoresOnTwoNodesConverge(t *testing.T) {
+	nodeA, nodeB := NewRoomManager(NewLocalBus()), NewRoomManager(NewLocalBus())
+	a := NewCRDTDocument(SeedCRDTUpdates("ab"))
+	b := NewCRDTDocument(SeedCRDTUpdates("ab"))
+
+	fromA := a.Replace(nodeA.CRDTClient(), "one")
+	fromB := b.Replace(nodeB.CRDTClient(), "two")
+	if applied := len(a.Apply(fromB)) + len(b.Apply(fromA)); applied != len(fromA)+len(fromB) {
+		t.Errorf("%d of %d updates applied, the restores clashed", applied, len(fromA)+len(fromB))
+	}
+	if a.Text() != b.Text() {
+		t.Errorf("got %q and %q after exchanging restores", a.Text(), b.Text())
+	}
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"strings"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+// DiffLines computes a line diff of a and b with Myers' algorithm.
+func DiffLines(a, b string) []models.DiffLine {
+	x := splitLines(a)
+	y := splitLines(b)
+	n, m := len(x), len(y)
+
+	// trace[d] holds the furthest x reached on each diagonal k in [-d, d]
+	// before round d, indexed by k+d.
+	var trace [][]int
+	v := map[int]int{1: 0}
+	for d := 0; d <= n+m; d++ {
+		snapshot := make([]int, 2*d+1)
+		for k := -d; k <= d; k++ {
+			snapshot[k+d] = v[k]
+		}
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var xi int
+			if k == -d || (k != d && v[k-1] < v[k+1]) {
+				xi = v[k+1]
+			} else {
+				xi = v[k-1] + 1
+			}
+			yi := xi - k
+			for xi < n && yi < m && x[xi] == y[yi] {
+				xi++
+				yi++
+			}
+			v[k] = xi
+			if xi >= n && yi >= m {
+				return backtrackDiff(trace, x, y)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(trace [][]int, x, y []string) []models.DiffLine {
+	var lines []models.DiffLine
+	xi, yi := len(x), len(y)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := func(k int) int { return trace[d][k+d] }
+		k := xi - yi
+
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v(prevK)
+		}
+		prevY := prevX - prevK
+
+		for xi > prevX && yi > prevY {
+			xi--
+			yi--
+			lines = append(lines, models.DiffLine{Op: DiffEqual, Text: x[xi], OldLine: xi + 1, NewLine: yi + 1})
+		}
+		if d > 0 {
+			if xi == prevX {
+				lines = append(lines, models.DiffLine{Op: DiffInsert, Text: y[prevY], NewLine: prevY + 1})
+			} else {
+				lines = append(lines, models.DiffLine{Op: DiffDelete, Text: x[prevX], OldLine: prevX + 1})
+			}
+		}
+		xi, yi = prevX, prevY
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+var (
+	ErrDriverModeOff    = errors.New("driver mode is off")
+	ErrNotDriver        = errors.New("not the driver")
+	ErrCannotDrive      = errors.New("viewers cannot drive")
+	ErrNoRequest        = errors.New("user has not requested control")
+	ErrDriverContention = errors.New("too many concurrent driver changes")
+)
+
+// driverState is this node's copy of a room's driver state, with the timer
+// that rotates the driver. The state itself lives on the bus, where every
+// change is made, so control is decided alike whichever node a user is on.
+// The copy follows the driver_state broadcasts and is what edits over
+// WebSocket are checked against.
+type driverState struct {
+	models.DriverState
+	timer *time.Timer
+}
+
+// CanDrive reports whether the client may edit code, which outside driver
+// mode everyone who can edit may.
+func (rm *RoomManager) CanDrive(client *Client) bool {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	st := rm.drivers[client.RoomID]
+	return st == nil || st.DriverID == client.UserID
+}
+
+// MayDrive reports whether the user may edit a room in driver mode over
+// REST, which they may while they drive or nobody does. It reads the
+// shared state, since this node may have nobody in the room.
+func (rm *RoomManager) MayDrive(roomID, userID string) (bool, error) {
+	state, err := rm.bus.Driver(roomID)
+	if err != nil {
+		return false, err
+	}
+	return state == nil || state.DriverID == "" || state.DriverID == userID, nil
+}
+
+// DriverState returns a room's driver state, or nil outside driver mode.
+func (rm *RoomManager) DriverState(roomID string) *models.DriverState {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	st := rm.drivers[roomID]
+	if st == nil {
+		return nil
+	}
+	state := st.snapshot()
+	return &state
+}
+
+// RequestControl hands the client control if nobody drives, and otherwise
+// queues their request for the driver to grant.
+func (rm *RoomManager) RequestControl(client *Client) error {
+	if !models.CanEdit(client.Role()) {
+		return ErrCannotDrive
+	}
+	return rm.changeDriver(client.RoomID, func(state *models.DriverState) (bool, error) {
+		switch {
+		case state.DriverID == "":
+			setDriver(state, client.UserID)
+		case state.DriverID != client.UserID && !slices.Contains(state.Requests, client.UserID):
+			state.Requests = append(state.Requests, client.UserID)
+		default:
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+// GrantControl lets the driver, or the owner, hand control to a user who
+// asked for it, or to the first who did when userID is empty.
+func (rm *RoomManager) GrantControl(client *Client, userID string) error {
+	return rm.changeDriver(client.RoomID, func(state *models.DriverState) (bool, error) {
+		if state.DriverID != client.UserID && client.Role() != models.RoleOwner {
+			return false, ErrNotDriver
+		}
+		next := userID
+		if next == "" {
+			next = firstOf(state.Requests)
+		}
+		if !slices.Contains(state.Requests, next) {
+			return false, ErrNoRequest
+		}
+		setDriver(state, next)
+		return true, nil
+	})
+}
+
+// ReleaseControl gives up the client's control to the first user waiting
+// for it, leaving the room without a driver if nobody is.
+func (rm *RoomManager) ReleaseControl(client *Client) error {
+	return rm.changeDriver(client.RoomID, func(state *models.DriverState) (bool, error) {
+		if state.DriverID != client.UserID {
+			return false, ErrNotDriver
+		}
+		setDriver(state, firstOf(state.Requests))
+		return true, nil
+	})
+}
+
+// dropDriver takes a user who can no longer drive, because they left or
+// became a viewer, out of the running, passing control on if they had it.
+func (rm *RoomManager) dropDriver(roomID, userID string) {
+	err := rm.changeDriver(roomID, func(state *models.DriverState) (bool, error) {
+		if state.DriverID != userID && !slices.Contains(state.Requests, userID) {
+			return false, nil
+		}
+		state.Requests = slices.DeleteFunc(state.Requests, func(uid string) bool { return uid == userID })
+		if state.DriverID == userID {
+			setDriver(state, firstOf(state.Requests))
+		}
+		return true, nil
+	})
+	if err != nil && err != ErrDriverModeOff {
+		log.Printf("Error updating driver state: %v", err)
+	}
+}
+
+// changeDriver applies change to a copy of a room's shared driver state.
+// If change reports a change, the copy is stored, adopted on this node and
+// sent to the room's clients on every node.
+func (rm *RoomManager) changeDriver(roomID string, change func(state *models.DriverState) (bool, error)) error {
+	changed := false
+	state, err := rm.bus.UpdateDriver(roomID, func(current *models.DriverState) (*models.DriverState, error) {
+		if current == nil {
+			return nil, ErrDriverModeOff
+		}
+		next := cloneDriver(*current)
+		var err error
+		if changed, err = change(&next); err != nil || !changed {
+			return current, err
+		}
+		next.Version++
+		return &next, nil
+	})
+	if err != nil || !changed {
+		return err
+	}
+	rm.adoptDriver(roomID, *state)
+	rm.publishDriver(roomID, *state)
+	return nil
+}
+
+// configureDriver starts, changes or ends driver mode in a room on this
+// node, then has the shared state brought in line. Called with rm.mu held.
+func (rm *RoomManager) configureDriver(roomID string, enabled bool, rotateMinutes int) {
+	st := rm.drivers[roomID]
+	switch {
+	case !enabled:
+		if st == nil {
+			return
+		}
+		st.stop()
+		delete(rm.drivers, roomID)
+	case st == nil:
+		st = &driverState{DriverState: models.DriverState{Requests: []string{}, RotateMinutes: rotateMinutes}}
+		rm.drivers[roomID] = st
+	case st.RotateMinutes == rotateMinutes:
+		return
+	}
+	rm.queuePresence(func() { rm.syncDriver(roomID, enabled, rotateMinutes) })
+}
+
+// syncDriver brings a room's shared driver state in line with its settings,
+// which every node in the room does with the first to get there making the
+// change, and adopts the result on this node, telling the clients here.
+func (rm *RoomManager) syncDriver(roomID string, enabled bool, rotateMinutes int) {
+	state, err := rm.bus.UpdateDriver(roomID, func(current *models.DriverState) (*models.DriverState, error) {
+		if !enabled {
+			return nil, nil
+		}
+		if current != nil && current.RotateMinutes == rotateMinutes {
+			return current, nil
+		}
+		next := models.DriverState{Requests: []string{}}
+		if current != nil {
+			next = cloneDriver(*current)
+		}
+		next.RotateMinutes = rotateMinutes
+		next.Version++
+		restartRotation(&next)
+		return &next, nil
+	})
+	if err != nil {
+		log.Printf("Error updating driver state: %v", err)
+		return
+	}
+	if state == nil || !rm.adoptDriver(roomID, *state) {
+		return
+	}
+	data, _ := json.Marshal(models.WSMessage{Type: "driver_state", Payload: cloneDriver(*state)})
+	rm.broadcast <- BroadcastMessage{RoomID: roomID, Message: data}
+}
+
+// endDriver drops a room's driver state once nobody on this node is in it.
+// Called with rm.mu held.
+func (rm *RoomManager) endDriver(roomID string) {
+	if st := rm.drivers[roomID]; st != nil {
+		st.stop()
+		delete(rm.drivers, roomID)
+	}
+}
+
+// adoptDriver makes a room's shared driver state this node's copy, unless
+// the room is not in driver mode here or the copy is already newer,
+// reporting whether it did.
+func (rm *RoomManager) adoptDriver(roomID string, state models.DriverState) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	st := rm.drivers[roomID]
+	if st == nil || state.Version < st.Version {
+		return false
+	}
+	st.DriverState = cloneDriver(state)
+	rm.scheduleRotation(roomID, st)
+	return true
+}
+
+// applyDriver adopts driver state published by another node.
+func (rm *RoomManager) applyDriver(roomID string, state models.DriverState) {
+	rm.adoptDriver(roomID, state)
+}
+
+// scheduleRotation sets the timer for the state's next rotation, if any.
+// Called with rm.mu held.
+func (rm *RoomManager) scheduleRotation(roomID string, st *driverState) {
+	st.stop()
+	if st.NextRotation == nil {
+		return
+	}
+	version := st.Version
+	st.timer = time.AfterFunc(time.Until(*st.NextRotation), func() {
+		rm.rotate(roomID, version)
+	})
+}
+
+// rotate hands control to the first user who asked for it, or else to the
+// next connected editor by user ID. Every node in the room has a timer for
+// it; the first to fire rotates and the others find the state has moved
+// on from version.
+func (rm *RoomManager) rotate(roomID string, version int) {
+	members, err := rm.bus.Members(roomID)
+	if err != nil {
+		log.Printf("Error fetching room members: %v", err)
+	}
+	err = rm.changeDriver(roomID, func(state *models.DriverState) (bool, error) {
+		if state.Version != version {
+			return false, nil
+		}
+		next := firstOf(state.Requests)
+		if next == "" {
+			next = nextDriver(members, state.DriverID)
+		}
+		setDriver(state, next)
+		return true, nil
+	})
+	if err != nil && err != ErrDriverModeOff {
+		log.Printf("Error rotating driver: %v", err)
+	}
+}
+
+// publishDriver tells a room's clients on every node about its driver.
+func (rm *RoomManager) publishDriver(roomID string, state models.DriverState) {
+	data, _ := json.Marshal(models.WSMessage{Type: "driver_state", Payload: state})
+	rm.BroadcastToRoom(roomID, data, "")
+}
+
+// setDriver makes userID the driver, or leaves the room without one when
+// empty, and starts a new rotation period.
+func setDriver(state *models.DriverState, userID string) {
+	state.DriverID = userID
+	state.Requests = slices.DeleteFunc(state.Requests, func(uid string) bool { return uid == userID })
+	restartRotation(state)
+}
+
+// restartRotation sets the next rotation a full period from now.
+func restartRotation(state *models.DriverState) {
+	state.NextRotation = nil
+	if state.DriverID != "" && state.RotateMinutes > 0 {
+		next := time.Now().Add(time.Duration(state.RotateMinutes) * time.Minute)
+		state.NextRotation = &next
+	}
+}
+
+// nextDriver picks the connected editor after current in user ID order,
+// wrapping around, or keeps current when nobody else can drive.
+func nextDriver(members []models.UserPresence, current string) string {
+	var editors []string
+	for _, member := range members {
+		if models.CanEdit(member.Role) && !slices.Contains(editors, member.UserID) {
+			editors = append(editors, member.UserID)
+		}
+	}
+	if len(editors) == 0 {
+		return current
+	}
+	sort.Strings(editors)
+	for _, uid := range editors {
+		if uid > current {
+			return uid
+		}
+	}
+	return editors[0]
+}
+
+func firstOf(userIDs []string) string {
+	if len(userIDs) == 0 {
+		return ""
+	}
+	return userIDs[0]
+}
+
+func (st *driverState) snapshot() models.DriverState {
+	return cloneDriver(st.DriverState)
+}
+
+func cloneDriver(state models.DriverState) models.DriverState {
+	state.Requests = slices.Clone(state.Requests)
+	if state.Requests == nil {
+		state.Requests = []string{}
+	}
+	return state
+}
+
+func (st *driverState) stop() {
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+const (
+	maxOTHistory      = 1000
+	maxAppendAttempts = 50
+)
+
+var (
+	ErrRevisionTooOld = errors.New("base revision is no longer available, resync required")
+	ErrFutureRevision = errors.New("base revision is ahead of the document")
+	ErrInvalidOp      = errors.New("operation is out of range for the document")
+	ErrEditsGone      = errors.New("edits are no longer in the log, reload the document")
+	ErrEditContention = errors.New("too many concurrent edits, resync required")
+)
+
+type appliedOp struct {
+	revision int
+	userID   string
+	ops      []models.TextOp
+}
+
+// Edit is an edit a document accepted, as kept in its shared edit log.
+type Edit struct {
+	Revision int             `json:"revision"`
+	UserID   string          `json:"userId"`
+	Ops      []models.TextOp `json:"ops"`
+	Language string          `json:"language,omitempty"`
+}
+
+// EditLog is where the nodes sharing a document agree on the order of its
+// edits. Append logs an edit only if it directly follows the last one
+// logged; Since returns the edits logged after a revision.
+type EditLog interface {
+	Append(edit Edit) (bool, error)
+	Since(revision int) ([]Edit, error)
+}
+
+// OTDocument is a node's copy of a room's code. Clients submit ops against
+// the revision they last saw and the document transforms them over
+// everything that has been applied since. With a log, an edit only takes
+// a revision once the log has it, so every node's copy applies the same
+// edits in the same order.
+type OTDocument struct {
+	content  []rune
+	language string
+	revision int
+	history  []appliedOp
+	log      EditLog
+	mu       sync.Mutex
+}
+
+func NewOTDocument(code, language string, revision int) *OTDocument {
+	return &OTDocument{
+		content:  []rune(code),
+		language: language,
+		revision: revision,
+	}
+}
+
+func (d *OTDocument) Snapshot() (string, string, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return string(d.content), d.language, d.revision
+}
+
+// OTSnapshot is a document's code as an edit left it, before any later
+// edit could change it.
+type OTSnapshot struct {
+	Code     string
+	Language string
+	Revision int
+}
+
+func (d *OTDocument) snapshot() OTSnapshot {
+	return OTSnapshot{Code: string(d.content), Language: d.language, Revision: d.revision}
+}
+
+// Apply transforms ops from baseRevision up to the current revision, applies
+// them and returns the transformed ops along with the code at the new
+// revision. When another node logged the next revision first, the document
+// catches up with it and transforms the ops again.
+func (d *OTDocument) Apply(userID string, baseRevision int, ops []models.TextOp, language string) ([]models.TextOp, OTSnapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if baseRevision > d.revision {
+		return nil, d.snapshot(), ErrFutureRevision
+	}
+	ops = normalizeOps(ops)
+
+	for attempt := 1; ; attempt++ {
+		oldest := d.revision - len(d.history)
+		if baseRevision < oldest {
+			return nil, d.snapshot(), ErrRevisionTooOld
+		}
+
+		transformed := ops
+		for _, past := range d.history[baseRevision-oldest:] {
+			transformed, _ = transformOps(transformed, past.ops, false)
+		}
+
+		content, err := applyOps(d.content, transformed)
+		if err != nil {
+			return nil, d.snapshot(), err
+		}
+
+		edit := Edit{Revision: d.revision + 1, UserID: userID, Ops: transformed, Language: language}
+		logged := true
+		if d.log != nil {
+			if logged, err = d.log.Append(edit); err != nil {
+				return nil, d.snapshot(), err
+			}
+		}
+		if logged {
+			d.record(edit, content)
+			return transformed, d.snapshot(), nil
+		}
+
+		if attempt == maxAppendAttempts {
+			return nil, d.snapshot(), ErrEditContention
+		}
+		if err := d.catchUp(); err != nil {
+			return nil, d.snapshot(), err
+		}
+	}
+}
+
+// ApplyRemote applies an edit another node logged. Edits the document has
+// already caught up on are skipped, and any it missed are read from the log.
+func (d *OTDocument) ApplyRemote(edit Edit) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case edit.Revision <= d.revision:
+		return nil
+	case edit.Revision == d.revision+1:
+		return d.applyEdit(edit)
+	default:
+		return d.catchUp()
+	}
+}
+
+// CatchUp applies the edits other nodes logged since the local revision,
+// for a document just loaded from storage, which may lag behind the log.
+func (d *OTDocument) CatchUp() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.catchUp()
+}
+
+func (d *OTDocument) catchUp() error {
+	if d.log == nil {
+		return nil
+	}
+	edits, err := d.log.Since(d.revision)
+	if err != nil {
+		return err
+	}
+	for _, edit := range edits {
+		if err := d.applyEdit(edit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *OTDocument) applyEdit(edit Edit) error {
+	if edit.Revision != d.revision+1 {
+		return ErrFutureRevision
+	}
+	content, err := applyOps(d.content, edit.Ops)
+	if err != nil {
+		return err
+	}
+	d.record(edit, content)
+	return nil
+}
+
+func (d *OTDocument) record(edit Edit, content []rune) {
+	d.content = content
+	if edit.Language != "" {
+		d.language = edit.Language
+	}
+	d.revision = edit.Revision
+	d.history = append(d.history, appliedOp{revision: edit.Revision, userID: edit.UserID, ops: edit.Ops})
+	if len(d.history) > maxOTHistory {
+		d.history = d.history[len(d.history)-maxOTHistory:]
+	}
+}
+
+// Replace turns a whole-document overwrite into ops at the current revision,
+// for clients that still send the full code instead of changes.
+func (d *OTDocument) Replace(userID, code, language string) ([]models.TextOp, OTSnapshot, error) {
+	d.mu.Lock()
+	current := len(d.content)
+	revision := d.revision
+	d.mu.Unlock()
+
+	ops := []models.TextOp{}
+	if current > 0 {
+		ops = append(ops, models.TextOp{Type: models.OpDelete, Position: 0, Length: current})
+	}
+	if code != "" {
+		ops = append(ops, models.TextOp{Type: models.OpInsert, Position: 0, Text: code})
+	}
+	return d.Apply(userID, revision, ops, language)
+}
+
+func normalizeOps(ops []models.TextOp) []models.TextOp {
+	out := make([]models.TextOp, 0, len(ops))
+	for _, op := range ops {
+		if op.Type == models.OpInsert && op.Text == "" {
+			continue
+		}
+		if op.Type == models.OpDelete && op.Length <= 0 {
+			continue
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+func applyOps(content []rune, ops []models.TextOp) ([]rune, error) {
+	result := append([]rune(nil), content...)
+	for _, op := range ops {
+		switch op.Type {
+		case models.OpInsert:
+			if op.Position < 0 || op.Position > len(result) {
+				return nil, ErrInvalidOp
+			}
+			text := []rune(op.Text)
+			next := make([]rune, 0, len(result)+len(text))
+			next = append(next, result[:op.Position]...)
+			next = append(next, text...)
+			result = append(next, result[op.Position:]...)
+		case models.OpDelete:
+			if op.Position < 0 || op.Length < 0 || op.Position+op.Length > len(result) {
+				return nil, ErrInvalidOp
+			}
+			result = append(result[:op.Position], result[op.Position+op.Length:]...)
+		default:
+			return nil, ErrInvalidOp
+		}
+	}
+	return result, nil
+}
+
+// transformOps returns a' and b' such that applying b then a' yields the
+// same document as applying a then b'. When both insert at the same
+// position, aFirst decides whose text ends up first.
+func transformOps(a, b []models.TextOp, aFirst bool) ([]models.TextOp, []models.TextOp) {
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+	if len(a) > 1 {
+		a1, b1 := transformOps(a[:1], b, aFirst)
+		a2, b2 := transformOps(a[1:], b1, aFirst)
+		return append(a1, a2...), b2
+	}
+	if len(b) > 1 {
+		a1, b1 := transformOps(a, b[:1], aFirst)
+		a2, b2 := transformOps(a1, b[1:], aFirst)
+		return a2, append(b1, b2...)
+	}
+	return transformPair(a[0], b[0], aFirst)
+}
+
+func transformPair(a, b models.TextOp, aFirst bool) ([]models.TextOp, []models.TextOp) {
+	switch {
+	case a.Type == models.OpInsert && b.Type == models.OpInsert:
+		if a.Position < b.Position || (a.Position == b.Position && aFirst) {
+			return ops(a), ops(shift(b, runeLen(a.Text)))
+		}
+		return ops(shift(a, runeLen(b.Text))), ops(b)
+
+	case a.Type == models.OpInsert && b.Type == models.OpDelete:
+		return transformInsertDelete(a, b)
+
+	case a.Type == models.OpDelete && b.Type == models.OpInsert:
+		bt, at := transformInsertDelete(b, a)
+		return at, bt
+
+	default:
+		return ops(transformDeleteDelete(a, b)...), ops(transformDeleteDelete(b, a)...)
+	}
+}
+
+func transformInsertDelete(ins, del models.TextOp) ([]models.TextOp, []models.TextOp) {
+	end := del.Position + del.Length
+	switch {
+	case ins.Position <= del.Position:
+		return ops(ins), ops(shift(del, runeLen(ins.Text)))
+	case ins.Position >= end:
+		return ops(shift(ins, -del.Length)), ops(del)
+	default:
+		before := models.TextOp{Type: models.OpDelete, Position: del.Position, Length: ins.Position - del.Position}
+		after := models.TextOp{Type: models.OpDelete, Position: del.Position + runeLen(ins.Text), Length: end - ins.Position}
+		moved := ins
+		moved.Position = del.Position
+		return ops(moved), ops(before, after)
+	}
+}
+
+func transformDeleteDelete(a, b models.TextOp) []models.TextOp {
+	aEnd := a.Position + a.Length
+	bEnd := b.Position + b.Length
+	shiftBy := max(0, min(bEnd, a.Position)-b.Position)
+	overlap := max(0, min(aEnd, bEnd)-max(a.Position, b.Position))
+	if a.Length-overlap == 0 {
+		return nil
+	}
+	return []models.TextOp{{Type: models.OpDelete, Position: a.Position - shiftBy, Length: a.Length - overlap}}
+}
+
+func ops(list ...models.TextOp) []models.TextOp {
+	out := make([]models.TextOp, 0, len(list))
+	for _, op := range list {
+		if op.Type == models.OpDelete && op.Length == 0 {
+			continue
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+func shift(op models.TextOp, by int) models.TextOp {
+	op.Position += by
+	return op
+}
+
+func runeLen(s string) int {
+	return len([]rune(s))
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+func ins(position int, text string) models.TextOp {
+	return models.TextOp{Type: models.OpInsert, Position: position, Text: text}
+}
+
+func del(position, length int) models.TextOp {
+	return models.TextOp{Type: models.OpDelete, Position: position, Length: length}
+}
+
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		a, b   []models.TextOp
+		aFirst bool
+		want   string
+	}{
+		{"inserts at different positions", "abc", ops(ins(0, "X")), ops(ins(3, "Y")), true, "XabcY"},
+		{"inserts at the same position, a first", "abc", ops(ins(1, "X")), ops(ins(1, "Y")), true, "aXYbc"},
+		{"inserts at the same position, b first", "abc", ops(ins(1, "X")), ops(ins(1, "Y")), false, "aYXbc"},
+		{"insert before a delete", "abcdef", ops(ins(1, "X")), ops(del(1, 2)), true, "aXdef"},
+		{"insert after a delete", "abcdef", ops(ins(3, "X")), ops(del(1, 2)), true, "aXdef"},
+		{"insert inside a delete", "abcdef", ops(ins(3, "X")), ops(del(1, 4)), true, "aXf"},
+		{"delete around an insert", "abcdef", ops(del(1, 4)), ops(ins(3, "X")), true, "aXf"},
+		{"disjoint deletes", "abcdef", ops(del(0, 2)), ops(del(4, 2)), true, "cd"},
+		{"overlapping deletes", "abcdef", ops(del(1, 3)), ops(del(2, 3)), true, "af"},
+		{"nested deletes", "abcdef", ops(del(1, 4)), ops(del(2, 1)), true, "af"},
+		{"identical deletes", "abcdef", ops(del(2, 2)), ops(del(2, 2)), true, "abef"},
+		{"multi-op edits", "hello world", ops(del(0, 5), ins(0, "goodbye")), ops(ins(11, "!"), del(5, 1)), true, "goodbyeworld!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a2, b2 := transformOps(tt.a, tt.b, tt.aFirst)
+			aThenB := mustApply(t, mustApply(t, tt.doc, tt.a), b2)
+			bThenA := mustApply(t, mustApply(t, tt.doc, tt.b), a2)
+
+			if aThenB != bThenA {
+				t.Fatalf("diverged: a then b' gives %q, b then a' gives %q", aThenB, bThenA)
+			}
+			if aThenB != tt.want {
+				t.Errorf("got %q, want %q", aThenB, tt.want)
+			}
+		})
+	}
+}
+
+func TestOTDocumentTransformsStaleEdits(t *testing.T) {
+	doc := NewOTDocument("hello world", "", 0)
+
+	// Three users all edit revision 0; each later edit is transformed over
+	// the ones accepted before it.
+	edits := []struct {
+		user string
+		ops  []models.TextOp
+	}{
+		{"alice", ops(ins(0, "> "))},
+		{"bob", ops(del(5, 6))},
+		{"carol", ops(ins(11, "!"))},
+	}
+	for i, e := range edits {
+		_, snapshot, err := doc.Apply(e.user, 0, e.ops, "")
+		if err != nil {
+			t.Fatalf("applying edit from %s: %v", e.user, err)
+		}
+		if snapshot.Revision != i+1 {
+			t.Errorf("got revision %d for %s, want %d", snapshot.Revision, e.user, i+1)
+		}
+	}
+
+	if code, _, _ := doc.Snapshot(); code != "> hello!" {
+		t.Errorf("got %q, want %q", code, "> hello!")
+	}
+}
+
+func TestOTDocumentRejectsBadEdits(t *testing.T) {
+	doc := NewOTDocument("abc", "", 5)
+
+	if _, _, err := doc.Apply("alice", 6, ops(ins(0, "x")), ""); err != ErrFutureRevision {
+		t.Errorf("edit from the future: got %v, want %v", err, ErrFutureRevision)
+	}
+	if _, _, err := doc.Apply("alice", 4, ops(ins(0, "x")), ""); err != ErrRevisionTooOld {
+		t.Errorf("edit older than the history: got %v, want %v", err, ErrRevisionTooOld)
+	}
+	if _, _, err := doc.Apply("alice", 5, ops(del(2, 5)), ""); err != ErrInvalidOp {
+		t.Errorf("delete past the end: got %v, want %v", err, ErrInvalidOp)
+	}
+	if code, _, revision := doc.Snapshot(); code != "abc" || revision != 5 {
+		t.Errorf("got %q at %d after rejected edits, want %q at 5", code, revision, "abc")
+	}
+}
+
+func mustApply(t *testing.T, doc string, list []models.TextOp) string {
+	t.Helper()
+	content, err := applyOps([]rune(doc), list)
+	if err != nil {
+		t.Fatalf("applying %v to %q: %v", list, doc, err)
+	}
+	return string(content)
+}
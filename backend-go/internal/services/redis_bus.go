@@ -0,0 +1,333 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix     = "pairprog:"
+	redisNodeTTL       = 30 * time.Second
+	redisNodeHeartbeat = 10 * time.Second
+	redisEditLogTTL    = 24 * time.Hour
+	redisDriverRetries = 50
+)
+
+// appendEditScript logs an edit if it follows the last one in the log. An
+// empty log takes any revision: nothing was edited for longer than the log
+// is kept, so every node loads the same revision from storage.
+var appendEditScript = redis.NewScript(`
+local last = redis.call('LINDEX', KEYS[1], -1)
+if last and cjson.decode(last).revision + 1 ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], ARGV[2])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[3]), -1)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+// editsSinceScript returns the logged edits after a revision, or nil when
+// the log no longer reaches back to it.
+var editsSinceScript = redis.NewScript(`
+local first = redis.call('LINDEX', KEYS[1], 0)
+if not first then
+	return {}
+end
+local start = tonumber(ARGV[1]) + 1 - cjson.decode(first).revision
+if start < 0 then
+	return false
+end
+return redis.call('LRANGE', KEYS[1], start, -1)
+`)
+
+type redisEnvelope struct {
+	Node string     `json:"node"`
+	Msg  BusMessage `json:"msg"`
+}
+
+type redisPresence struct {
+	Node string `json:"node"`
+	models.UserPresence
+}
+
+// RedisBus shares broadcasts over Redis pub/sub and keeps presence in a
+// hash per room. Each node refreshes a heartbeat key; connections of a node
+// whose heartbeat has expired are treated as gone, so a crashed node does
+// not leave users online forever.
+type RedisBus struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+	nodeID string
+	done   chan struct{}
+}
+
+func NewRedisBus(url string) (*RedisBus, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.TODO()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	b := &RedisBus{
+		client: client,
+		nodeID: uuid.New().String(),
+		done:   make(chan struct{}),
+	}
+	if err := b.heartbeat(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	go b.keepAlive()
+	return b, nil
+}
+
+func (b *RedisBus) Publish(msg BusMessage) error {
+	data, err := json.Marshal(redisEnvelope{Node: b.nodeID, Msg: msg})
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.TODO(), redisKeyPrefix+"room:"+msg.RoomID, data).Err()
+}
+
+func (b *RedisBus) Subscribe(deliver func(BusMessage)) {
+	b.pubsub = b.client.PSubscribe(context.TODO(), redisKeyPrefix+"room:*")
+	go func() {
+		for m := range b.pubsub.Channel() {
+			var env redisEnvelope
+			if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+				log.Printf("Error decoding bus message: %v", err)
+				continue
+			}
+			if env.Node == b.nodeID {
+				continue
+			}
+			deliver(env.Msg)
+		}
+	}()
+}
+
+func (b *RedisBus) Join(roomID, connID string, user models.UserPresence) (bool, error) {
+	data, _ := json.Marshal(redisPresence{Node: b.nodeID, UserPresence: user})
+	if err := b.client.HSet(context.TODO(), presenceKey(roomID), connID, data).Err(); err != nil {
+		return false, err
+	}
+	conns, err := b.connections(roomID)
+	if err != nil {
+		return false, err
+	}
+	return countConnections(conns, user.UserID) == 1, nil
+}
+
+func (b *RedisBus) Leave(roomID, connID string) (bool, error) {
+	data, err := b.client.HGet(context.TODO(), presenceKey(roomID), connID).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var entry redisPresence
+	json.Unmarshal([]byte(data), &entry)
+
+	if err := b.client.HDel(context.TODO(), presenceKey(roomID), connID).Err(); err != nil {
+		return false, err
+	}
+	conns, err := b.connections(roomID)
+	if err != nil {
+		return false, err
+	}
+	return countConnections(conns, entry.UserID) == 0, nil
+}
+
+func (b *RedisBus) Members(roomID string) ([]models.UserPresence, error) {
+	conns, err := b.connections(roomID)
+	if err != nil {
+		return nil, err
+	}
+	members := []models.UserPresence{}
+	for _, user := range conns {
+		members = append(members, user)
+	}
+	return members, nil
+}
+
+func (b *RedisBus) AppendEdit(roomID, fileID string, edit Edit) (bool, error) {
+	data, err := json.Marshal(edit)
+	if err != nil {
+		return false, err
+	}
+	logged, err := appendEditScript.Run(context.TODO(), b.client, []string{editLogKey(roomID, fileID)},
+		edit.Revision, data, maxOTHistory, redisEditLogTTL.Milliseconds()).Int()
+	return logged == 1, err
+}
+
+func (b *RedisBus) EditsSince(roomID, fileID string, revision int) ([]Edit, error) {
+	entries, err := editsSinceScript.Run(context.TODO(), b.client, []string{editLogKey(roomID, fileID)}, revision).StringSlice()
+	if err == redis.Nil {
+		return nil, ErrEditsGone
+	}
+	if err != nil {
+		return nil, err
+	}
+	edits := make([]Edit, 0, len(entries))
+	for _, data := range entries {
+		var edit Edit
+		if err := json.Unmarshal([]byte(data), &edit); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+func (b *RedisBus) Driver(roomID string) (*models.DriverState, error) {
+	return decodeDriver(b.client.Get(context.TODO(), driverKey(roomID)))
+}
+
+// UpdateDriver watches the room's driver state and runs update again
+// whenever another node changed it in the meantime.
+func (b *RedisBus) UpdateDriver(roomID string, update func(*models.DriverState) (*models.DriverState, error)) (*models.DriverState, error) {
+	ctx := context.TODO()
+	key := driverKey(roomID)
+	for attempt := 0; attempt < redisDriverRetries; attempt++ {
+		var next *models.DriverState
+		err := b.client.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := decodeDriver(tx.Get(ctx, key))
+			if err != nil {
+				return err
+			}
+			if next, err = update(current); err != nil || next == current {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if next == nil {
+					pipe.Del(ctx, key)
+					return nil
+				}
+				data, err := json.Marshal(next)
+				if err != nil {
+					return err
+				}
+				pipe.Set(ctx, key, data, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			if err != nil {
+				return nil, err
+			}
+			return next, nil
+		}
+	}
+	return nil, ErrDriverContention
+}
+
+func (b *RedisBus) Close() error {
+	close(b.done)
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	b.client.Del(context.TODO(), nodeKey(b.nodeID))
+	return b.client.Close()
+}
+
+// connections returns the live connections in a room keyed by connection
+// ID, pruning the ones left behind by dead nodes.
+func (b *RedisBus) connections(roomID string) (map[string]models.UserPresence, error) {
+	ctx := context.TODO()
+	entries, err := b.client.HGetAll(ctx, presenceKey(roomID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	alive := map[string]bool{b.nodeID: true}
+	conns := make(map[string]models.UserPresence, len(entries))
+	var stale []string
+	for connID, data := range entries {
+		var entry redisPresence
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			stale = append(stale, connID)
+			continue
+		}
+		live, checked := alive[entry.Node]
+		if !checked {
+			n, err := b.client.Exists(ctx, nodeKey(entry.Node)).Result()
+			if err != nil {
+				return nil, err
+			}
+			live = n > 0
+			alive[entry.Node] = live
+		}
+		if !live {
+			stale = append(stale, connID)
+			continue
+		}
+		conns[connID] = entry.UserPresence
+	}
+	if len(stale) > 0 {
+		b.client.HDel(ctx, presenceKey(roomID), stale...)
+	}
+	return conns, nil
+}
+
+func (b *RedisBus) heartbeat() error {
+	return b.client.Set(context.TODO(), nodeKey(b.nodeID), time.Now().Unix(), redisNodeTTL).Err()
+}
+
+func (b *RedisBus) keepAlive() {
+	ticker := time.NewTicker(redisNodeHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.heartbeat(); err != nil {
+				log.Printf("Error refreshing bus heartbeat: %v", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func presenceKey(roomID string) string {
+	return redisKeyPrefix + "presence:" + roomID
+}
+
+func editLogKey(roomID, fileID string) string {
+	return redisKeyPrefix + "edits:" + roomID + ":" + fileID
+}
+
+func driverKey(roomID string) string {
+	return redisKeyPrefix + "driver:" + roomID
+}
+
+func decodeDriver(cmd *redis.StringCmd) (*models.DriverState, error) {
+	data, err := cmd.Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state models.DriverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func nodeKey(nodeID string) string {
+	return redisKeyPrefix + "node:" + nodeID
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+const testRoom = "room-1"
+
+// newTestNodes starts two RoomManagers sharing a Redis stand-in, like two
+// backend nodes behind a load balancer.
+func newTestNodes(t *testing.T) (*RoomManager, *RoomManager) {
+	t.Helper()
+	server := miniredis.RunT(t)
+
+	var nodes [2]*RoomManager
+	for i := range nodes {
+		bus, err := NewRedisBus("redis://" + server.Addr())
+		if err != nil {
+			t.Fatalf("connecting to redis: %v", err)
+		}
+		t.Cleanup(func() { bus.Close() })
+		nodes[i] = NewRoomManager(bus)
+		go nodes[i].Run()
+	}
+	// Let both subscriptions reach the server before anything is published.
+	time.Sleep(50 * time.Millisecond)
+	return nodes[0], nodes[1]
+}
+
+func storedCode(code string, revision int) func() (*models.CodeSync, error) {
+	return func() (*models.CodeSync, error) {
+		return &models.CodeSync{RoomID: testRoom, FileID: models.MainFileID, Code: code, Revision: revision}, nil
+	}
+}
+
+func openDocument(t *testing.T, rm *RoomManager, load func() (*models.CodeSync, error)) *OTDocument {
+	t.Helper()
+	doc, err := rm.GetDocument(testRoom, models.MainFileID, load)
+	if err != nil {
+		t.Fatalf("loading document: %v", err)
+	}
+	return doc
+}
+
+// edit applies ops the way the WebSocket handler does, publishing the
+// result unless publish is false.
+func edit(t *testing.T, rm *RoomManager, doc *OTDocument, userID string, base int, ops []models.TextOp, publish bool) {
+	applied, snapshot, err := doc.Apply(userID, base, ops, "")
+	if err != nil {
+		t.Errorf("applying edit from %s at %d: %v", userID, base, err)
+		return
+	}
+	if !publish {
+		return
+	}
+	data, _ := json.Marshal(models.WSMessage{
+		Type: "code_change",
+		Payload: models.CodeChangePayload{
+			RoomID:   testRoom,
+			FileID:   models.MainFileID,
+			UserID:   userID,
+			Revision: snapshot.Revision,
+			Changes:  applied,
+		},
+	})
+	rm.BroadcastToRoom(testRoom, data, userID)
+}
+
+func insertAt(position int, text string) []models.TextOp {
+	return []models.TextOp{{Type: models.OpInsert, Position: position, Text: text}}
+}
+
+// waitConverged waits for both documents to reach revision with the same
+// content, returning that content.
+func waitConverged(t *testing.T, a, b *OTDocument, revision int) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		codeA, _, revA := a.Snapshot()
+		codeB, _, revB := b.Snapshot()
+		if revA == revision && revB == revision && codeA == codeB {
+			return codeA
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("documents did not converge: %q at %d and %q at %d, want revision %d", codeA, revA, codeB, revB, revision)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBusConcurrentEditsConverge(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+	docA := openDocument(t, nodeA, storedCode("base", 0))
+	docB := openDocument(t, nodeB, storedCode("base", 0))
+
+	const perNode = 50
+	var wg sync.WaitGroup
+	for _, n := range []struct {
+		rm   *RoomManager
+		doc  *OTDocument
+		user string
+		text string
+	}{
+		{nodeA, docA, "alice", "x"},
+		{nodeB, docB, "bob", "y"},
+	} {
+		wg.Add(1)
+		go func(rm *RoomManager, doc *OTDocument, user, text string) {
+			defer wg.Done()
+			for i := 0; i < perNode; i++ {
+				code, _, revision := doc.Snapshot()
+				edit(t, rm, doc, user, revision, insertAt(len(code)/2, text), true)
+			}
+		}(n.rm, n.doc, n.user, n.text)
+	}
+	wg.Wait()
+
+	code := waitConverged(t, docA, docB, 2*perNode)
+	for _, text := range []string{"x", "y"} {
+		if got := strings.Count(code, text); got != perNode {
+			t.Errorf("got %d inserts of %q, want %d in %q", got, text, perNode, code)
+		}
+	}
+}
+
+func TestRedisBusSameRevisionEdits(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+	docA := openDocument(t, nodeA, storedCode("hello", 3))
+	docB := openDocument(t, nodeB, storedCode("hello", 3))
+
+	// Both clients edit revision 3; whichever node logs second transforms
+	// its edit over the other's instead of also calling it revision 4.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		edit(t, nodeA, docA, "alice", 3, insertAt(0, ">> "), true)
+	}()
+	go func() {
+		defer wg.Done()
+		edit(t, nodeB, docB, "bob", 3, insertAt(5, "!"), true)
+	}()
+	wg.Wait()
+
+	if code := waitConverged(t, docA, docB, 5); code != ">> hello!" {
+		t.Errorf("got %q, want %q", code, ">> hello!")
+	}
+}
+
+func TestRedisBusCatchesUpFromLog(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+	docA := openDocument(t, nodeA, storedCode("", 0))
+
+	// Node B never hears of the first edit, and opens the document while
+	// storage still has revision 0.
+	edit(t, nodeA, docA, "alice", 0, insertAt(0, "one "), false)
+	docB := openDocument(t, nodeB, storedCode("", 0))
+	if code, _, revision := docB.Snapshot(); code != "one " || revision != 1 {
+		t.Fatalf("got %q at %d after loading, want %q at 1", code, revision, "one ")
+	}
+
+	edit(t, nodeA, docA, "alice", 1, insertAt(4, "two "), false)
+	edit(t, nodeA, docA, "alice", 2, insertAt(8, "three"), true)
+	if code := waitConverged(t, docA, docB, 3); code != "one two three" {
+		t.Errorf("got %q, want %q", code, "one two three")
+	}
+}
+
+func connect(rm *RoomManager, connID, userID string) *Client {
+	client := &Client{
+		ConnID:     connID,
+		UserID:     userID,
+		RoomID:     testRoom,
+		Reauth:     make(chan time.Time, 1),
+		Disconnect: make(chan string, 1),
+		Send:       make(chan []byte, 256),
+	}
+	client.SetRole(models.RoleEditor)
+	rm.RegisterClient(client)
+	return client
+}
+
+func connectDriving(rm *RoomManager, connID, userID string) *Client {
+	client := &Client{
+		ConnID:     connID,
+		UserID:     userID,
+		RoomID:     testRoom,
+		DriverMode: true,
+		Reauth:     make(chan time.Time, 1),
+		Disconnect: make(chan string, 1),
+		Send:       make(chan []byte, 256),
+	}
+	client.SetRole(models.RoleEditor)
+	rm.RegisterClient(client)
+	return client
+}
+
+// received reports whether message reaches client within a second,
+// skipping whatever else it is sent.
+func received(client *Client, message string) bool {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data := <-client.Send:
+			if string(data) == message {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestRedisBusParticipantsCountEveryNode(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+	connect(nodeA, "conn-1", "alice")
+	connect(nodeA, "conn-2", "alice")
+	connect(nodeB, "conn-3", "bob")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		countA, errA := nodeA.Participants(testRoom)
+		countB, errB := nodeB.Participants(testRoom)
+		if errA != nil || errB != nil {
+			t.Fatalf("counting participants: %v, %v", errA, errB)
+		}
+		if countA == 2 && countB == 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d and %d participants, want 2 on both nodes", countA, countB)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBusBroadcastFromConnReachesOtherTabs(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+	sender := connect(nodeA, "conn-1", "alice")
+	sameNode := connect(nodeA, "conn-2", "alice")
+	otherNode := connect(nodeB, "conn-3", "alice")
+	time.Sleep(50 * time.Millisecond)
+
+	const message = `{"type":"code_change"}`
+	nodeA.BroadcastFromConn(testRoom, []byte(message), sender.ConnID)
+	if !received(sameNode, message) {
+		t.Error("the sender's other tab on the same node did not get the message")
+	}
+	if !received(otherNode, message) {
+		t.Error("the sender's tab on another node did not get the message")
+	}
+	if received(sender, message) {
+		t.Error("the message was echoed to the connection that sent it")
+	}
+}
+
+// waitFor fails the test unless cond holds within five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBusDriverSharedAcrossNodes(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+	alice := connectDriving(nodeA, "conn-1", "alice")
+	waitFor(t, "alice to take control", func() bool {
+		return nodeA.RequestControl(alice) != ErrDriverModeOff
+	})
+
+	// Node B has nobody in the room yet but knows who drives.
+	if ok, err := nodeB.MayDrive(testRoom, "bob"); err != nil || ok {
+		t.Errorf("bob may drive over REST on another node: %v, %v", ok, err)
+	}
+	if ok, err := nodeB.MayDrive(testRoom, "alice"); err != nil || !ok {
+		t.Errorf("alice may not drive over REST on another node: %v, %v", ok, err)
+	}
+
+	// Bob joins on node B and only gets in the queue.
+	bob := connectDriving(nodeB, "conn-2", "bob")
+	if err := nodeB.RequestControl(bob); err != nil {
+		t.Fatalf("requesting control: %v", err)
+	}
+	waitFor(t, "node B to learn alice drives", func() bool {
+		state := nodeB.DriverState(testRoom)
+		return state != nil && state.DriverID == "alice" && slices.Equal(state.Requests, []string{"bob"})
+	})
+	if nodeB.CanDrive(bob) {
+		t.Error("bob can edit while alice drives")
+	}
+
+	if err := nodeA.GrantControl(alice, ""); err != nil {
+		t.Fatalf("granting control: %v", err)
+	}
+	waitFor(t, "bob to drive on node B", func() bool { return nodeB.CanDrive(bob) })
+	if nodeA.CanDrive(alice) {
+		t.Error("alice can still edit after handing over")
+	}
+}
@@ -2,63 +2,212 @@ package services
 
 import (
 	"encoding/json"
+	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	ConnID   string
-	UserID   string
-	Username string
-	RoomID   string
-	Conn     *websocket.Conn
-	Send     chan []byte
+	ConnID     string
+	UserID     string
+	RoomID     string
+	SyncMode   string
+	MaxEditors int
+	ExpiresAt  time.Time
+	Reauth     chan time.Time
+	Disconnect chan string
+	Conn       *websocket.Conn
+	Send       chan []byte
+	// DriverMode and RotateMinutes are the room's driver mode settings as
+	// of when the client connected.
+	DriverMode    bool
+	RotateMinutes int
+	// Scopes limits what a client that authenticated with an API token
+	// may do. It is nil for access tokens, which can do anything.
+	Scopes []string
+	// DeviceID names the replica the client edits CRDT documents from, as
+	// given in its crdt_sync. It stays the same across reconnects.
+	DeviceID string
+	// OnAdmit is called once the client is let into its room, right away
+	// or after waiting in the lobby.
+	OnAdmit  func()
+	role     atomic.Value
+	username atomic.Value
+	archived atomic.Bool
+	mute     atomic.Pointer[models.RoomMute]
+	waiting  atomic.Bool
+}
+
+// CRDTClientID is the client ID the connection authors CRDT updates as. It
+// is bound to the user and device, so a replica that edited offline can
+// send its updates over a new connection; until the client names a device
+// its connection stands in.
+func (c *Client) CRDTClientID() string {
+	device := c.DeviceID
+	if device == "" {
+		device = c.ConnID
+	}
+	return c.UserID + ":" + device
+}
+
+// Role is the client's role in its room. It can change while the client is
+// connected, so it is read on every message rather than cached.
+func (c *Client) Role() string {
+	role, _ := c.role.Load().(string)
+	return role
+}
+
+func (c *Client) SetRole(role string) {
+	c.role.Store(role)
+}
+
+// Username is the client's current username, which like the role can
+// change while it is connected.
+func (c *Client) Username() string {
+	username, _ := c.username.Load().(string)
+	return username
+}
+
+func (c *Client) SetUsername(username string) {
+	c.username.Store(username)
+}
+
+// Archived reports whether the client's room is archived, and so
+// read-only.
+func (c *Client) Archived() bool {
+	return c.archived.Load()
+}
+
+func (c *Client) SetArchived(archived bool) {
+	c.archived.Store(archived)
+}
+
+// Mute returns the client's mute if it is in force, or nil.
+func (c *Client) Mute() *models.RoomMute {
+	mute := c.mute.Load()
+	if !mute.Active(time.Now()) {
+		return nil
+	}
+	return mute
+}
+
+func (c *Client) SetMute(mute *models.RoomMute) {
+	c.mute.Store(mute)
+}
+
+// HasScope reports whether the client's token allows what scope covers.
+func (c *Client) HasScope(scope string) bool {
+	return c.Scopes == nil || slices.Contains(c.Scopes, scope)
+}
+
+// Waiting reports whether the client is in its room's lobby, waiting for
+// an editor seat.
+func (c *Client) Waiting() bool {
+	return c.waiting.Load()
 }
 
 type RoomManager struct {
-	rooms         map[string]map[string]*Client 
+	rooms         map[string]map[string]*Client
 	broadcast     chan BroadcastMessage
 	register      chan *Client
 	unregister    chan *Client
-	pendingLeaves map[string]*time.Timer 
+	pendingLeaves map[string]*pendingLeave
+	documents     map[string]map[string]*OTDocument
+	crdtDocuments map[string]map[string]*CRDTDocument
+	bus           Bus
+	presenceMu    sync.Mutex
+	presenceQueue []func()
+	presenceReady chan struct{}
+	activity      map[string]time.Time
+	lobby         map[string][]*Client
+	capacity      map[string]int
+	drivers       map[string]*driverState
+	members       map[string][]models.UserPresence
+	crdtClient    string
 	mu            sync.RWMutex
 }
 
+// activityInterval is how often at most a busy room's last activity is
+// written to storage.
+const activityInterval = time.Minute
+
+// BroadcastMessage is a message for the clients of a room. Exclude skips
+// every connection of a user and ExcludeConn a single connection. With
+// Close set each recipient is disconnected after it, with Close as the
+// reason.
 type BroadcastMessage struct {
-	RoomID  string
-	Message []byte
-	Exclude string 
+	RoomID      string
+	Message     []byte
+	Exclude     string
+	ExcludeConn string
+	Target      string
+	Close       string
 }
 
-func NewRoomManager() *RoomManager {
-	return &RoomManager{
+// admission is a client let in from the lobby, with the connection it
+// takes over from like on register.
+type admission struct {
+	client   *Client
+	replaced *Client
+}
+
+// pendingLeave holds back a user's departure briefly so a quick reconnect
+// does not show up as leaving and rejoining.
+type pendingLeave struct {
+	client *Client
+	timer  *time.Timer
+}
+
+func NewRoomManager(bus Bus) *RoomManager {
+	rm := &RoomManager{
 		rooms:         make(map[string]map[string]*Client),
 		broadcast:     make(chan BroadcastMessage, 256),
 		register:      make(chan *Client),
 		unregister:    make(chan *Client),
-		pendingLeaves: make(map[string]*time.Timer),
+		pendingLeaves: make(map[string]*pendingLeave),
+		documents:     make(map[string]map[string]*OTDocument),
+		crdtDocuments: make(map[string]map[string]*CRDTDocument),
+		bus:           bus,
+		presenceReady: make(chan struct{}, 1),
+		activity:      make(map[string]time.Time),
+		lobby:         make(map[string][]*Client),
+		capacity:      make(map[string]int),
+		drivers:       make(map[string]*driverState),
+		members:       make(map[string][]models.UserPresence),
+		crdtClient:    CRDTServerClient + ":" + uuid.New().String(),
 	}
+	bus.Subscribe(rm.deliverRemote)
+	go rm.runPresence()
+	return rm
+}
+
+// CRDTClient is the client ID this node authors its own CRDT updates, such
+// as restores, as. Every node has its own, so two nodes restoring at once
+// never mint the same ID.
+func (rm *RoomManager) CRDTClient() string {
+	return rm.crdtClient
 }
 
 func (rm *RoomManager) BroadcastUserList(roomID string) {
-	rm.mu.RLock()
-	clients := rm.rooms[roomID]
-	rm.mu.RUnlock()
+	members, err := rm.bus.Members(roomID)
+	if err != nil {
+		log.Printf("Error fetching room members: %v", err)
+		return
+	}
 
 	var userList []models.UserPresence
 	seenUsers := make(map[string]bool)
 
-	for _, client := range clients {
-		if !seenUsers[client.UserID] {
-			userList = append(userList, models.UserPresence{
-				UserID:   client.UserID,
-				Username: client.Username,
-				Status:   "online",
-			})
-			seenUsers[client.UserID] = true
+	for _, member := range members {
+		if !seenUsers[member.UserID] {
+			userList = append(userList, member)
+			seenUsers[member.UserID] = true
 		}
 	}
 
@@ -68,57 +217,71 @@ func (rm *RoomManager) BroadcastUserList(roomID string) {
 	}
 	data, _ := json.Marshal(msg)
 
+	rm.setMembers(roomID, userList)
 	rm.BroadcastToRoom(roomID, data, "")
 }
 
+// setMembers keeps the latest user list of a room, from this node or
+// another, for counting its editors on every node, and fills any editor
+// seat that frees up.
+func (rm *RoomManager) setMembers(roomID string, members []models.UserPresence) {
+	rm.mu.Lock()
+	if len(members) == 0 {
+		delete(rm.members, roomID)
+	} else {
+		rm.members[roomID] = members
+	}
+	rm.mu.Unlock()
+	rm.fillSeats(roomID)
+}
+
 func (rm *RoomManager) Run() {
 	for {
 		select {
 		case client := <-rm.register:
 			rm.mu.Lock()
-			if rm.rooms[client.RoomID] == nil {
-				rm.rooms[client.RoomID] = make(map[string]*Client)
-			}
-			isFirstConnection := true
-			for _, c := range rm.rooms[client.RoomID] {
-				if c.UserID == client.UserID {
-					isFirstConnection = false
-					break
-				}
+			if _, ok := rm.capacity[client.RoomID]; !ok {
+				rm.capacity[client.RoomID] = client.MaxEditors
+				rm.configureDriver(client.RoomID, client.DriverMode, client.RotateMinutes)
 			}
-
-			rm.rooms[client.RoomID][client.ConnID] = client
-
-			if timer, exists := rm.pendingLeaves[client.UserID]; exists {
-				timer.Stop()
-				delete(rm.pendingLeaves, client.UserID)
-				isFirstConnection = false
+			if !rm.hasSeat(client) {
+				client.waiting.Store(true)
+				rm.lobby[client.RoomID] = append(rm.lobby[client.RoomID], client)
+				rm.notifyLobby(client.RoomID)
+				rm.mu.Unlock()
+				continue
+			}
+			replaced := rm.enter(client)
+			if len(rm.lobby[client.RoomID]) > 0 {
+				rm.notifyLobby(client.RoomID)
 			}
-
 			rm.mu.Unlock()
 
-			if isFirstConnection {
-				joinMsg := models.WSMessage{
-					Type: "user_joined",
-					Payload: map[string]interface{}{
-						"userId":   client.UserID,
-						"username": client.Username,
-					},
-				}
-				joinData, _ := json.Marshal(joinMsg)
-				rm.BroadcastToRoom(client.RoomID, joinData, "")
+			rm.queuePresence(func() { rm.join(client, replaced) })
+			if client.OnAdmit != nil {
+				go client.OnAdmit()
 			}
 
-			go rm.BroadcastUserList(client.RoomID)
-
 		case client := <-rm.unregister:
 			rm.mu.Lock()
+			if client.Waiting() {
+				rm.leaveLobby(client)
+				rm.mu.Unlock()
+				continue
+			}
 			if clients, ok := rm.rooms[client.RoomID]; ok {
 				if _, ok := clients[client.ConnID]; ok {
 					delete(clients, client.ConnID)
 					close(client.Send)
 					if len(clients) == 0 {
 						delete(rm.rooms, client.RoomID)
+						delete(rm.documents, client.RoomID)
+						delete(rm.crdtDocuments, client.RoomID)
+						delete(rm.activity, client.RoomID)
+						if len(rm.lobby[client.RoomID]) == 0 {
+							delete(rm.capacity, client.RoomID)
+							rm.endDriver(client.RoomID)
+						}
 					}
 				}
 			}
@@ -134,40 +297,65 @@ func (rm *RoomManager) Run() {
 			}
 
 			if isLastConnection {
-				timer := time.AfterFunc(2*time.Second, func() {
-					rm.mu.Lock()
-					if _, exists := rm.pendingLeaves[client.UserID]; exists {
-						delete(rm.pendingLeaves, client.UserID)
-
-						leftMsg := models.WSMessage{
-							Type: "user_left",
-							Payload: map[string]interface{}{
-								"userId":   client.UserID,
-								"username": client.Username,
-							},
-						}
-						leftData, _ := json.Marshal(leftMsg)
-						rm.BroadcastToRoom(client.RoomID, leftData, "")
-						go rm.BroadcastUserList(client.RoomID)
+				key := leaveKey(client)
+				previous, exists := rm.pendingLeaves[key]
+				if exists {
+					previous.timer.Stop()
+				}
+				rm.pendingLeaves[key] = &pendingLeave{
+					client: client,
+					timer: time.AfterFunc(2*time.Second, func() {
+						rm.finishLeave(key, client)
+					}),
+				}
+				rm.mu.Unlock()
+
+				if exists {
+					rm.queuePresence(func() { rm.bus.Leave(previous.client.RoomID, previous.client.ConnID) })
+				}
+			} else {
+				rm.mu.Unlock()
+				rm.queuePresence(func() {
+					if _, err := rm.bus.Leave(client.RoomID, client.ConnID); err != nil {
+						log.Printf("Error removing presence: %v", err)
 					}
-					rm.mu.Unlock()
+					go rm.BroadcastUserList(client.RoomID)
 				})
-				rm.pendingLeaves[client.UserID] = timer
-			} else {
-				go rm.BroadcastUserList(client.RoomID)
 			}
-			rm.mu.Unlock()
 
 		case msg := <-rm.broadcast:
 			rm.mu.RLock()
 			if clients, ok := rm.rooms[msg.RoomID]; ok {
 				for connID, client := range clients {
+					if (msg.Target != "" && connID != msg.Target) || connID == msg.ExcludeConn {
+						continue
+					}
 					if client.UserID != msg.Exclude {
 						select {
 						case client.Send <- msg.Message:
 						default:
 							close(client.Send)
 							delete(clients, connID)
+							continue
+						}
+						if msg.Close != "" {
+							select {
+							case client.Disconnect <- msg.Close:
+							default:
+							}
+						}
+					}
+				}
+			}
+			// Waiting clients only get what is meant for them alone, and
+			// the closing of their room.
+			for _, client := range rm.lobby[msg.RoomID] {
+				if msg.Target == client.ConnID || (msg.Target == "" && msg.Close != "") {
+					trySend(client, msg.Message)
+					if msg.Close != "" {
+						select {
+						case client.Disconnect <- msg.Close:
+						default:
 						}
 					}
 				}
@@ -177,6 +365,391 @@ func (rm *RoomManager) Run() {
 	}
 }
 
+// enter adds a client to its room, returning the connection it takes over
+// from when the user reconnected within the leave grace period. Called
+// with rm.mu held.
+func (rm *RoomManager) enter(client *Client) *Client {
+	if rm.rooms[client.RoomID] == nil {
+		rm.rooms[client.RoomID] = make(map[string]*Client)
+	}
+	rm.rooms[client.RoomID][client.ConnID] = client
+
+	key := leaveKey(client)
+	pending, reconnected := rm.pendingLeaves[key]
+	if !reconnected {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(rm.pendingLeaves, key)
+	return pending.client
+}
+
+// hasSeat reports whether a client can be let into its room. The owner,
+// viewers and users who are already in always can; other editors only
+// while fewer editors than the room's maximum are connected, counting
+// those within the leave grace period. Editors on other nodes are counted
+// from the room's latest user list, so two nodes letting editors in at the
+// same moment can go over by the ones neither has heard of yet. Called with
+// rm.mu held.
+func (rm *RoomManager) hasSeat(client *Client) bool {
+	max := rm.capacity[client.RoomID]
+	if max <= 0 || client.Role() == models.RoleOwner || !models.CanEdit(client.Role()) {
+		return true
+	}
+
+	editors := make(map[string]bool)
+	for _, member := range rm.members[client.RoomID] {
+		if models.CanEdit(member.Role) {
+			editors[member.UserID] = true
+		}
+	}
+	for _, c := range rm.rooms[client.RoomID] {
+		if models.CanEdit(c.Role()) {
+			editors[c.UserID] = true
+		}
+	}
+	for _, pending := range rm.pendingLeaves {
+		c := pending.client
+		if c.RoomID == client.RoomID && models.CanEdit(c.Role()) {
+			editors[c.UserID] = true
+		}
+	}
+	return editors[client.UserID] || len(editors) < max
+}
+
+// leaveLobby drops a waiting client that disconnected. Called with rm.mu
+// held.
+func (rm *RoomManager) leaveLobby(client *Client) {
+	queue := slices.DeleteFunc(rm.lobby[client.RoomID], func(c *Client) bool { return c == client })
+	close(client.Send)
+	if len(queue) == 0 {
+		delete(rm.lobby, client.RoomID)
+		if rm.rooms[client.RoomID] == nil {
+			delete(rm.capacity, client.RoomID)
+			rm.endDriver(client.RoomID)
+		}
+	} else {
+		rm.lobby[client.RoomID] = queue
+	}
+	rm.notifyLobby(client.RoomID)
+}
+
+// admitWaiting lets the waiting clients of a room that admit accepts in,
+// keeping the others in the order they came. Called with rm.mu held.
+func (rm *RoomManager) admitWaiting(roomID string, admit func(*Client) bool) []admission {
+	var admitted []admission
+	var waiting []*Client
+	for _, client := range rm.lobby[roomID] {
+		if !admit(client) {
+			waiting = append(waiting, client)
+			continue
+		}
+		client.waiting.Store(false)
+		admitted = append(admitted, admission{client: client, replaced: rm.enter(client)})
+		data, _ := json.Marshal(models.WSMessage{
+			Type:    "admitted",
+			Payload: models.LobbyEntry{UserID: client.UserID, Username: client.Username()},
+		})
+		trySend(client, data)
+	}
+	if len(admitted) == 0 {
+		return nil
+	}
+	if len(waiting) == 0 {
+		delete(rm.lobby, roomID)
+	} else {
+		rm.lobby[roomID] = waiting
+	}
+	rm.notifyLobby(roomID)
+	return admitted
+}
+
+// fillSeats lets waiting clients into a room, first come first served,
+// while it has seats for them.
+func (rm *RoomManager) fillSeats(roomID string) {
+	rm.mu.Lock()
+	admitted := rm.admitWaiting(roomID, rm.hasSeat)
+	rm.mu.Unlock()
+	rm.welcome(admitted)
+}
+
+// welcome announces clients let in from the lobby and sends them the room.
+func (rm *RoomManager) welcome(admitted []admission) {
+	for _, a := range admitted {
+		client, replaced := a.client, a.replaced
+		rm.queuePresence(func() { rm.join(client, replaced) })
+		if client.OnAdmit != nil {
+			go client.OnAdmit()
+		}
+	}
+}
+
+// notifyLobby tells each waiting client of a room its place in the queue,
+// and the room's clients who is waiting. Called with rm.mu held.
+func (rm *RoomManager) notifyLobby(roomID string) {
+	entries := []models.LobbyEntry{}
+	seen := make(map[string]bool)
+	for i, client := range rm.lobby[roomID] {
+		data, _ := json.Marshal(models.WSMessage{
+			Type:    "lobby_position",
+			Payload: models.LobbyPositionPayload{Position: i + 1, MaxEditors: rm.capacity[roomID]},
+		})
+		trySend(client, data)
+		if !seen[client.UserID] {
+			seen[client.UserID] = true
+			entries = append(entries, models.LobbyEntry{UserID: client.UserID, Username: client.Username(), Position: i + 1})
+		}
+	}
+
+	data, _ := json.Marshal(models.WSMessage{Type: "lobby", Payload: entries})
+	for _, client := range rm.rooms[roomID] {
+		trySend(client, data)
+	}
+}
+
+// trySend queues a message for a client unless its buffer is full.
+func trySend(client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+	default:
+	}
+}
+
+// Admit lets a user waiting in a room's lobby in on every node, even when
+// the room is full.
+func (rm *RoomManager) Admit(roomID, userID string) {
+	rm.admitUser(roomID, userID)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "admitted",
+		Payload: models.LobbyEntry{UserID: userID},
+	})
+	rm.BroadcastToRoom(roomID, data, userID)
+}
+
+func (rm *RoomManager) admitUser(roomID, userID string) {
+	rm.mu.Lock()
+	admitted := rm.admitWaiting(roomID, func(c *Client) bool { return c.UserID == userID })
+	rm.mu.Unlock()
+	rm.welcome(admitted)
+}
+
+// eachClient calls fn for every connection to a room on this node, waiting
+// ones included. Called with rm.mu held.
+func (rm *RoomManager) eachClient(roomID string, fn func(*Client)) {
+	for _, client := range rm.rooms[roomID] {
+		fn(client)
+	}
+	for _, client := range rm.lobby[roomID] {
+		fn(client)
+	}
+}
+
+// queuePresence queues a presence change for runPresence. It never blocks,
+// since the changes broadcast through Run, which queues them.
+func (rm *RoomManager) queuePresence(fn func()) {
+	rm.presenceMu.Lock()
+	rm.presenceQueue = append(rm.presenceQueue, fn)
+	rm.presenceMu.Unlock()
+	select {
+	case rm.presenceReady <- struct{}{}:
+	default:
+	}
+}
+
+// runPresence applies presence changes in the order Run saw them, off the
+// Run goroutine since the bus may have to reach a remote server.
+func (rm *RoomManager) runPresence() {
+	for range rm.presenceReady {
+		for {
+			rm.presenceMu.Lock()
+			if len(rm.presenceQueue) == 0 {
+				rm.presenceMu.Unlock()
+				break
+			}
+			fn := rm.presenceQueue[0]
+			rm.presenceQueue[0] = nil
+			rm.presenceQueue = rm.presenceQueue[1:]
+			rm.presenceMu.Unlock()
+			fn()
+		}
+	}
+}
+
+// join announces a new connection. replaced is the connection it takes
+// over from when the user reconnected within the leave grace period.
+func (rm *RoomManager) join(client *Client, replaced *Client) {
+	isFirstConnection, err := rm.bus.Join(client.RoomID, client.ConnID, presenceOf(client))
+	if err != nil {
+		log.Printf("Error announcing presence: %v", err)
+	}
+	if replaced != nil {
+		rm.bus.Leave(replaced.RoomID, replaced.ConnID)
+		isFirstConnection = false
+	}
+
+	if isFirstConnection {
+		joinMsg := models.WSMessage{
+			Type: "user_joined",
+			Payload: map[string]interface{}{
+				"userId":   client.UserID,
+				"username": client.Username(),
+			},
+		}
+		joinData, _ := json.Marshal(joinMsg)
+		rm.BroadcastToRoom(client.RoomID, joinData, "")
+	}
+
+	go rm.BroadcastUserList(client.RoomID)
+}
+
+func (rm *RoomManager) finishLeave(key string, client *Client) {
+	rm.mu.Lock()
+	pending, exists := rm.pendingLeaves[key]
+	if !exists || pending.client != client {
+		rm.mu.Unlock()
+		return
+	}
+	delete(rm.pendingLeaves, key)
+	rm.mu.Unlock()
+	defer rm.fillSeats(client.RoomID)
+
+	rm.queuePresence(func() {
+		isLastConnection, err := rm.bus.Leave(client.RoomID, client.ConnID)
+		if err != nil {
+			log.Printf("Error removing presence: %v", err)
+		}
+		if isLastConnection {
+			leftMsg := models.WSMessage{
+				Type: "user_left",
+				Payload: map[string]interface{}{
+					"userId":   client.UserID,
+					"username": client.Username(),
+				},
+			}
+			leftData, _ := json.Marshal(leftMsg)
+			rm.BroadcastToRoom(client.RoomID, leftData, "")
+			rm.dropDriver(client.RoomID, client.UserID)
+		}
+		go rm.BroadcastUserList(client.RoomID)
+	})
+}
+
+func presenceOf(client *Client) models.UserPresence {
+	return models.UserPresence{
+		UserID:   client.UserID,
+		Username: client.Username(),
+		Role:     client.Role(),
+		Status:   "online",
+	}
+}
+
+func leaveKey(client *Client) string {
+	return client.RoomID + "/" + client.UserID
+}
+
+// deliverRemote hands a broadcast from another node to the local clients,
+// first replaying any edit or role change it carries onto this node's state.
+func (rm *RoomManager) deliverRemote(msg BusMessage) {
+	rm.applyRemoteState(msg)
+	rm.broadcast <- BroadcastMessage{
+		RoomID:      msg.RoomID,
+		Message:     msg.Message,
+		Exclude:     msg.Exclude,
+		ExcludeConn: msg.ExcludeConn,
+		Close:       msg.Close,
+	}
+}
+
+func (rm *RoomManager) applyRemoteState(msg BusMessage) {
+	var wsMsg struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(msg.Message, &wsMsg); err != nil {
+		return
+	}
+
+	switch wsMsg.Type {
+	case "code_change":
+		var payload models.CodeChangePayload
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.mu.RLock()
+		doc, ok := rm.documents[msg.RoomID][payload.FileID]
+		rm.mu.RUnlock()
+		if !ok {
+			return
+		}
+		edit := Edit{Revision: payload.Revision, UserID: payload.UserID, Ops: payload.Changes, Language: payload.Language}
+		if err := doc.ApplyRemote(edit); err != nil {
+			log.Printf("Error applying remote edit: %v", err)
+			// Unable to catch up with the log; reload from storage on the
+			// next local edit instead of guessing.
+			rm.mu.Lock()
+			if rm.documents[msg.RoomID][payload.FileID] == doc {
+				delete(rm.documents[msg.RoomID], payload.FileID)
+			}
+			rm.mu.Unlock()
+		}
+
+	case "crdt_update":
+		var payload models.CRDTUpdatePayload
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.mu.RLock()
+		doc, ok := rm.crdtDocuments[msg.RoomID][payload.FileID]
+		rm.mu.RUnlock()
+		if !ok {
+			return
+		}
+		doc.Apply(payload.Updates)
+
+	case "role_changed":
+		var payload models.RoomMember
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.setClientRoles(msg.RoomID, payload.UserID, payload.Role)
+
+	case "user_renamed":
+		var payload models.UserRenamedPayload
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.renameClients(msg.RoomID, payload.UserID, payload.Username)
+
+	case "member_removed", "member_kicked":
+		var payload models.MemberRemovedPayload
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.disconnectClients(msg.RoomID, payload.UserID, payload.Reason)
+
+	case "user_list":
+		var payload []models.UserPresence
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.setMembers(msg.RoomID, payload)
+
+	case "admitted":
+		var payload models.LobbyEntry
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.admitUser(msg.RoomID, payload.UserID)
+
+	case "driver_state":
+		var payload models.DriverState
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.applyDriver(msg.RoomID, payload)
+
+	case "mute_changed":
+		var payload models.MuteChangedPayload
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.setClientMutes(msg.RoomID, payload.UserID, payload.Mute)
+
+	case "room_updated":
+		var payload models.Room
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.applyRoomUpdate(&payload)
+
+	case "ownership_transferred":
+		var payload models.OwnershipTransferredPayload
+		json.Unmarshal(wsMsg.Payload, &payload)
+		rm.setClientRoles(msg.RoomID, payload.Owner.UserID, payload.Owner.Role)
+		rm.setClientRoles(msg.RoomID, payload.PreviousOwner.UserID, payload.PreviousOwner.Role)
+	}
+}
+
 func (rm *RoomManager) RegisterClient(client *Client) {
 	rm.register <- client
 }
@@ -191,6 +764,220 @@ func (rm *RoomManager) BroadcastToRoom(roomID string, message []byte, excludeUse
 		Message: message,
 		Exclude: excludeUserID,
 	}
+	if err := rm.bus.Publish(BusMessage{RoomID: roomID, Message: message, Exclude: excludeUserID}); err != nil {
+		log.Printf("Error publishing to bus: %v", err)
+	}
+}
+
+// BroadcastFromConn sends a message to everyone in a room but the
+// connection it came from, so the sender's other tabs get it too.
+func (rm *RoomManager) BroadcastFromConn(roomID string, message []byte, connID string) {
+	rm.broadcast <- BroadcastMessage{
+		RoomID:      roomID,
+		Message:     message,
+		ExcludeConn: connID,
+	}
+	if err := rm.bus.Publish(BusMessage{RoomID: roomID, Message: message, ExcludeConn: connID}); err != nil {
+		log.Printf("Error publishing to bus: %v", err)
+	}
+}
+
+func (rm *RoomManager) SendToClient(client *Client, message []byte) {
+	rm.broadcast <- BroadcastMessage{
+		RoomID:  client.RoomID,
+		Message: message,
+		Target:  client.ConnID,
+	}
+}
+
+// SetRole updates the role of a member's live connections on every node
+// and tells the room about it.
+func (rm *RoomManager) SetRole(roomID string, member models.RoomMember) {
+	rm.setClientRoles(roomID, member.UserID, member.Role)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "role_changed",
+		Payload: member,
+	})
+	rm.BroadcastToRoom(roomID, data, "")
+	if !models.CanEdit(member.Role) {
+		rm.dropDriver(roomID, member.UserID)
+	}
+}
+
+// setClientRoles updates this node's connections of a user and their
+// presence, then fills any editor seat the change freed or lets them in if
+// they no longer need one.
+func (rm *RoomManager) setClientRoles(roomID, userID, role string) {
+	var changed []*Client
+	rm.mu.RLock()
+	rm.eachClient(roomID, func(client *Client) {
+		if client.UserID == userID {
+			client.SetRole(role)
+			if !client.Waiting() {
+				changed = append(changed, client)
+			}
+		}
+	})
+	rm.mu.RUnlock()
+	rm.refreshPresence(roomID, changed)
+	rm.fillSeats(roomID)
+}
+
+// RenameUser gives a user's live connections in a room their new username
+// on every node, and tells the room about it.
+func (rm *RoomManager) RenameUser(roomID, userID, username string) {
+	rm.renameClients(roomID, userID, username)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "user_renamed",
+		Payload: models.UserRenamedPayload{UserID: userID, Username: username},
+	})
+	rm.BroadcastToRoom(roomID, data, "")
+}
+
+// renameClients updates this node's connections of a user and their
+// presence, then resends the user list.
+func (rm *RoomManager) renameClients(roomID, userID, username string) {
+	var renamed []*Client
+	rm.mu.RLock()
+	for _, client := range rm.rooms[roomID] {
+		if client.UserID == userID {
+			client.SetUsername(username)
+			renamed = append(renamed, client)
+		}
+	}
+	for _, client := range rm.lobby[roomID] {
+		if client.UserID == userID {
+			client.SetUsername(username)
+		}
+	}
+	rm.mu.RUnlock()
+	rm.refreshPresence(roomID, renamed)
+}
+
+// refreshPresence republishes the presence of connections whose username
+// or role changed, then resends the user list.
+func (rm *RoomManager) refreshPresence(roomID string, clients []*Client) {
+	if len(clients) == 0 {
+		return
+	}
+
+	rm.queuePresence(func() {
+		for _, client := range clients {
+			if _, err := rm.bus.Join(roomID, client.ConnID, presenceOf(client)); err != nil {
+				log.Printf("Error updating presence: %v", err)
+			}
+		}
+		go rm.BroadcastUserList(roomID)
+	})
+}
+
+// DisconnectUser closes a user's live connections to a room on every node,
+// giving reason as the close reason, and tells the room they were removed.
+func (rm *RoomManager) DisconnectUser(roomID, userID, reason string) {
+	rm.disconnectClients(roomID, userID, reason)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "member_removed",
+		Payload: models.MemberRemovedPayload{UserID: userID, Reason: reason},
+	})
+	rm.BroadcastToRoom(roomID, data, "")
+}
+
+func (rm *RoomManager) disconnectClients(roomID, userID, reason string) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	rm.eachClient(roomID, func(client *Client) {
+		if client.UserID == userID {
+			select {
+			case client.Disconnect <- reason:
+			default:
+			}
+		}
+	})
+}
+
+// KickUser closes a user's live connections to a room on every node and
+// tells the room, leaving their membership alone.
+func (rm *RoomManager) KickUser(roomID, userID, reason string) {
+	rm.disconnectClients(roomID, userID, reason)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "member_kicked",
+		Payload: models.MemberRemovedPayload{UserID: userID, Reason: reason},
+	})
+	rm.BroadcastToRoom(roomID, data, "")
+}
+
+// SetMute applies a member's mute, or lifts it when nil, to their live
+// connections on every node and tells the room about it.
+func (rm *RoomManager) SetMute(roomID, userID string, mute *models.RoomMute) {
+	rm.setClientMutes(roomID, userID, mute)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "mute_changed",
+		Payload: models.MuteChangedPayload{UserID: userID, Mute: mute},
+	})
+	rm.BroadcastToRoom(roomID, data, "")
+}
+
+func (rm *RoomManager) setClientMutes(roomID, userID string, mute *models.RoomMute) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	rm.eachClient(roomID, func(client *Client) {
+		if client.UserID == userID {
+			client.SetMute(mute)
+		}
+	})
+}
+
+// UpdateRoom tells a room's clients on every node that its details,
+// archived state or editor limit changed.
+func (rm *RoomManager) UpdateRoom(room *models.Room) {
+	rm.applyRoomUpdate(room)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "room_updated",
+		Payload: room,
+	})
+	rm.BroadcastToRoom(room.RoomID, data, "")
+}
+
+// applyRoomUpdate brings this node's connections to a room in line with
+// it. A raised editor limit lets waiting clients in; a lowered one only
+// applies to clients that connect later. Changes to driver mode are sent
+// to this node's clients as driver_state.
+func (rm *RoomManager) applyRoomUpdate(room *models.Room) {
+	rm.mu.Lock()
+	rm.eachClient(room.RoomID, func(client *Client) {
+		client.SetArchived(room.Archived)
+	})
+	if _, ok := rm.capacity[room.RoomID]; ok {
+		rm.capacity[room.RoomID] = room.MaxEditors
+		rm.configureDriver(room.RoomID, room.DriverMode, room.RotateMinutes)
+	}
+	rm.mu.Unlock()
+	rm.fillSeats(room.RoomID)
+}
+
+// TransferOwnership updates the roles of the old and new owner's live
+// connections on every node and tells the room about it.
+func (rm *RoomManager) TransferOwnership(roomID string, previousOwner, owner models.RoomMember) {
+	rm.setClientRoles(roomID, owner.UserID, owner.Role)
+	rm.setClientRoles(roomID, previousOwner.UserID, previousOwner.Role)
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "ownership_transferred",
+		Payload: models.OwnershipTransferredPayload{PreviousOwner: previousOwner, Owner: owner},
+	})
+	rm.BroadcastToRoom(roomID, data, "")
+}
+
+// CloseRoom tells every client of a deleted room about it and then closes
+// their connections, on every node.
+func (rm *RoomManager) CloseRoom(roomID string) {
+	data, _ := json.Marshal(models.WSMessage{
+		Type:    "room_deleted",
+		Payload: models.RoomDeletedPayload{RoomID: roomID},
+	})
+	rm.broadcast <- BroadcastMessage{RoomID: roomID, Message: data, Close: "room deleted"}
+	if err := rm.bus.Publish(BusMessage{RoomID: roomID, Message: data, Close: "room deleted"}); err != nil {
+		log.Printf("Error publishing to bus: %v", err)
+	}
 }
 
 func (rm *RoomManager) GetRoomClients(roomID string) []*Client {
@@ -205,3 +992,123 @@ func (rm *RoomManager) GetRoomClients(roomID string) []*Client {
 	}
 	return clients
 }
+
+// Participants counts the distinct users connected to a room across all
+// nodes.
+func (rm *RoomManager) Participants(roomID string) (int, error) {
+	members, err := rm.bus.Members(roomID)
+	if err != nil {
+		return 0, err
+	}
+	users := make(map[string]bool)
+	for _, member := range members {
+		users[member.UserID] = true
+	}
+	return len(users), nil
+}
+
+// MarkActive notes activity in a room and reports whether it is due to be
+// recorded, which is at most once per activityInterval.
+func (rm *RoomManager) MarkActive(roomID string) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rm.activity[roomID]) < activityInterval {
+		return false
+	}
+	rm.activity[roomID] = now
+	return true
+}
+
+// GetDocument returns the live OT document for a file, calling load to seed
+// it from storage the first time the file is edited.
+func (rm *RoomManager) GetDocument(roomID, fileID string, load func() (*models.CodeSync, error)) (*OTDocument, error) {
+	rm.mu.RLock()
+	doc, ok := rm.documents[roomID][fileID]
+	rm.mu.RUnlock()
+	if ok {
+		return doc, nil
+	}
+
+	codeSync, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	rm.mu.Lock()
+	if doc, ok := rm.documents[roomID][fileID]; ok {
+		rm.mu.Unlock()
+		return doc, nil
+	}
+	if rm.documents[roomID] == nil {
+		rm.documents[roomID] = make(map[string]*OTDocument)
+	}
+	doc = NewOTDocument(codeSync.Code, codeSync.Language, codeSync.Revision)
+	doc.log = busEditLog{bus: rm.bus, roomID: roomID, fileID: fileID}
+	rm.documents[roomID][fileID] = doc
+	rm.mu.Unlock()
+
+	// Storage lags behind the log by the edits other nodes are still
+	// saving.
+	if err := doc.CatchUp(); err != nil {
+		rm.mu.Lock()
+		if rm.documents[roomID][fileID] == doc {
+			delete(rm.documents[roomID], fileID)
+		}
+		rm.mu.Unlock()
+		return nil, err
+	}
+	return doc, nil
+}
+
+// busEditLog is a document's edit log, kept on the bus.
+type busEditLog struct {
+	bus    Bus
+	roomID string
+	fileID string
+}
+
+func (l busEditLog) Append(edit Edit) (bool, error) {
+	return l.bus.AppendEdit(l.roomID, l.fileID, edit)
+}
+
+func (l busEditLog) Since(revision int) ([]Edit, error) {
+	return l.bus.EditsSince(l.roomID, l.fileID, revision)
+}
+
+// GetCRDTDocument is the CRDT counterpart of GetDocument for rooms using
+// the crdt sync mode.
+func (rm *RoomManager) GetCRDTDocument(roomID, fileID string, load func() (*models.CodeSync, error)) (*CRDTDocument, error) {
+	rm.mu.RLock()
+	doc, ok := rm.crdtDocuments[roomID][fileID]
+	rm.mu.RUnlock()
+	if ok {
+		return doc, nil
+	}
+
+	codeSync, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if doc, ok := rm.crdtDocuments[roomID][fileID]; ok {
+		return doc, nil
+	}
+	if rm.crdtDocuments[roomID] == nil {
+		rm.crdtDocuments[roomID] = make(map[string]*CRDTDocument)
+	}
+	doc = NewCRDTDocument(codeSync.Updates)
+	rm.crdtDocuments[roomID][fileID] = doc
+	return doc, nil
+}
+
+// DropDocument forgets the live document of a deleted file.
+func (rm *RoomManager) DropDocument(roomID, fileID string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.documents[roomID], fileID)
+	delete(rm.crdtDocuments[roomID], fileID)
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+// lobbyClient connects a client to a room that seats maxEditors editors,
+// returning it along with a channel that is closed once it is let in.
+func lobbyClient(rm *RoomManager, connID, userID, role string, maxEditors int) (*Client, chan struct{}) {
+	admitted := make(chan struct{})
+	client := &Client{
+		ConnID:     connID,
+		UserID:     userID,
+		RoomID:     testRoom,
+		MaxEditors: maxEditors,
+		Reauth:     make(chan time.Time, 1),
+		Disconnect: make(chan string, 1),
+		Send:       make(chan []byte, 256),
+		OnAdmit:    func() { close(admitted) },
+	}
+	client.SetRole(role)
+	rm.RegisterClient(client)
+	return client, admitted
+}
+
+func wantAdmitted(t *testing.T, who string, admitted chan struct{}, within time.Duration) {
+	t.Helper()
+	select {
+	case <-admitted:
+	case <-time.After(within):
+		t.Fatalf("%s was not let in", who)
+	}
+}
+
+func wantWaiting(t *testing.T, who string, client *Client, admitted chan struct{}) {
+	t.Helper()
+	select {
+	case <-admitted:
+		t.Fatalf("%s was let into a full room", who)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !client.Waiting() {
+		t.Fatalf("%s is not waiting in the lobby", who)
+	}
+}
+
+func TestLobbySeatsEditors(t *testing.T) {
+	rm := NewRoomManager(NewLocalBus())
+	go rm.Run()
+
+	alice, aliceIn := lobbyClient(rm, "conn-1", "alice", models.RoleEditor, 1)
+	wantAdmitted(t, "the first editor", aliceIn, time.Second)
+	bob, bobIn := lobbyClient(rm, "conn-2", "bob", models.RoleEditor, 1)
+	wantWaiting(t, "a second editor", bob, bobIn)
+
+	// Viewers and editors already in never wait.
+	_, viewerIn := lobbyClient(rm, "conn-3", "dave", models.RoleViewer, 1)
+	wantAdmitted(t, "a viewer", viewerIn, time.Second)
+	alice2, alice2In := lobbyClient(rm, "conn-4", "alice", models.RoleEditor, 1)
+	wantAdmitted(t, "an editor's second tab", alice2In, time.Second)
+
+	// Alice's seat frees up once her leave grace period is over.
+	rm.UnregisterClient(alice)
+	rm.UnregisterClient(alice2)
+	wantWaiting(t, "an editor during the leave grace period", bob, bobIn)
+	wantAdmitted(t, "the waiting editor", bobIn, 5*time.Second)
+	if bob.Waiting() {
+		t.Error("bob is still marked waiting after being let in")
+	}
+}
+
+func TestLobbyAdmit(t *testing.T) {
+	rm := NewRoomManager(NewLocalBus())
+	go rm.Run()
+
+	_, aliceIn := lobbyClient(rm, "conn-1", "alice", models.RoleEditor, 1)
+	wantAdmitted(t, "the first editor", aliceIn, time.Second)
+	bob, bobIn := lobbyClient(rm, "conn-2", "bob", models.RoleEditor, 1)
+	wantWaiting(t, "a second editor", bob, bobIn)
+	erin, erinIn := lobbyClient(rm, "conn-3", "erin", models.RoleEditor, 1)
+	wantWaiting(t, "a third editor", erin, erinIn)
+
+	// The owner gets in however full the room is, and can let anyone else
+	// in without moving the others up.
+	_, ownerIn := lobbyClient(rm, "conn-4", "carol", models.RoleOwner, 1)
+	wantAdmitted(t, "the owner", ownerIn, time.Second)
+	rm.Admit(testRoom, "erin")
+	wantAdmitted(t, "an admitted editor", erinIn, time.Second)
+	wantWaiting(t, "an editor who was not admitted", bob, bobIn)
+}
+
+func TestLobbyCountsEditorsOnEveryNode(t *testing.T) {
+	nodeA, nodeB := newTestNodes(t)
+
+	alice, aliceIn := lobbyClient(nodeA, "conn-1", "alice", models.RoleEditor, 1)
+	wantAdmitted(t, "the first editor", aliceIn, time.Second)
+	waitFor(t, "node B to hear alice is in", func() bool {
+		nodeB.mu.RLock()
+		defer nodeB.mu.RUnlock()
+		return len(nodeB.members[testRoom]) == 1
+	})
+
+	// Bob is the first on node B but the room is full on node A.
+	bob, bobIn := lobbyClient(nodeB, "conn-2", "bob", models.RoleEditor, 1)
+	wantWaiting(t, "an editor on another node", bob, bobIn)
+
+	nodeA.UnregisterClient(alice)
+	wantAdmitted(t, "the waiting editor once alice left node A", bobIn, 5*time.Second)
+}
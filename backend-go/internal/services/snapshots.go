@@ -0,0 +1,50 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SnapshotScheduler decides when a room's code is due for an automatic
+// version. It only tracks timing; storing the version is up to the caller.
+type SnapshotScheduler struct {
+	interval time.Duration
+	last     map[string]time.Time
+	mu       sync.Mutex
+}
+
+func NewSnapshotScheduler(interval time.Duration) *SnapshotScheduler {
+	return &SnapshotScheduler{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// Due reports whether roomID has gone a full interval without a snapshot
+// and, if so, records now as its latest one. The first edit of a room only
+// starts the clock.
+func (s *SnapshotScheduler) Due(roomID string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, ok := s.last[roomID]
+	if ok && now.Sub(last) < s.interval {
+		return false
+	}
+	s.last[roomID] = now
+	return ok
+}
+
+// Taken resets the clock after an explicit checkpoint or restore.
+func (s *SnapshotScheduler) Taken(roomID string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[roomID] = now
+}
+
+func NewVersionID(now time.Time) string {
+	return fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.New().String()[:8])
+}
@@ -0,0 +1,1232 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketMeta         = []byte("meta")
+	bucketUsers        = []byte("users")
+	bucketUsersByEmail = []byte("users_by_email")
+	bucketIdentities   = []byte("user_identities")
+	bucketRooms        = []byte("rooms")
+	bucketMessages     = []byte("messages")
+	bucketCode         = []byte("code_sync")
+	bucketVersions     = []byte("code_versions")
+	bucketFiles        = []byte("workspace_files")
+	bucketInvites      = []byte("invites")
+	bucketSessions     = []byte("sessions")
+	bucketRevoked      = []byte("revoked_tokens")
+	bucketUserTokens   = []byte("user_tokens")
+	bucketAttempts     = []byte("login_attempts")
+	bucketAudit        = []byte("audit_log")
+	bucketAPITokens    = []byte("api_tokens")
+	bucketUserRooms    = []byte("user_rooms")
+
+	keySchemaVersion = []byte("schema_version")
+)
+
+// boltMigrations run in order inside a single transaction each. The index
+// of the last applied migration is kept in the meta bucket, so new entries
+// must only ever be appended.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketUsers, bucketUsersByEmail, bucketRooms, bucketMessages, bucketCode} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketVersions)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketFiles)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketInvites)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketSessions, bucketRevoked} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketIdentities)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketUserTokens)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketAttempts, bucketAudit} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketAPITokens)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketUserRooms); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketRooms).ForEach(func(k, v []byte) error {
+			var room models.Room
+			if err := gobDecode(v, &room); err != nil {
+				return err
+			}
+			for _, userID := range room.Users {
+				if err := indexRoomMember(tx, userID, room.RoomID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	},
+}
+
+// BoltStore is an embedded, single-file backend for self-hosting without
+// DynamoDB. Records are gob encoded so fields hidden from JSON, such as
+// password hashes, are still persisted.
+type BoltStore struct {
+	DB *bolt.DB
+}
+
+func NewBolt(path string) (*Store, error) {
+	database, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BoltStore{DB: database}
+	if err := b.migrate(); err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	log.Printf("Bolt storage opened at %s", path)
+	return &Store{Users: b, Rooms: b, Messages: b, Code: b, Files: b, Versions: b, Invites: b, Sessions: b, UserTokens: b, Attempts: b, Audit: b, APITokens: b}, nil
+}
+
+func (b *BoltStore) migrate() error {
+	if err := b.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketMeta)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for {
+		done := false
+		err := b.DB.Update(func(tx *bolt.Tx) error {
+			meta := tx.Bucket(bucketMeta)
+			version := 0
+			if v := meta.Get(keySchemaVersion); v != nil {
+				version = int(binary.BigEndian.Uint64(v))
+			}
+			if version >= len(boltMigrations) {
+				done = true
+				return nil
+			}
+
+			if err := boltMigrations[version](tx); err != nil {
+				return err
+			}
+			log.Printf("Applied bolt schema migration %d", version+1)
+			return meta.Put(keySchemaVersion, uint64Key(uint64(version+1)))
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (b *BoltStore) CreateUser(ctx context.Context, user *models.User) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		byEmail := tx.Bucket(bucketUsersByEmail)
+		if byEmail.Get([]byte(user.Email)) != nil {
+			return ErrConflict
+		}
+		if err := byEmail.Put([]byte(user.Email), []byte(user.UserID)); err != nil {
+			return err
+		}
+		return boltPut(tx.Bucket(bucketUsers), user.UserID, user)
+	})
+}
+
+func (b *BoltStore) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	var user models.User
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(bucketUsers), userID, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (b *BoltStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		userID := tx.Bucket(bucketUsersByEmail).Get([]byte(email))
+		if userID == nil {
+			return ErrNotFound
+		}
+		return boltGet(tx.Bucket(bucketUsers), string(userID), &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (b *BoltStore) UpdateLastSeen(ctx context.Context, userID string, lastSeen time.Time) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketUsers)
+		var user models.User
+		if err := boltGet(bucket, userID, &user); err != nil {
+			return err
+		}
+		user.LastSeen = lastSeen
+		return boltPut(bucket, userID, &user)
+	})
+}
+
+func (b *BoltStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	var user models.User
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		var identity models.UserIdentity
+		if err := boltGet(tx.Bucket(bucketIdentities), identityKey(issuer, subject), &identity); err != nil {
+			return err
+		}
+		return boltGet(tx.Bucket(bucketUsers), identity.UserID, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (b *BoltStore) LinkIdentity(ctx context.Context, identity *models.UserIdentity) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketIdentities)
+		key := identityKey(identity.Issuer, identity.Subject)
+		if bucket.Get([]byte(key)) != nil {
+			return ErrConflict
+		}
+		return boltPut(bucket, key, identity)
+	})
+}
+
+func (b *BoltStore) SetEmailVerified(ctx context.Context, userID string) error {
+	return b.updateUser(userID, func(user *models.User) error {
+		user.EmailVerified = true
+		return nil
+	})
+}
+
+func (b *BoltStore) UpdatePassword(ctx context.Context, userID, hashedPassword string) error {
+	return b.updateUser(userID, func(user *models.User) error {
+		user.HashedPassword = hashedPassword
+		return nil
+	})
+}
+
+func (b *BoltStore) SetTwoFactor(ctx context.Context, userID string, twoFactor *models.TwoFactor) error {
+	return b.updateUser(userID, func(user *models.User) error {
+		user.TwoFactor = twoFactor
+		return nil
+	})
+}
+
+func (b *BoltStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	return b.updateUser(userID, func(user *models.User) error {
+		if user.TwoFactor == nil || step <= user.TwoFactor.LastStep {
+			return ErrConflict
+		}
+		user.TwoFactor.LastStep = step
+		return nil
+	})
+}
+
+func (b *BoltStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	return b.updateUser(userID, func(user *models.User) error {
+		if user.TwoFactor == nil {
+			return ErrNotFound
+		}
+		i := slices.Index(user.TwoFactor.RecoveryCodes, codeHash)
+		if i < 0 {
+			return ErrNotFound
+		}
+		user.TwoFactor.RecoveryCodes = slices.Delete(user.TwoFactor.RecoveryCodes, i, i+1)
+		return nil
+	})
+}
+
+func (b *BoltStore) UpdateProfile(ctx context.Context, user *models.User) error {
+	return b.updateUser(user.UserID, func(stored *models.User) error {
+		stored.Username = user.Username
+		stored.DisplayName = user.DisplayName
+		stored.AvatarURL = user.AvatarURL
+		stored.Preferences = user.Preferences
+		return nil
+	})
+}
+
+func (b *BoltStore) DeleteUser(ctx context.Context, userID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var user models.User
+		if err := boltGet(users, userID, &user); err != nil {
+			return err
+		}
+
+		identities := tx.Bucket(bucketIdentities)
+		var linked [][]byte
+		identities.ForEach(func(k, v []byte) error {
+			var identity models.UserIdentity
+			if gobDecode(v, &identity) == nil && identity.UserID == userID {
+				linked = append(linked, k)
+			}
+			return nil
+		})
+		for _, k := range linked {
+			if err := identities.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Bucket(bucketUsersByEmail).Delete([]byte(user.Email)); err != nil {
+			return err
+		}
+		return users.Delete([]byte(userID))
+	})
+}
+
+func (b *BoltStore) updateUser(userID string, update func(*models.User) error) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketUsers)
+		var user models.User
+		if err := boltGet(bucket, userID, &user); err != nil {
+			return err
+		}
+		if err := update(&user); err != nil {
+			return err
+		}
+		return boltPut(bucket, userID, &user)
+	})
+}
+
+func (b *BoltStore) CreateRoom(ctx context.Context, room *models.Room) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		for _, userID := range room.Users {
+			if err := indexRoomMember(tx, userID, room.RoomID); err != nil {
+				return err
+			}
+		}
+		return boltPut(tx.Bucket(bucketRooms), room.RoomID, room)
+	})
+}
+
+func (b *BoltStore) GetRoom(ctx context.Context, roomID string) (*models.Room, error) {
+	var room models.Room
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(bucketRooms), roomID, &room)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// QueryRooms finds a member's rooms through the user_rooms index. Public
+// listings read every room, which is fine for a single-node database.
+func (b *BoltStore) QueryRooms(ctx context.Context, query RoomQuery) ([]models.Room, error) {
+	var rooms []models.Room
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRooms)
+		if query.MemberID == "" {
+			return bucket.ForEach(func(k, v []byte) error {
+				var room models.Room
+				if err := gobDecode(v, &room); err != nil {
+					return err
+				}
+				if listedPublicly(&room) {
+					rooms = append(rooms, room)
+				}
+				return nil
+			})
+		}
+
+		index := tx.Bucket(bucketUserRooms).Bucket([]byte(query.MemberID))
+		if index == nil {
+			return nil
+		}
+		return index.ForEach(func(k, v []byte) error {
+			var room models.Room
+			if err := boltGet(bucket, string(k), &room); err != nil {
+				return err
+			}
+			rooms = append(rooms, room)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageRooms(rooms, query), nil
+}
+
+func (b *BoltStore) TouchRoom(ctx context.Context, roomID string, at time.Time) error {
+	_, err := b.updateRoom(roomID, func(room *models.Room) {
+		room.LastActivity = at
+	})
+	return err
+}
+
+func (b *BoltStore) AddRoomUser(ctx context.Context, roomID, userID, role string) (*models.Room, error) {
+	var room *models.Room
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		room, err = updateRoomTx(tx, roomID, func(room *models.Room) {
+			room.Users = append(room.Users, userID)
+			room.Roles[userID] = role
+		})
+		if err != nil {
+			return err
+		}
+		return indexRoomMember(tx, userID, roomID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func (b *BoltStore) SetRoomRole(ctx context.Context, roomID, userID, role string) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.Roles[userID] = role
+	})
+}
+
+func (b *BoltStore) RemoveRoomUser(ctx context.Context, roomID, userID string) (*models.Room, error) {
+	var room *models.Room
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		room, err = updateRoomTx(tx, roomID, func(room *models.Room) {
+			room.Users = slices.DeleteFunc(room.Users, func(uid string) bool { return uid == userID })
+			delete(room.Roles, userID)
+		})
+		if err != nil {
+			return err
+		}
+		return unindexRoomMember(tx, userID, roomID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func (b *BoltStore) SetInviteOnly(ctx context.Context, roomID string, inviteOnly bool) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.InviteOnly = inviteOnly
+	})
+}
+
+func (b *BoltStore) SetMaxEditors(ctx context.Context, roomID string, maxEditors int) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.MaxEditors = maxEditors
+	})
+}
+
+func (b *BoltStore) SetDriverMode(ctx context.Context, roomID string, enabled bool, rotateMinutes int) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.DriverMode = enabled
+		room.RotateMinutes = rotateMinutes
+	})
+}
+
+func (b *BoltStore) SetVisibility(ctx context.Context, roomID, visibility, passwordHash string) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.Visibility = visibility
+		room.PasswordHash = passwordHash
+	})
+}
+
+func (b *BoltStore) SetRoomBan(ctx context.Context, roomID, userID string, ban *models.RoomBan) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		if ban == nil {
+			delete(room.Bans, userID)
+			return
+		}
+		if room.Bans == nil {
+			room.Bans = make(map[string]models.RoomBan)
+		}
+		room.Bans[userID] = *ban
+	})
+}
+
+func (b *BoltStore) SetRoomMute(ctx context.Context, roomID, userID string, mute *models.RoomMute) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		if mute == nil {
+			delete(room.Mutes, userID)
+			return
+		}
+		if room.Mutes == nil {
+			room.Mutes = make(map[string]models.RoomMute)
+		}
+		room.Mutes[userID] = *mute
+	})
+}
+
+func (b *BoltStore) UpdateRoomDetails(ctx context.Context, roomID, name, description string) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.Name = name
+		room.Description = description
+	})
+}
+
+func (b *BoltStore) SetArchived(ctx context.Context, roomID string, archived bool) (*models.Room, error) {
+	return b.updateRoom(roomID, func(room *models.Room) {
+		room.Archived = archived
+	})
+}
+
+func (b *BoltStore) DeleteRoom(ctx context.Context, roomID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket(bucketRooms)
+		var room models.Room
+		if err := boltGet(rooms, roomID, &room); err != nil {
+			return err
+		}
+		if err := rooms.Delete([]byte(roomID)); err != nil {
+			return err
+		}
+		for _, userID := range room.Users {
+			if err := unindexRoomMember(tx, userID, roomID); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range [][]byte{bucketMessages, bucketFiles, bucketVersions, bucketInvites} {
+			err := tx.Bucket(name).DeleteBucket([]byte(roomID))
+			if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+
+		code := tx.Bucket(bucketCode)
+		if err := code.Delete([]byte(roomID)); err != nil {
+			return err
+		}
+		prefix := []byte(roomID + "/")
+		var keys [][]byte
+		c := code.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := code.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) updateRoom(roomID string, update func(room *models.Room)) (*models.Room, error) {
+	var room *models.Room
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		room, err = updateRoomTx(tx, roomID, update)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func updateRoomTx(tx *bolt.Tx, roomID string, update func(room *models.Room)) (*models.Room, error) {
+	var room models.Room
+	bucket := tx.Bucket(bucketRooms)
+	if err := boltGet(bucket, roomID, &room); err != nil {
+		return nil, err
+	}
+	if room.Roles == nil {
+		room.Roles = make(map[string]string)
+	}
+	update(&room)
+	if err := boltPut(bucket, roomID, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// indexRoomMember records in the user_rooms bucket that userID is a member
+// of roomID; unindexRoomMember forgets it again.
+func indexRoomMember(tx *bolt.Tx, userID, roomID string) error {
+	bucket, err := tx.Bucket(bucketUserRooms).CreateBucketIfNotExists([]byte(userID))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(roomID), []byte{})
+}
+
+func unindexRoomMember(tx *bolt.Tx, userID, roomID string) error {
+	bucket := tx.Bucket(bucketUserRooms).Bucket([]byte(userID))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(roomID))
+}
+
+func (b *BoltStore) SaveMessage(ctx context.Context, message *models.Message) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketMessages).CreateBucketIfNotExists([]byte(message.RoomID))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, string(messageKey(message)), message)
+	})
+}
+
+func (b *BoltStore) ListMessages(ctx context.Context, roomID string, query MessageQuery) ([]models.Message, error) {
+	page := []models.Message{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketMessages).Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+
+		if !query.After.IsZero() {
+			start := uint64Key(uint64(query.After.UnixNano()) + 1)
+			for k, v := c.Seek(start); k != nil && len(page) < query.Limit; k, v = c.Next() {
+				var msg models.Message
+				if err := gobDecode(v, &msg); err != nil {
+					return err
+				}
+				page = append(page, msg)
+			}
+			return nil
+		}
+
+		var k, v []byte
+		if query.Before.IsZero() {
+			k, v = c.Last()
+		} else if k, v = c.Seek(uint64Key(uint64(query.Before.UnixNano()))); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && len(page) < query.Limit; k, v = c.Prev() {
+			var msg models.Message
+			if err := gobDecode(v, &msg); err != nil {
+				return err
+			}
+			page = append(page, msg)
+		}
+		reverseMessages(page)
+		return nil
+	})
+	return page, err
+}
+
+func (b *BoltStore) GetCode(ctx context.Context, roomID, fileID string) (*models.CodeSync, error) {
+	var codeSync models.CodeSync
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(bucketCode), codeKey(roomID, fileID), &codeSync)
+	})
+	if err != nil {
+		return nil, err
+	}
+	codeSync.FileID = fileID
+	return &codeSync, nil
+}
+
+func (b *BoltStore) PutCode(ctx context.Context, codeSync *models.CodeSync) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(bucketCode), codeKey(codeSync.RoomID, codeSync.FileID), codeSync)
+	})
+}
+
+func (b *BoltStore) UpdateCode(ctx context.Context, roomID, fileID, code, language string, revision int) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketCode)
+		key := codeKey(roomID, fileID)
+		var codeSync models.CodeSync
+		err := boltGet(bucket, key, &codeSync)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil && codeSync.Revision >= revision {
+			return nil
+		}
+		codeSync.RoomID = roomID
+		codeSync.FileID = fileID
+		codeSync.Code = code
+		codeSync.Language = language
+		codeSync.Revision = revision
+		codeSync.UpdatedAt = time.Now()
+		return boltPut(bucket, key, &codeSync)
+	})
+}
+
+func (b *BoltStore) AppendCRDTUpdates(ctx context.Context, roomID, fileID, code string, updates []models.CRDTUpdate) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketCode)
+		key := codeKey(roomID, fileID)
+		var codeSync models.CodeSync
+		if err := boltGet(bucket, key, &codeSync); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		codeSync.RoomID = roomID
+		codeSync.FileID = fileID
+		codeSync.Code = code
+		codeSync.Updates = append(codeSync.Updates, updates...)
+		codeSync.UpdatedAt = time.Now()
+		return boltPut(bucket, key, &codeSync)
+	})
+}
+
+func (b *BoltStore) PutFile(ctx context.Context, file *models.WorkspaceFile) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketFiles).CreateBucketIfNotExists([]byte(file.RoomID))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, file.FileID, file)
+	})
+}
+
+func (b *BoltStore) GetFile(ctx context.Context, roomID, fileID string) (*models.WorkspaceFile, error) {
+	var file models.WorkspaceFile
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketFiles).Bucket([]byte(roomID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		return boltGet(bucket, fileID, &file)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (b *BoltStore) ListFiles(ctx context.Context, roomID string) ([]models.WorkspaceFile, error) {
+	files := []models.WorkspaceFile{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketFiles).Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var file models.WorkspaceFile
+			if err := gobDecode(v, &file); err != nil {
+				return err
+			}
+			files = append(files, file)
+			return nil
+		})
+	})
+	return files, err
+}
+
+func (b *BoltStore) DeleteFile(ctx context.Context, roomID, fileID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(bucketFiles).Bucket([]byte(roomID)); bucket != nil {
+			if err := bucket.Delete([]byte(fileID)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketCode).Delete([]byte(codeKey(roomID, fileID)))
+	})
+}
+
+func (b *BoltStore) SaveVersion(ctx context.Context, version *models.CodeVersion) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketVersions).CreateBucketIfNotExists([]byte(version.RoomID))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, version.VersionID, version)
+	})
+}
+
+func (b *BoltStore) GetVersion(ctx context.Context, roomID, versionID string) (*models.CodeVersion, error) {
+	var version models.CodeVersion
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketVersions).Bucket([]byte(roomID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		return boltGet(bucket, versionID, &version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (b *BoltStore) ListVersions(ctx context.Context, roomID, before string, limit int) ([]models.CodeVersion, error) {
+	page := []models.CodeVersion{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketVersions).Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+
+		var k, v []byte
+		if before == "" {
+			k, v = c.Last()
+		} else if k, v = c.Seek([]byte(before)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && len(page) < limit; k, v = c.Prev() {
+			var version models.CodeVersion
+			if err := gobDecode(v, &version); err != nil {
+				return err
+			}
+			page = append(page, version)
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (b *BoltStore) CreateInvite(ctx context.Context, invite *models.Invite) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketInvites).CreateBucketIfNotExists([]byte(invite.RoomID))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, invite.InviteID, invite)
+	})
+}
+
+func (b *BoltStore) ListInvites(ctx context.Context, roomID string) ([]models.Invite, error) {
+	invites := []models.Invite{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketInvites).Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var invite models.Invite
+			if err := gobDecode(v, &invite); err != nil {
+				return err
+			}
+			invites = append(invites, invite)
+			return nil
+		})
+	})
+	return invites, err
+}
+
+func (b *BoltStore) UseInvite(ctx context.Context, roomID, inviteID string) (*models.Invite, error) {
+	var invite models.Invite
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketInvites).Bucket([]byte(roomID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		if err := boltGet(bucket, inviteID, &invite); err != nil {
+			return err
+		}
+		if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+			return ErrExhausted
+		}
+		invite.Uses++
+		return boltPut(bucket, inviteID, &invite)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (b *BoltStore) DeleteInvite(ctx context.Context, roomID, inviteID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketInvites).Bucket([]byte(roomID))
+		if bucket == nil || bucket.Get([]byte(inviteID)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(inviteID))
+	})
+}
+
+func (b *BoltStore) CreateSession(ctx context.Context, session *models.Session) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketSessions).CreateBucketIfNotExists([]byte(session.UserID))
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			var s models.Session
+			if err := gobDecode(v, &s); err != nil {
+				return err
+			}
+			if session.CreatedAt.After(s.ExpiresAt) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return boltPut(bucket, session.SessionID, session)
+	})
+}
+
+func (b *BoltStore) GetSession(ctx context.Context, userID, sessionID string) (*models.Session, error) {
+	var session models.Session
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketSessions).Bucket([]byte(userID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		return boltGet(bucket, sessionID, &session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (b *BoltStore) RotateSession(ctx context.Context, session *models.Session, oldHash string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketSessions).Bucket([]byte(session.UserID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		var current models.Session
+		if err := boltGet(bucket, session.SessionID, &current); err != nil {
+			return err
+		}
+		if current.TokenHash != oldHash {
+			return ErrConflict
+		}
+		return boltPut(bucket, session.SessionID, session)
+	})
+}
+
+func (b *BoltStore) SessionActive(ctx context.Context, userID, sessionID string) (bool, error) {
+	session, err := b.GetSession(ctx, userID, sessionID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Before(session.ExpiresAt), nil
+}
+
+func (b *BoltStore) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketSessions).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(sessionID))
+	})
+}
+
+func (b *BoltStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketSessions).DeleteBucket([]byte(userID))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// RevokeToken also drops revocations whose tokens have expired, keeping
+// the bucket down to the tokens that could still be presented.
+func (b *BoltStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRevoked)
+		now := uint64(time.Now().Unix())
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint64(v) < now {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(jti), uint64Key(uint64(expiresAt.Unix())))
+	})
+}
+
+func (b *BoltStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	revoked := false
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(bucketRevoked).Get([]byte(jti)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+// CreateUserToken also drops tokens that have expired unused.
+func (b *BoltStore) CreateUserToken(ctx context.Context, token *models.UserToken) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketUserTokens)
+		now := time.Now()
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			var t models.UserToken
+			if gobDecode(v, &t) == nil && now.After(t.ExpiresAt) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return boltPut(bucket, token.TokenHash, token)
+	})
+}
+
+func (b *BoltStore) ConsumeUserToken(ctx context.Context, tokenHash string) (*models.UserToken, error) {
+	var token models.UserToken
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketUserTokens)
+		if err := boltGet(bucket, tokenHash, &token); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(tokenHash))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (b *BoltStore) GetLoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error) {
+	var attempts models.LoginAttempts
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(bucketAttempts), key, &attempts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(attempts.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &attempts, nil
+}
+
+// RecordLoginFailure also drops counts that have expired.
+func (b *BoltStore) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*models.LoginAttempts, error) {
+	var attempts models.LoginAttempts
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAttempts)
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			var a models.LoginAttempts
+			if gobDecode(v, &a) == nil && now.After(a.ExpiresAt) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if err := boltGet(bucket, key, &attempts); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		attempts.Key = key
+		attempts.Failures++
+		attempts.LastFailure = now
+		attempts.ExpiresAt = now.Add(window)
+		return boltPut(bucket, key, &attempts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+func (b *BoltStore) ClearLoginAttempts(ctx context.Context, key string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttempts).Delete([]byte(key))
+	})
+}
+
+func (b *BoltStore) AddAuditEntry(ctx context.Context, entry *models.AuditEntry) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketAudit).CreateBucketIfNotExists([]byte(entry.Scope))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, entry.EntryID, entry)
+	})
+}
+
+func (b *BoltStore) ListAuditEntries(ctx context.Context, scope string, limit int) ([]models.AuditEntry, error) {
+	entries := []models.AuditEntry{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAudit).Bucket([]byte(scope))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < limit; k, v = c.Prev() {
+			var entry models.AuditEntry
+			if err := gobDecode(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (b *BoltStore) CreateAPIToken(ctx context.Context, token *models.APIToken) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketAPITokens).CreateBucketIfNotExists([]byte(token.UserID))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, token.TokenID, token)
+	})
+}
+
+func (b *BoltStore) GetAPIToken(ctx context.Context, userID, tokenID string) (*models.APIToken, error) {
+	var token models.APIToken
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAPITokens).Bucket([]byte(userID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		return boltGet(bucket, tokenID, &token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (b *BoltStore) ListAPITokens(ctx context.Context, userID string) ([]models.APIToken, error) {
+	tokens := []models.APIToken{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAPITokens).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var token models.APIToken
+			if err := gobDecode(v, &token); err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (b *BoltStore) TouchAPIToken(ctx context.Context, userID, tokenID string, usedAt time.Time) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAPITokens).Bucket([]byte(userID))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		var token models.APIToken
+		if err := boltGet(bucket, tokenID, &token); err != nil {
+			return err
+		}
+		token.LastUsedAt = &usedAt
+		return boltPut(bucket, tokenID, &token)
+	})
+}
+
+func (b *BoltStore) DeleteAPIToken(ctx context.Context, userID, tokenID string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAPITokens).Bucket([]byte(userID))
+		if bucket == nil || bucket.Get([]byte(tokenID)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(tokenID))
+	})
+}
+
+// messageKey sorts messages by timestamp within a room bucket, with the
+// message ID breaking ties between messages sent in the same nanosecond.
+func messageKey(message *models.Message) []byte {
+	return append(uint64Key(uint64(message.Timestamp.UnixNano())), message.MessageID...)
+}
+
+func uint64Key(v uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, v)
+	return key
+}
+
+func boltPut(bucket *bolt.Bucket, key string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), buf.Bytes())
+}
+
+func boltGet(bucket *bolt.Bucket, key string, v interface{}) error {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return gobDecode(data, v)
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,1614 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/db"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type DynamoStore struct {
+	DB *db.DynamoDB
+}
+
+// NewDynamo wraps database, whose tables must already exist. When the
+// UserRooms table has just been created, the rooms already stored are
+// indexed before NewDynamo returns.
+func NewDynamo(database *db.DynamoDB) (*Store, error) {
+	d := &DynamoStore{DB: database}
+	if database.Created(database.UserRoomsTable) {
+		if err := d.indexRooms(context.TODO()); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{Users: d, Rooms: d, Messages: d, Code: d, Files: d, Versions: d, Invites: d, Sessions: d, UserTokens: d, Attempts: d, Audit: d, APITokens: d}, nil
+}
+
+func (d *DynamoStore) CreateUser(ctx context.Context, user *models.User) error {
+	item, err := attributevalue.MarshalMap(user)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	var user models.User
+	if err := d.getItem(ctx, d.DB.UsersTable, "userId", userID, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (d *DynamoStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	result, err := d.DB.Client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.UsersTable),
+		IndexName:              aws.String("EmailIndex"),
+		KeyConditionExpression: aws.String("email = :email"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":email": &types.AttributeValueMemberS{Value: email},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Count == 0 {
+		return nil, ErrNotFound
+	}
+
+	var user models.User
+	if err := attributevalue.UnmarshalMap(result.Items[0], &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (d *DynamoStore) UpdateLastSeen(ctx context.Context, userID string, lastSeen time.Time) error {
+	_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression: aws.String("SET lastSeen = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: lastSeen.Format(time.RFC3339)},
+		},
+	})
+	return err
+}
+
+func (d *DynamoStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	var identity models.UserIdentity
+	if err := d.getItem(ctx, d.DB.IdentitiesTable, "identity", identityKey(issuer, subject), &identity); err != nil {
+		return nil, err
+	}
+	return d.GetUser(ctx, identity.UserID)
+}
+
+func (d *DynamoStore) LinkIdentity(ctx context.Context, identity *models.UserIdentity) error {
+	item, err := attributevalue.MarshalMap(identity)
+	if err != nil {
+		return err
+	}
+	item["identity"] = &types.AttributeValueMemberS{Value: identityKey(identity.Issuer, identity.Subject)}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.DB.IdentitiesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#identity)"),
+		ExpressionAttributeNames: map[string]string{
+			"#identity": "identity",
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (d *DynamoStore) SetEmailVerified(ctx context.Context, userID string) error {
+	return d.updateUser(ctx, userID, "SET emailVerified = :value", &types.AttributeValueMemberBOOL{Value: true})
+}
+
+func (d *DynamoStore) UpdatePassword(ctx context.Context, userID, hashedPassword string) error {
+	return d.updateUser(ctx, userID, "SET hashedPassword = :value", &types.AttributeValueMemberS{Value: hashedPassword})
+}
+
+func (d *DynamoStore) SetTwoFactor(ctx context.Context, userID string, twoFactor *models.TwoFactor) error {
+	if twoFactor == nil {
+		_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.DB.UsersTable),
+			Key: map[string]types.AttributeValue{
+				"userId": &types.AttributeValueMemberS{Value: userID},
+			},
+			UpdateExpression:    aws.String("REMOVE twoFactor"),
+			ConditionExpression: aws.String("attribute_exists(userId)"),
+		})
+		if isConditionFailed(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	value, err := attributevalue.Marshal(twoFactor)
+	if err != nil {
+		return err
+	}
+	return d.updateUser(ctx, userID, "SET twoFactor = :value", value)
+}
+
+func (d *DynamoStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String("SET twoFactor.lastStep = :step"),
+		ConditionExpression: aws.String("twoFactor.lastStep < :step"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":step": &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (d *DynamoStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String("DELETE twoFactor.recoveryCodes :codes"),
+		ConditionExpression: aws.String("contains(twoFactor.recoveryCodes, :code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":codes": &types.AttributeValueMemberSS{Value: []string{codeHash}},
+			":code":  &types.AttributeValueMemberS{Value: codeHash},
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d *DynamoStore) UpdateProfile(ctx context.Context, user *models.User) error {
+	preferences, err := attributevalue.Marshal(user.Preferences)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: user.UserID},
+		},
+		UpdateExpression:    aws.String("SET #username = :username, displayName = :displayName, avatarUrl = :avatarUrl, preferences = :preferences"),
+		ConditionExpression: aws.String("attribute_exists(userId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#username": "username",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":username":    &types.AttributeValueMemberS{Value: user.Username},
+			":displayName": &types.AttributeValueMemberS{Value: user.DisplayName},
+			":avatarUrl":   &types.AttributeValueMemberS{Value: user.AvatarURL},
+			":preferences": preferences,
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DeleteUser unlinks the user's identities before deleting the user, so a
+// failure part way leaves no identity pointing at a missing user. The
+// identities table has no index by user, so they are found with a scan.
+func (d *DynamoStore) DeleteUser(ctx context.Context, userID string) error {
+	paginator := dynamodb.NewScanPaginator(d.DB.Client, &dynamodb.ScanInput{
+		TableName:        aws.String(d.DB.IdentitiesTable),
+		FilterExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(d.DB.IdentitiesTable),
+				Key:       map[string]types.AttributeValue{"identity": item["identity"]},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		ConditionExpression: aws.String("attribute_exists(userId)"),
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d *DynamoStore) updateUser(ctx context.Context, userID, expression string, value types.AttributeValue) error {
+	_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.UsersTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String(expression),
+		ConditionExpression: aws.String("attribute_exists(userId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":value": value,
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// publicRoomsIndex lists the rooms whose listing attribute is set to
+// publicListing, newest activity last. The attribute is only present while
+// the room is listed publicly, and searchName holds the room's name in
+// lower case for search.
+const (
+	publicRoomsIndex = "PublicRoomsIndex"
+	publicListing    = "public"
+)
+
+func (d *DynamoStore) CreateRoom(ctx context.Context, room *models.Room) error {
+	item, err := attributevalue.MarshalMap(room)
+	if err != nil {
+		return err
+	}
+
+	item["lastActivity"] = &types.AttributeValueMemberS{Value: sortableTime(room.ActiveAt())}
+	item["searchName"] = &types.AttributeValueMemberS{Value: strings.ToLower(room.Name)}
+	if listedPublicly(room) {
+		item["listing"] = &types.AttributeValueMemberS{Value: publicListing}
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.RoomsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return err
+	}
+	for _, userID := range room.Users {
+		if err := d.indexRoomMember(ctx, userID, room.RoomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DynamoStore) GetRoom(ctx context.Context, roomID string) (*models.Room, error) {
+	var room models.Room
+	if err := d.getItem(ctx, d.DB.RoomsTable, "roomId", roomID, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// QueryRooms reads a member's rooms through the UserRooms table and public
+// rooms from publicRoomsIndex, so neither needs to scan the Rooms table.
+func (d *DynamoStore) QueryRooms(ctx context.Context, query RoomQuery) ([]models.Room, error) {
+	if query.MemberID != "" {
+		return d.queryMemberRooms(ctx, query)
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.RoomsTable),
+		IndexName:              aws.String(publicRoomsIndex),
+		KeyConditionExpression: aws.String("listing = :listing"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":listing": &types.AttributeValueMemberS{Value: publicListing},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if query.Search != "" {
+		input.FilterExpression = aws.String("contains(searchName, :search)")
+		input.ExpressionAttributeValues[":search"] = &types.AttributeValueMemberS{Value: strings.ToLower(query.Search)}
+	}
+	if query.AfterID != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"listing":      &types.AttributeValueMemberS{Value: publicListing},
+			"lastActivity": &types.AttributeValueMemberS{Value: sortableTime(query.AfterTime)},
+			"roomId":       &types.AttributeValueMemberS{Value: query.AfterID},
+		}
+	}
+
+	rooms := []models.Room{}
+	for {
+		// The limit counts rooms read before filtering, so asking for only
+		// as many as are missing never reads past the end of the page.
+		if query.Limit > 0 {
+			input.Limit = aws.Int32(int32(query.Limit - len(rooms)))
+		}
+		result, err := d.DB.Client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []models.Room
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, page...)
+		if result.LastEvaluatedKey == nil || (query.Limit > 0 && len(rooms) >= query.Limit) {
+			return rooms, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (d *DynamoStore) queryMemberRooms(ctx context.Context, query RoomQuery) ([]models.Room, error) {
+	paginator := dynamodb.NewQueryPaginator(d.DB.Client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.UserRoomsTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: query.MemberID},
+		},
+	})
+
+	var keys []map[string]types.AttributeValue
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			keys = append(keys, map[string]types.AttributeValue{"roomId": item["roomId"]})
+		}
+	}
+
+	rooms := []models.Room{}
+	for len(keys) > 0 {
+		// BatchGetItem takes at most 100 keys.
+		n := min(len(keys), 100)
+		request := map[string]types.KeysAndAttributes{
+			d.DB.RoomsTable: {Keys: keys[:n]},
+		}
+		keys = keys[n:]
+		for len(request) > 0 {
+			result, err := d.DB.Client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: request,
+			})
+			if err != nil {
+				return nil, err
+			}
+			var batch []models.Room
+			if err := attributevalue.UnmarshalListOfMaps(result.Responses[d.DB.RoomsTable], &batch); err != nil {
+				return nil, err
+			}
+			rooms = append(rooms, batch...)
+			request = result.UnprocessedKeys
+		}
+	}
+	return pageRooms(rooms, query), nil
+}
+
+func (d *DynamoStore) TouchRoom(ctx context.Context, roomID string, at time.Time) error {
+	_, err := d.updateRoom(ctx, roomID, "SET lastActivity = :at", nil, map[string]types.AttributeValue{
+		":at": &types.AttributeValueMemberS{Value: sortableTime(at)},
+	})
+	return err
+}
+
+func (d *DynamoStore) AddRoomUser(ctx context.Context, roomID, userID, role string) (*models.Room, error) {
+	_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.RoomsTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+		UpdateExpression:    aws.String("SET #users = list_append(if_not_exists(#users, :empty_list), :user)"),
+		ConditionExpression: aws.String("attribute_exists(roomId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#users": "users",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user":       &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberS{Value: userID}}},
+			":empty_list": &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if err := d.indexRoomMember(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+	return d.SetRoomRole(ctx, roomID, userID, role)
+}
+
+func (d *DynamoStore) SetRoomRole(ctx context.Context, roomID, userID, role string) (*models.Room, error) {
+	return d.setRoomMapEntry(ctx, roomID, "roles", userID, &types.AttributeValueMemberS{Value: role})
+}
+
+func (d *DynamoStore) SetRoomBan(ctx context.Context, roomID, userID string, ban *models.RoomBan) (*models.Room, error) {
+	if ban == nil {
+		return d.setRoomMapEntry(ctx, roomID, "bans", userID, nil)
+	}
+	value, err := attributevalue.Marshal(ban)
+	if err != nil {
+		return nil, err
+	}
+	return d.setRoomMapEntry(ctx, roomID, "bans", userID, value)
+}
+
+func (d *DynamoStore) SetRoomMute(ctx context.Context, roomID, userID string, mute *models.RoomMute) (*models.Room, error) {
+	if mute == nil {
+		return d.setRoomMapEntry(ctx, roomID, "mutes", userID, nil)
+	}
+	value, err := attributevalue.Marshal(mute)
+	if err != nil {
+		return nil, err
+	}
+	return d.setRoomMapEntry(ctx, roomID, "mutes", userID, value)
+}
+
+// setRoomMapEntry writes one entry of a map attribute of a room, such as
+// its roles, or removes it when value is nil. Rooms created before the map
+// existed have no attribute yet, and DynamoDB cannot set a key inside a
+// missing map, so the first entry written creates it.
+func (d *DynamoStore) setRoomMapEntry(ctx context.Context, roomID, attr, key string, value types.AttributeValue) (*models.Room, error) {
+	roomKey := map[string]types.AttributeValue{
+		"roomId": &types.AttributeValueMemberS{Value: roomID},
+	}
+	if value == nil {
+		result, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(d.DB.RoomsTable),
+			Key:                 roomKey,
+			UpdateExpression:    aws.String("REMOVE #map.#key"),
+			ConditionExpression: aws.String("attribute_exists(#map)"),
+			ExpressionAttributeNames: map[string]string{
+				"#map": attr,
+				"#key": key,
+			},
+			ReturnValues: types.ReturnValueAllNew,
+		})
+		if isConditionFailed(err) {
+			// No map means no entry to remove.
+			return d.GetRoom(ctx, roomID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var room models.Room
+		if err := attributevalue.UnmarshalMap(result.Attributes, &room); err != nil {
+			return nil, err
+		}
+		return &room, nil
+	}
+
+	result, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.DB.RoomsTable),
+		Key:                 roomKey,
+		UpdateExpression:    aws.String("SET #map.#key = :value"),
+		ConditionExpression: aws.String("attribute_exists(#map)"),
+		ExpressionAttributeNames: map[string]string{
+			"#map": attr,
+			"#key": key,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":value": value,
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		result, err = d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(d.DB.RoomsTable),
+			Key:                 roomKey,
+			UpdateExpression:    aws.String("SET #map = :map"),
+			ConditionExpression: aws.String("attribute_exists(roomId) AND attribute_not_exists(#map)"),
+			ExpressionAttributeNames: map[string]string{
+				"#map": attr,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":map": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+					key: value,
+				}},
+			},
+			ReturnValues: types.ReturnValueAllNew,
+		})
+		if isConditionFailed(err) {
+			if _, getErr := d.GetRoom(ctx, roomID); getErr != nil {
+				return nil, getErr
+			}
+			// Another writer created the map in the meantime.
+			return d.setRoomMapEntry(ctx, roomID, attr, key, value)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var room models.Room
+	if err := attributevalue.UnmarshalMap(result.Attributes, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// RemoveRoomUser drops a member. DynamoDB removes list elements by index
+// only, so the index is looked up first and the removal retried if the
+// list changed in the meantime.
+func (d *DynamoStore) RemoveRoomUser(ctx context.Context, roomID, userID string) (*models.Room, error) {
+	for {
+		room, err := d.GetRoom(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.Index(room.Users, userID)
+		if i < 0 {
+			return room, d.unindexRoomMember(ctx, userID, roomID)
+		}
+
+		update := fmt.Sprintf("REMOVE #users[%d]", i)
+		names := map[string]string{"#users": "users"}
+		if _, ok := room.Roles[userID]; ok {
+			update += ", #roles.#user"
+			names["#roles"] = "roles"
+			names["#user"] = userID
+		}
+		result, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.DB.RoomsTable),
+			Key: map[string]types.AttributeValue{
+				"roomId": &types.AttributeValueMemberS{Value: roomID},
+			},
+			UpdateExpression:         aws.String(update),
+			ConditionExpression:      aws.String(fmt.Sprintf("#users[%d] = :user", i)),
+			ExpressionAttributeNames: names,
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":user": &types.AttributeValueMemberS{Value: userID},
+			},
+			ReturnValues: types.ReturnValueAllNew,
+		})
+		if isConditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var updated models.Room
+		if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+			return nil, err
+		}
+		return &updated, d.unindexRoomMember(ctx, userID, roomID)
+	}
+}
+
+func (d *DynamoStore) SetInviteOnly(ctx context.Context, roomID string, inviteOnly bool) (*models.Room, error) {
+	room, err := d.updateRoom(ctx, roomID, "SET inviteOnly = :inviteOnly", nil, map[string]types.AttributeValue{
+		":inviteOnly": &types.AttributeValueMemberBOOL{Value: inviteOnly},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, d.indexRoom(ctx, room)
+}
+
+func (d *DynamoStore) SetMaxEditors(ctx context.Context, roomID string, maxEditors int) (*models.Room, error) {
+	if maxEditors == 0 {
+		return d.updateRoom(ctx, roomID, "REMOVE maxEditors", nil, nil)
+	}
+	return d.updateRoom(ctx, roomID, "SET maxEditors = :maxEditors", nil, map[string]types.AttributeValue{
+		":maxEditors": &types.AttributeValueMemberN{Value: strconv.Itoa(maxEditors)},
+	})
+}
+
+func (d *DynamoStore) SetDriverMode(ctx context.Context, roomID string, enabled bool, rotateMinutes int) (*models.Room, error) {
+	if !enabled {
+		return d.updateRoom(ctx, roomID, "REMOVE driverMode, rotateMinutes", nil, nil)
+	}
+	return d.updateRoom(ctx, roomID, "SET driverMode = :driverMode, rotateMinutes = :rotateMinutes", nil, map[string]types.AttributeValue{
+		":driverMode":    &types.AttributeValueMemberBOOL{Value: true},
+		":rotateMinutes": &types.AttributeValueMemberN{Value: strconv.Itoa(rotateMinutes)},
+	})
+}
+
+func (d *DynamoStore) SetVisibility(ctx context.Context, roomID, visibility, passwordHash string) (*models.Room, error) {
+	update := "SET visibility = :visibility REMOVE passwordHash"
+	values := map[string]types.AttributeValue{
+		":visibility": &types.AttributeValueMemberS{Value: visibility},
+	}
+	if passwordHash != "" {
+		update = "SET visibility = :visibility, passwordHash = :passwordHash"
+		values[":passwordHash"] = &types.AttributeValueMemberS{Value: passwordHash}
+	}
+	room, err := d.updateRoom(ctx, roomID, update, nil, values)
+	if err != nil {
+		return nil, err
+	}
+	return room, d.indexRoom(ctx, room)
+}
+
+func (d *DynamoStore) UpdateRoomDetails(ctx context.Context, roomID, name, description string) (*models.Room, error) {
+	return d.updateRoom(ctx, roomID, "SET #name = :name, description = :description, searchName = :searchName", map[string]string{"#name": "name"}, map[string]types.AttributeValue{
+		":name":        &types.AttributeValueMemberS{Value: name},
+		":description": &types.AttributeValueMemberS{Value: description},
+		":searchName":  &types.AttributeValueMemberS{Value: strings.ToLower(name)},
+	})
+}
+
+func (d *DynamoStore) SetArchived(ctx context.Context, roomID string, archived bool) (*models.Room, error) {
+	room, err := d.updateRoom(ctx, roomID, "SET archived = :archived", nil, map[string]types.AttributeValue{
+		":archived": &types.AttributeValueMemberBOOL{Value: archived},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, d.indexRoom(ctx, room)
+}
+
+// indexRoom brings the attributes behind publicRoomsIndex in line with
+// room. Rooms from before the index get lastActivity from their creation
+// time.
+func (d *DynamoStore) indexRoom(ctx context.Context, room *models.Room) error {
+	update := "SET searchName = :searchName, lastActivity = if_not_exists(lastActivity, :at)"
+	values := map[string]types.AttributeValue{
+		":searchName": &types.AttributeValueMemberS{Value: strings.ToLower(room.Name)},
+		":at":         &types.AttributeValueMemberS{Value: sortableTime(room.ActiveAt())},
+	}
+	if listedPublicly(room) {
+		update += ", listing = :listing"
+		values[":listing"] = &types.AttributeValueMemberS{Value: publicListing}
+	} else {
+		update += " REMOVE listing"
+	}
+	_, err := d.updateRoom(ctx, room.RoomID, update, nil, values)
+	return err
+}
+
+// indexRooms indexes every stored room, for deployments from before the
+// UserRooms table and publicRoomsIndex existed.
+func (d *DynamoStore) indexRooms(ctx context.Context) error {
+	log.Printf("Indexing existing rooms...")
+	waiter := dynamodb.NewTableExistsWaiter(d.DB.Client)
+	err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(d.DB.UserRoomsTable),
+	}, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	paginator := dynamodb.NewScanPaginator(d.DB.Client, &dynamodb.ScanInput{
+		TableName: aws.String(d.DB.RoomsTable),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		var rooms []models.Room
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &rooms); err != nil {
+			return err
+		}
+		for i := range rooms {
+			if err := d.indexRoom(ctx, &rooms[i]); err != nil {
+				return err
+			}
+			for _, userID := range rooms[i].Users {
+				if err := d.indexRoomMember(ctx, userID, rooms[i].RoomID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// indexRoomMember records in the UserRooms table that userID is a member
+// of roomID; unindexRoomMember forgets it again.
+func (d *DynamoStore) indexRoomMember(ctx context.Context, userID, roomID string) error {
+	_, err := d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.UserRoomsTable),
+		Item:      userRoomKey(userID, roomID),
+	})
+	return err
+}
+
+func (d *DynamoStore) unindexRoomMember(ctx context.Context, userID, roomID string) error {
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.UserRoomsTable),
+		Key:       userRoomKey(userID, roomID),
+	})
+	return err
+}
+
+func (d *DynamoStore) updateRoom(ctx context.Context, roomID, expression string, names map[string]string, values map[string]types.AttributeValue) (*models.Room, error) {
+	result, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.RoomsTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(roomId)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var room models.Room
+	if err := attributevalue.UnmarshalMap(result.Attributes, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// DeleteRoom deletes the room item first, so nobody can join or connect
+// while the rest is removed.
+func (d *DynamoStore) DeleteRoom(ctx context.Context, roomID string) error {
+	result, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.RoomsTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+		ConditionExpression: aws.String("attribute_exists(roomId)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var room models.Room
+	if err := attributevalue.UnmarshalMap(result.Attributes, &room); err != nil {
+		return err
+	}
+	for _, userID := range room.Users {
+		if err := d.unindexRoomMember(ctx, userID, roomID); err != nil {
+			return err
+		}
+	}
+
+	files, err := d.ListFiles(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := d.DeleteFile(ctx, roomID, file.FileID); err != nil {
+			return err
+		}
+	}
+	// Rooms from before workspaces have main file code but no file entry.
+	_, err = d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.CodeSyncTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: codeKey(roomID, models.MainFileID)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for table, sortKey := range map[string]string{
+		d.DB.MessagesTable: "timestamp",
+		d.DB.VersionsTable: "versionId",
+		d.DB.InvitesTable:  "inviteId",
+	} {
+		if err := d.deleteRoomItems(ctx, table, sortKey, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRoomItems deletes every item of a room from a table keyed by
+// roomId and sortKey.
+func (d *DynamoStore) deleteRoomItems(ctx context.Context, table, sortKey, roomID string) error {
+	paginator := dynamodb.NewQueryPaginator(d.DB.Client, &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		KeyConditionExpression:   aws.String("roomId = :roomId"),
+		ProjectionExpression:     aws.String("#sortKey"),
+		ExpressionAttributeNames: map[string]string{"#sortKey": sortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(table),
+				Key: map[string]types.AttributeValue{
+					"roomId": &types.AttributeValueMemberS{Value: roomID},
+					sortKey:  item[sortKey],
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DynamoStore) SaveMessage(ctx context.Context, message *models.Message) error {
+	item, err := attributevalue.MarshalMap(message)
+	if err != nil {
+		return err
+	}
+
+	item["timestamp"] = &types.AttributeValueMemberS{Value: sortableTime(message.Timestamp)}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.MessagesTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) ListMessages(ctx context.Context, roomID string, query MessageQuery) ([]models.Message, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.MessagesTable),
+		KeyConditionExpression: aws.String("roomId = :roomId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(query.Limit)),
+	}
+	switch {
+	case !query.After.IsZero():
+		input.KeyConditionExpression = aws.String("roomId = :roomId AND #ts > :cursor")
+		input.ExpressionAttributeValues[":cursor"] = &types.AttributeValueMemberS{Value: sortableTime(query.After)}
+		input.ScanIndexForward = aws.Bool(true)
+	case !query.Before.IsZero():
+		input.KeyConditionExpression = aws.String("roomId = :roomId AND #ts < :cursor")
+		input.ExpressionAttributeValues[":cursor"] = &types.AttributeValueMemberS{Value: sortableTime(query.Before)}
+	}
+	if !query.After.IsZero() || !query.Before.IsZero() {
+		input.ExpressionAttributeNames = map[string]string{"#ts": "timestamp"}
+	}
+
+	result, err := d.DB.Client.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &messages); err != nil {
+		return nil, err
+	}
+	if query.After.IsZero() {
+		reverseMessages(messages)
+	}
+	return messages, nil
+}
+
+func (d *DynamoStore) GetCode(ctx context.Context, roomID, fileID string) (*models.CodeSync, error) {
+	var codeSync models.CodeSync
+	if err := d.getItem(ctx, d.DB.CodeSyncTable, "roomId", codeKey(roomID, fileID), &codeSync); err != nil {
+		return nil, err
+	}
+	codeSync.RoomID = roomID
+	codeSync.FileID = fileID
+	return &codeSync, nil
+}
+
+func (d *DynamoStore) PutCode(ctx context.Context, codeSync *models.CodeSync) error {
+	item, err := attributevalue.MarshalMap(codeSync)
+	if err != nil {
+		return err
+	}
+	item["roomId"] = &types.AttributeValueMemberS{Value: codeKey(codeSync.RoomID, codeSync.FileID)}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.CodeSyncTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) UpdateCode(ctx context.Context, roomID, fileID, code, language string, revision int) error {
+	_, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.CodeSyncTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: codeKey(roomID, fileID)},
+		},
+		UpdateExpression:    aws.String("SET code = :code, fileId = :file, updatedAt = :now, #lang = :lang, revision = :rev"),
+		ConditionExpression: aws.String("attribute_not_exists(revision) OR revision < :rev"),
+		ExpressionAttributeNames: map[string]string{
+			"#lang": "language",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":code": &types.AttributeValueMemberS{Value: code},
+			":file": &types.AttributeValueMemberS{Value: fileID},
+			":now":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			":lang": &types.AttributeValueMemberS{Value: language},
+			":rev":  &types.AttributeValueMemberN{Value: strconv.Itoa(revision)},
+		},
+	})
+	if err != nil && !isConditionFailed(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DynamoStore) AppendCRDTUpdates(ctx context.Context, roomID, fileID, code string, updates []models.CRDTUpdate) error {
+	list, err := attributevalue.Marshal(updates)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.CodeSyncTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: codeKey(roomID, fileID)},
+		},
+		UpdateExpression: aws.String("SET code = :code, fileId = :file, updatedAt = :now, crdtUpdates = list_append(if_not_exists(crdtUpdates, :empty), :updates)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":code":    &types.AttributeValueMemberS{Value: code},
+			":file":    &types.AttributeValueMemberS{Value: fileID},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			":updates": list,
+			":empty":   &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		},
+	})
+	return err
+}
+
+func (d *DynamoStore) PutFile(ctx context.Context, file *models.WorkspaceFile) error {
+	item, err := attributevalue.MarshalMap(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.FilesTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) GetFile(ctx context.Context, roomID, fileID string) (*models.WorkspaceFile, error) {
+	result, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.DB.FilesTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: roomID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var file models.WorkspaceFile
+	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (d *DynamoStore) ListFiles(ctx context.Context, roomID string) ([]models.WorkspaceFile, error) {
+	result, err := d.DB.Client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.FilesTable),
+		KeyConditionExpression: aws.String("roomId = :roomId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := []models.WorkspaceFile{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (d *DynamoStore) DeleteFile(ctx context.Context, roomID, fileID string) error {
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.FilesTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: roomID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.CodeSyncTable),
+		Key: map[string]types.AttributeValue{
+			"roomId": &types.AttributeValueMemberS{Value: codeKey(roomID, fileID)},
+		},
+	})
+	return err
+}
+
+func (d *DynamoStore) SaveVersion(ctx context.Context, version *models.CodeVersion) error {
+	item, err := attributevalue.MarshalMap(version)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.VersionsTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) GetVersion(ctx context.Context, roomID, versionID string) (*models.CodeVersion, error) {
+	result, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.DB.VersionsTable),
+		Key: map[string]types.AttributeValue{
+			"roomId":    &types.AttributeValueMemberS{Value: roomID},
+			"versionId": &types.AttributeValueMemberS{Value: versionID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var version models.CodeVersion
+	if err := attributevalue.UnmarshalMap(result.Item, &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (d *DynamoStore) ListVersions(ctx context.Context, roomID, before string, limit int) ([]models.CodeVersion, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.VersionsTable),
+		KeyConditionExpression: aws.String("roomId = :roomId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	}
+	if before != "" {
+		input.KeyConditionExpression = aws.String("roomId = :roomId AND versionId < :before")
+		input.ExpressionAttributeValues[":before"] = &types.AttributeValueMemberS{Value: before}
+	}
+
+	result, err := d.DB.Client.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []models.CodeVersion{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (d *DynamoStore) getItem(ctx context.Context, table, keyName, key string, out interface{}) error {
+	result, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			keyName: &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if result.Item == nil {
+		return ErrNotFound
+	}
+	return attributevalue.UnmarshalMap(result.Item, out)
+}
+
+// sortableTime formats time range keys with a fixed number of
+// fractional digits in UTC, so DynamoDB's lexical ordering matches time
+// ordering. RFC3339Nano trims trailing zeros and would not sort correctly.
+func sortableTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z07:00")
+}
+
+func (d *DynamoStore) CreateInvite(ctx context.Context, invite *models.Invite) error {
+	item, err := attributevalue.MarshalMap(invite)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.InvitesTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) ListInvites(ctx context.Context, roomID string) ([]models.Invite, error) {
+	result, err := d.DB.Client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.InvitesTable),
+		KeyConditionExpression: aws.String("roomId = :roomId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":roomId": &types.AttributeValueMemberS{Value: roomID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invites := []models.Invite{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// UseInvite bumps the use count only while uses are left, so concurrent
+// redemptions cannot go past MaxUses.
+func (d *DynamoStore) UseInvite(ctx context.Context, roomID, inviteID string) (*models.Invite, error) {
+	key := map[string]types.AttributeValue{
+		"roomId":   &types.AttributeValueMemberS{Value: roomID},
+		"inviteId": &types.AttributeValueMemberS{Value: inviteID},
+	}
+	result, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.DB.InvitesTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET uses = uses + :one"),
+		ConditionExpression: aws.String("attribute_exists(inviteId) AND (maxUses = :zero OR uses < maxUses)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		existing, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(d.DB.InvitesTable),
+			Key:       key,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if existing.Item == nil {
+			return nil, ErrNotFound
+		}
+		return nil, ErrExhausted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var invite models.Invite
+	if err := attributevalue.UnmarshalMap(result.Attributes, &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (d *DynamoStore) DeleteInvite(ctx context.Context, roomID, inviteID string) error {
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.InvitesTable),
+		Key: map[string]types.AttributeValue{
+			"roomId":   &types.AttributeValueMemberS{Value: roomID},
+			"inviteId": &types.AttributeValueMemberS{Value: inviteID},
+		},
+		ConditionExpression: aws.String("attribute_exists(inviteId)"),
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d *DynamoStore) CreateSession(ctx context.Context, session *models.Session) error {
+	item, err := attributevalue.MarshalMap(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.SessionsTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) GetSession(ctx context.Context, userID, sessionID string) (*models.Session, error) {
+	result, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.DB.SessionsTable),
+		Key:       sessionKey(userID, sessionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var session models.Session
+	if err := attributevalue.UnmarshalMap(result.Item, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (d *DynamoStore) RotateSession(ctx context.Context, session *models.Session, oldHash string) error {
+	item, err := attributevalue.MarshalMap(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.DB.SessionsTable),
+		Item:                item,
+		ConditionExpression: aws.String("tokenHash = :oldHash"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":oldHash": &types.AttributeValueMemberS{Value: oldHash},
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (d *DynamoStore) SessionActive(ctx context.Context, userID, sessionID string) (bool, error) {
+	session, err := d.GetSession(ctx, userID, sessionID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Before(session.ExpiresAt), nil
+}
+
+func (d *DynamoStore) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.SessionsTable),
+		Key:       sessionKey(userID, sessionID),
+	})
+	return err
+}
+
+func (d *DynamoStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	paginator := dynamodb.NewQueryPaginator(d.DB.Client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.SessionsTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ProjectionExpression:   aws.String("sessionId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			sessionID, _ := item["sessionId"].(*types.AttributeValueMemberS)
+			if sessionID == nil {
+				continue
+			}
+			if err := d.DeleteSession(ctx, userID, sessionID.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RevokeToken stores expiresAt as epoch seconds so it can serve as the
+// table's TTL attribute.
+func (d *DynamoStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.RevokedTable),
+		Item: map[string]types.AttributeValue{
+			"jti":       &types.AttributeValueMemberS{Value: jti},
+			"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+	})
+	return err
+}
+
+func (d *DynamoStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	result, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.DB.RevokedTable),
+		Key: map[string]types.AttributeValue{
+			"jti": &types.AttributeValueMemberS{Value: jti},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.Item != nil, nil
+}
+
+func (d *DynamoStore) CreateUserToken(ctx context.Context, token *models.UserToken) error {
+	item, err := attributevalue.MarshalMap(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.UserTokensTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) ConsumeUserToken(ctx context.Context, tokenHash string) (*models.UserToken, error) {
+	result, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.UserTokensTable),
+		Key: map[string]types.AttributeValue{
+			"tokenHash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Attributes) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var token models.UserToken
+	if err := attributevalue.UnmarshalMap(result.Attributes, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (d *DynamoStore) GetLoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error) {
+	var attempts models.LoginAttempts
+	if err := d.getItem(ctx, d.DB.AttemptsTable, "attemptKey", key, &attempts); err != nil {
+		return nil, err
+	}
+	// TTL deletion lags, so expired items may still be around.
+	if time.Now().After(attempts.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &attempts, nil
+}
+
+func (d *DynamoStore) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*models.LoginAttempts, error) {
+	result, err := d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.DB.AttemptsTable),
+		Key: map[string]types.AttributeValue{
+			"attemptKey": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression:    aws.String("ADD failures :one SET lastFailure = :now, expiresAt = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(attemptKey) OR expiresAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(window).Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		// The previous count has expired, start over.
+		attempts := models.LoginAttempts{Key: key, Failures: 1, LastFailure: now, ExpiresAt: now.Add(window)}
+		item, err := attributevalue.MarshalMap(attempts)
+		if err != nil {
+			return nil, err
+		}
+		_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.DB.AttemptsTable),
+			Item:      item,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &attempts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts models.LoginAttempts
+	if err := attributevalue.UnmarshalMap(result.Attributes, &attempts); err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+func (d *DynamoStore) ClearLoginAttempts(ctx context.Context, key string) error {
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.DB.AttemptsTable),
+		Key: map[string]types.AttributeValue{
+			"attemptKey": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	return err
+}
+
+func (d *DynamoStore) AddAuditEntry(ctx context.Context, entry *models.AuditEntry) error {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.AuditTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) ListAuditEntries(ctx context.Context, scope string, limit int) ([]models.AuditEntry, error) {
+	result, err := d.DB.Client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.AuditTable),
+		KeyConditionExpression: aws.String("#scope = :scope"),
+		ExpressionAttributeNames: map[string]string{
+			"#scope": "scope",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":scope": &types.AttributeValueMemberS{Value: scope},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []models.AuditEntry{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (d *DynamoStore) CreateAPIToken(ctx context.Context, token *models.APIToken) error {
+	item, err := attributevalue.MarshalMap(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.DB.APITokensTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoStore) GetAPIToken(ctx context.Context, userID, tokenID string) (*models.APIToken, error) {
+	result, err := d.DB.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.DB.APITokensTable),
+		Key:       apiTokenKey(userID, tokenID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var token models.APIToken
+	if err := attributevalue.UnmarshalMap(result.Item, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (d *DynamoStore) ListAPITokens(ctx context.Context, userID string) ([]models.APIToken, error) {
+	result, err := d.DB.Client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.DB.APITokensTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []models.APIToken{}
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (d *DynamoStore) TouchAPIToken(ctx context.Context, userID, tokenID string, usedAt time.Time) error {
+	usedAtValue, err := attributevalue.Marshal(usedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.DB.APITokensTable),
+		Key:                 apiTokenKey(userID, tokenID),
+		UpdateExpression:    aws.String("SET lastUsedAt = :usedAt"),
+		ConditionExpression: aws.String("attribute_exists(tokenId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":usedAt": usedAtValue,
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d *DynamoStore) DeleteAPIToken(ctx context.Context, userID, tokenID string) error {
+	_, err := d.DB.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.DB.APITokensTable),
+		Key:                 apiTokenKey(userID, tokenID),
+		ConditionExpression: aws.String("attribute_exists(tokenId)"),
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func sessionKey(userID, sessionID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":    &types.AttributeValueMemberS{Value: userID},
+		"sessionId": &types.AttributeValueMemberS{Value: sessionID},
+	}
+}
+
+func userRoomKey(userID, roomID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId": &types.AttributeValueMemberS{Value: userID},
+		"roomId": &types.AttributeValueMemberS{Value: roomID},
+	}
+}
+
+func apiTokenKey(userID, tokenID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":  &types.AttributeValueMemberS{Value: userID},
+		"tokenId": &types.AttributeValueMemberS{Value: tokenID},
+	}
+}
+
+func isConditionFailed(err error) bool {
+	var conditionErr *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionErr)
+}
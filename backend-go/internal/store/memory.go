@@ -0,0 +1,973 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+// MemoryStore keeps everything in process memory. It is meant for local
+// development and tests; nothing survives a restart.
+type MemoryStore struct {
+	users     map[string]models.User
+	identity  map[string]models.UserIdentity
+	rooms     map[string]models.Room
+	messages  map[string][]models.Message
+	code      map[string]models.CodeSync
+	files     map[string]map[string]models.WorkspaceFile
+	versions  map[string][]models.CodeVersion
+	invites   map[string]map[string]models.Invite
+	sessions  map[string]map[string]models.Session
+	revoked   map[string]time.Time
+	tokens    map[string]models.UserToken
+	attempts  map[string]models.LoginAttempts
+	audit     map[string][]models.AuditEntry
+	apiTokens map[string]map[string]models.APIToken
+	mu        sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]models.User),
+		identity:  make(map[string]models.UserIdentity),
+		rooms:     make(map[string]models.Room),
+		messages:  make(map[string][]models.Message),
+		code:      make(map[string]models.CodeSync),
+		files:     make(map[string]map[string]models.WorkspaceFile),
+		versions:  make(map[string][]models.CodeVersion),
+		invites:   make(map[string]map[string]models.Invite),
+		sessions:  make(map[string]map[string]models.Session),
+		revoked:   make(map[string]time.Time),
+		tokens:    make(map[string]models.UserToken),
+		attempts:  make(map[string]models.LoginAttempts),
+		audit:     make(map[string][]models.AuditEntry),
+		apiTokens: make(map[string]map[string]models.APIToken),
+	}
+}
+
+func NewMemory() *Store {
+	m := NewMemoryStore()
+	return &Store{Users: m, Rooms: m, Messages: m, Code: m, Files: m, Versions: m, Invites: m, Sessions: m, UserTokens: m, Attempts: m, Audit: m, APITokens: m}
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, user *models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == user.Email {
+			return ErrConflict
+		}
+	}
+	m.users[user.UserID] = *user
+	return nil
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryStore) UpdateLastSeen(ctx context.Context, userID string, lastSeen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.LastSeen = lastSeen
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	identity, ok := m.identity[identityKey(issuer, subject)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user, ok := m.users[identity.UserID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (m *MemoryStore) LinkIdentity(ctx context.Context, identity *models.UserIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := identityKey(identity.Issuer, identity.Subject)
+	if _, ok := m.identity[key]; ok {
+		return ErrConflict
+	}
+	m.identity[key] = *identity
+	return nil
+}
+
+func (m *MemoryStore) SetEmailVerified(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.EmailVerified = true
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) UpdatePassword(ctx context.Context, userID, hashedPassword string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.HashedPassword = hashedPassword
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) SetTwoFactor(ctx context.Context, userID string, twoFactor *models.TwoFactor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.TwoFactor = nil
+	if twoFactor != nil {
+		stored := *twoFactor
+		stored.RecoveryCodes = slices.Clone(twoFactor.RecoveryCodes)
+		user.TwoFactor = &stored
+	}
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok || user.TwoFactor == nil || step <= user.TwoFactor.LastStep {
+		return ErrConflict
+	}
+	// Users handed out by GetUser share the old value, so replace it.
+	updated := *user.TwoFactor
+	updated.LastStep = step
+	user.TwoFactor = &updated
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok || user.TwoFactor == nil {
+		return ErrNotFound
+	}
+	i := slices.Index(user.TwoFactor.RecoveryCodes, codeHash)
+	if i < 0 {
+		return ErrNotFound
+	}
+	updated := *user.TwoFactor
+	updated.RecoveryCodes = slices.Delete(slices.Clone(updated.RecoveryCodes), i, i+1)
+	user.TwoFactor = &updated
+	m.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) UpdateProfile(ctx context.Context, user *models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[user.UserID]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Username = user.Username
+	stored.DisplayName = user.DisplayName
+	stored.AvatarURL = user.AvatarURL
+	stored.Preferences = user.Preferences
+	m.users[user.UserID] = stored
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, userID)
+	for key, identity := range m.identity {
+		if identity.UserID == userID {
+			delete(m.identity, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateRoom(ctx context.Context, room *models.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rooms[room.RoomID] = copyRoom(*room)
+	return nil
+}
+
+func (m *MemoryStore) GetRoom(ctx context.Context, roomID string) (*models.Room, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) QueryRooms(ctx context.Context, query RoomQuery) ([]models.Room, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var rooms []models.Room
+	for _, room := range m.rooms {
+		if query.MemberID != "" && !slices.Contains(room.Users, query.MemberID) {
+			continue
+		}
+		if query.MemberID == "" && !listedPublicly(&room) {
+			continue
+		}
+		rooms = append(rooms, copyRoom(room))
+	}
+	return pageRooms(rooms, query), nil
+}
+
+func (m *MemoryStore) TouchRoom(ctx context.Context, roomID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return ErrNotFound
+	}
+	room.LastActivity = at
+	m.rooms[roomID] = room
+	return nil
+}
+
+func (m *MemoryStore) AddRoomUser(ctx context.Context, roomID, userID, role string) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room = copyRoom(room)
+	room.Users = append(room.Users, userID)
+	room.Roles[userID] = role
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetRoomRole(ctx context.Context, roomID, userID, role string) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room = copyRoom(room)
+	room.Roles[userID] = role
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) RemoveRoomUser(ctx context.Context, roomID, userID string) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room = copyRoom(room)
+	room.Users = slices.DeleteFunc(room.Users, func(uid string) bool { return uid == userID })
+	delete(room.Roles, userID)
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetInviteOnly(ctx context.Context, roomID string, inviteOnly bool) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room.InviteOnly = inviteOnly
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetVisibility(ctx context.Context, roomID, visibility, passwordHash string) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room.Visibility = visibility
+	room.PasswordHash = passwordHash
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetMaxEditors(ctx context.Context, roomID string, maxEditors int) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room.MaxEditors = maxEditors
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetDriverMode(ctx context.Context, roomID string, enabled bool, rotateMinutes int) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room.DriverMode = enabled
+	room.RotateMinutes = rotateMinutes
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetRoomBan(ctx context.Context, roomID, userID string, ban *models.RoomBan) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room = copyRoom(room)
+	if ban == nil {
+		delete(room.Bans, userID)
+	} else {
+		room.Bans[userID] = *ban
+	}
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetRoomMute(ctx context.Context, roomID, userID string, mute *models.RoomMute) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room = copyRoom(room)
+	if mute == nil {
+		delete(room.Mutes, userID)
+	} else {
+		room.Mutes[userID] = *mute
+	}
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) UpdateRoomDetails(ctx context.Context, roomID, name, description string) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room.Name = name
+	room.Description = description
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) SetArchived(ctx context.Context, roomID string, archived bool) (*models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	room.Archived = archived
+	m.rooms[roomID] = room
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (m *MemoryStore) DeleteRoom(ctx context.Context, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rooms[roomID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.rooms, roomID)
+	delete(m.messages, roomID)
+	delete(m.files, roomID)
+	delete(m.versions, roomID)
+	delete(m.invites, roomID)
+	for key := range m.code {
+		if key == roomID || strings.HasPrefix(key, roomID+"/") {
+			delete(m.code, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveMessage(ctx context.Context, message *models.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages[message.RoomID] = append(m.messages[message.RoomID], *message)
+	return nil
+}
+
+func (m *MemoryStore) ListMessages(ctx context.Context, roomID string, query MessageQuery) ([]models.Message, error) {
+	m.mu.RLock()
+	messages := append([]models.Message(nil), m.messages[roomID]...)
+	m.mu.RUnlock()
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+
+	page := []models.Message{}
+	if !query.After.IsZero() {
+		for _, msg := range messages {
+			if msg.Timestamp.After(query.After) && len(page) < query.Limit {
+				page = append(page, msg)
+			}
+		}
+		return page, nil
+	}
+
+	for i := len(messages) - 1; i >= 0 && len(page) < query.Limit; i-- {
+		if query.Before.IsZero() || messages[i].Timestamp.Before(query.Before) {
+			page = append(page, messages[i])
+		}
+	}
+	reverseMessages(page)
+	return page, nil
+}
+
+func reverseMessages(messages []models.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+func (m *MemoryStore) GetCode(ctx context.Context, roomID, fileID string) (*models.CodeSync, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	codeSync, ok := m.code[codeKey(roomID, fileID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	codeSync.FileID = fileID
+	codeSync.Updates = append([]models.CRDTUpdate(nil), codeSync.Updates...)
+	return &codeSync, nil
+}
+
+func (m *MemoryStore) PutCode(ctx context.Context, codeSync *models.CodeSync) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *codeSync
+	stored.Updates = append([]models.CRDTUpdate(nil), codeSync.Updates...)
+	m.code[codeKey(codeSync.RoomID, codeSync.FileID)] = stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateCode(ctx context.Context, roomID, fileID, code, language string, revision int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := codeKey(roomID, fileID)
+	codeSync, ok := m.code[key]
+	if ok && codeSync.Revision >= revision {
+		return nil
+	}
+	codeSync.RoomID = roomID
+	codeSync.FileID = fileID
+	codeSync.Code = code
+	codeSync.Language = language
+	codeSync.Revision = revision
+	codeSync.UpdatedAt = time.Now()
+	m.code[key] = codeSync
+	return nil
+}
+
+func (m *MemoryStore) AppendCRDTUpdates(ctx context.Context, roomID, fileID, code string, updates []models.CRDTUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := codeKey(roomID, fileID)
+	codeSync := m.code[key]
+	codeSync.RoomID = roomID
+	codeSync.FileID = fileID
+	codeSync.Code = code
+	codeSync.Updates = append(append([]models.CRDTUpdate(nil), codeSync.Updates...), updates...)
+	codeSync.UpdatedAt = time.Now()
+	m.code[key] = codeSync
+	return nil
+}
+
+func (m *MemoryStore) PutFile(ctx context.Context, file *models.WorkspaceFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files[file.RoomID] == nil {
+		m.files[file.RoomID] = make(map[string]models.WorkspaceFile)
+	}
+	m.files[file.RoomID][file.FileID] = *file
+	return nil
+}
+
+func (m *MemoryStore) GetFile(ctx context.Context, roomID, fileID string) (*models.WorkspaceFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.files[roomID][fileID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &file, nil
+}
+
+func (m *MemoryStore) ListFiles(ctx context.Context, roomID string) ([]models.WorkspaceFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := []models.WorkspaceFile{}
+	for _, file := range m.files[roomID] {
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (m *MemoryStore) DeleteFile(ctx context.Context, roomID, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files[roomID], fileID)
+	delete(m.code, codeKey(roomID, fileID))
+	return nil
+}
+
+func (m *MemoryStore) SaveVersion(ctx context.Context, version *models.CodeVersion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	versions := append(m.versions[version.RoomID], *version)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].VersionID < versions[j].VersionID
+	})
+	m.versions[version.RoomID] = versions
+	return nil
+}
+
+func (m *MemoryStore) GetVersion(ctx context.Context, roomID, versionID string) (*models.CodeVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, version := range m.versions[roomID] {
+		if version.VersionID == versionID {
+			return &version, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryStore) ListVersions(ctx context.Context, roomID, before string, limit int) ([]models.CodeVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	page := []models.CodeVersion{}
+	versions := m.versions[roomID]
+	for i := len(versions) - 1; i >= 0 && len(page) < limit; i-- {
+		if before == "" || versions[i].VersionID < before {
+			page = append(page, versions[i])
+		}
+	}
+	return page, nil
+}
+
+func (m *MemoryStore) CreateInvite(ctx context.Context, invite *models.Invite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.invites[invite.RoomID] == nil {
+		m.invites[invite.RoomID] = make(map[string]models.Invite)
+	}
+	m.invites[invite.RoomID][invite.InviteID] = *invite
+	return nil
+}
+
+func (m *MemoryStore) ListInvites(ctx context.Context, roomID string) ([]models.Invite, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	invites := make([]models.Invite, 0, len(m.invites[roomID]))
+	for _, invite := range m.invites[roomID] {
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+func (m *MemoryStore) UseInvite(ctx context.Context, roomID, inviteID string) (*models.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invite, ok := m.invites[roomID][inviteID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return nil, ErrExhausted
+	}
+	invite.Uses++
+	m.invites[roomID][inviteID] = invite
+	return &invite, nil
+}
+
+func (m *MemoryStore) DeleteInvite(ctx context.Context, roomID, inviteID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.invites[roomID][inviteID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.invites[roomID], inviteID)
+	return nil
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, session *models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := m.sessions[session.UserID]
+	if sessions == nil {
+		sessions = make(map[string]models.Session)
+		m.sessions[session.UserID] = sessions
+	}
+	for id, s := range sessions {
+		if session.CreatedAt.After(s.ExpiresAt) {
+			delete(sessions, id)
+		}
+	}
+	sessions[session.SessionID] = *session
+	return nil
+}
+
+func (m *MemoryStore) GetSession(ctx context.Context, userID, sessionID string) (*models.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[userID][sessionID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+func (m *MemoryStore) RotateSession(ctx context.Context, session *models.Session, oldHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.sessions[session.UserID][session.SessionID]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.TokenHash != oldHash {
+		return ErrConflict
+	}
+	m.sessions[session.UserID][session.SessionID] = *session
+	return nil
+}
+
+func (m *MemoryStore) SessionActive(ctx context.Context, userID, sessionID string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[userID][sessionID]
+	return ok && time.Now().Before(session.ExpiresAt), nil
+}
+
+func (m *MemoryStore) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions[userID], sessionID)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, userID)
+	return nil
+}
+
+func (m *MemoryStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range m.revoked {
+		if now.After(exp) {
+			delete(m.revoked, id)
+		}
+	}
+	m.revoked[jti] = expiresAt
+	return nil
+}
+
+func (m *MemoryStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.revoked[jti]
+	return ok, nil
+}
+
+func (m *MemoryStore) CreateUserToken(ctx context.Context, token *models.UserToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for hash, t := range m.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(m.tokens, hash)
+		}
+	}
+	m.tokens[token.TokenHash] = *token
+	return nil
+}
+
+func (m *MemoryStore) ConsumeUserToken(ctx context.Context, tokenHash string) (*models.UserToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(m.tokens, tokenHash)
+	return &token, nil
+}
+
+func (m *MemoryStore) GetLoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	attempts, ok := m.attempts[key]
+	if !ok || time.Now().After(attempts.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &attempts, nil
+}
+
+func (m *MemoryStore) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*models.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, a := range m.attempts {
+		if now.After(a.ExpiresAt) {
+			delete(m.attempts, k)
+		}
+	}
+	attempts := m.attempts[key]
+	attempts.Key = key
+	attempts.Failures++
+	attempts.LastFailure = now
+	attempts.ExpiresAt = now.Add(window)
+	m.attempts[key] = attempts
+	return &attempts, nil
+}
+
+func (m *MemoryStore) ClearLoginAttempts(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *MemoryStore) AddAuditEntry(ctx context.Context, entry *models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audit[entry.Scope] = append(m.audit[entry.Scope], *entry)
+	return nil
+}
+
+func (m *MemoryStore) ListAuditEntries(ctx context.Context, scope string, limit int) ([]models.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stored := m.audit[scope]
+	entries := make([]models.AuditEntry, 0, min(len(stored), limit))
+	for i := len(stored) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, stored[i])
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) CreateAPIToken(ctx context.Context, token *models.APIToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.apiTokens[token.UserID] == nil {
+		m.apiTokens[token.UserID] = make(map[string]models.APIToken)
+	}
+	m.apiTokens[token.UserID][token.TokenID] = *token
+	return nil
+}
+
+func (m *MemoryStore) GetAPIToken(ctx context.Context, userID, tokenID string) (*models.APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, ok := m.apiTokens[userID][tokenID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (m *MemoryStore) ListAPITokens(ctx context.Context, userID string) ([]models.APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := make([]models.APIToken, 0, len(m.apiTokens[userID]))
+	for _, token := range m.apiTokens[userID] {
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (m *MemoryStore) TouchAPIToken(ctx context.Context, userID, tokenID string, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.apiTokens[userID][tokenID]
+	if !ok {
+		return ErrNotFound
+	}
+	token.LastUsedAt = &usedAt
+	m.apiTokens[userID][tokenID] = token
+	return nil
+}
+
+func (m *MemoryStore) DeleteAPIToken(ctx context.Context, userID, tokenID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiTokens[userID][tokenID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.apiTokens[userID], tokenID)
+	return nil
+}
+
+func copyRoom(room models.Room) models.Room {
+	room.Users = append([]string(nil), room.Users...)
+	roles := make(map[string]string, len(room.Roles))
+	for userID, role := range room.Roles {
+		roles[userID] = role
+	}
+	room.Roles = roles
+	room.Bans = maps.Clone(room.Bans)
+	if room.Bans == nil {
+		room.Bans = make(map[string]models.RoomBan)
+	}
+	room.Mutes = maps.Clone(room.Mutes)
+	if room.Mutes == nil {
+		room.Mutes = make(map[string]models.RoomMute)
+	}
+	return room
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrConflict  = errors.New("already exists")
+	ErrExhausted = errors.New("no uses left")
+)
+
+// UserStore keeps user accounts. LinkIdentity fails with ErrConflict when
+// the external identity already belongs to a user. SetTwoFactor replaces a
+// user's 2FA setup, removing it when nil. UseTOTPStep fails with
+// ErrConflict unless step is later than the last one used, and
+// UseRecoveryCode with ErrNotFound unless the code hash is unused.
+// UpdateProfile writes the username, display name, avatar and preferences
+// of user. DeleteUser also removes the user's linked identities.
+type UserStore interface {
+	CreateUser(ctx context.Context, user *models.User) error
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	UpdateLastSeen(ctx context.Context, userID string, lastSeen time.Time) error
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error)
+	LinkIdentity(ctx context.Context, identity *models.UserIdentity) error
+	SetEmailVerified(ctx context.Context, userID string) error
+	UpdatePassword(ctx context.Context, userID, hashedPassword string) error
+	SetTwoFactor(ctx context.Context, userID string, twoFactor *models.TwoFactor) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+	UpdateProfile(ctx context.Context, user *models.User) error
+	DeleteUser(ctx context.Context, userID string) error
+}
+
+// RoomQuery selects a page of rooms, most recently active first. With
+// MemberID set it lists that user's rooms, otherwise the publicly listed
+// ones. Search keeps the rooms whose name contains it, ignoring case. When
+// AfterID is set the page starts after that room, last active at
+// AfterTime. A zero Limit returns every match.
+type RoomQuery struct {
+	MemberID  string
+	Search    string
+	AfterTime time.Time
+	AfterID   string
+	Limit     int
+}
+
+// RoomStore keeps rooms and their members. AddRoomUser adds a member with
+// the given role; SetRoomRole changes the role of an existing member and
+// RemoveRoomUser removes a member along with their role. SetVisibility
+// stores the visibility with the passphrase hash it needs, which is empty
+// unless the room is password-protected. SetRoomBan and SetRoomMute set
+// one user's ban or mute, lifting it when nil. SetMaxEditors sets how many
+// editors can be connected at once, 0 lifting the limit, and
+// SetDriverMode turns driver mode on or off. TouchRoom sets a room's
+// LastActivity. DeleteRoom also removes the room's messages, code,
+// files, versions and invites.
+type RoomStore interface {
+	CreateRoom(ctx context.Context, room *models.Room) error
+	GetRoom(ctx context.Context, roomID string) (*models.Room, error)
+	QueryRooms(ctx context.Context, query RoomQuery) ([]models.Room, error)
+	TouchRoom(ctx context.Context, roomID string, at time.Time) error
+	AddRoomUser(ctx context.Context, roomID, userID, role string) (*models.Room, error)
+	SetRoomRole(ctx context.Context, roomID, userID, role string) (*models.Room, error)
+	RemoveRoomUser(ctx context.Context, roomID, userID string) (*models.Room, error)
+	SetInviteOnly(ctx context.Context, roomID string, inviteOnly bool) (*models.Room, error)
+	SetVisibility(ctx context.Context, roomID, visibility, passwordHash string) (*models.Room, error)
+	SetRoomBan(ctx context.Context, roomID, userID string, ban *models.RoomBan) (*models.Room, error)
+	SetRoomMute(ctx context.Context, roomID, userID string, mute *models.RoomMute) (*models.Room, error)
+	SetMaxEditors(ctx context.Context, roomID string, maxEditors int) (*models.Room, error)
+	SetDriverMode(ctx context.Context, roomID string, enabled bool, rotateMinutes int) (*models.Room, error)
+	UpdateRoomDetails(ctx context.Context, roomID, name, description string) (*models.Room, error)
+	SetArchived(ctx context.Context, roomID string, archived bool) (*models.Room, error)
+	DeleteRoom(ctx context.Context, roomID string) error
+}
+
+// InviteStore keeps the outstanding invites of each room. UseInvite counts
+// one redemption and fails with ErrExhausted once MaxUses is reached;
+// revoking an invite deletes it.
+type InviteStore interface {
+	CreateInvite(ctx context.Context, invite *models.Invite) error
+	ListInvites(ctx context.Context, roomID string) ([]models.Invite, error)
+	UseInvite(ctx context.Context, roomID, inviteID string) (*models.Invite, error)
+	DeleteInvite(ctx context.Context, roomID, inviteID string) error
+}
+
+// MessageQuery selects a page of a room's chat history. With After set the
+// page holds the oldest messages after that instant; otherwise it holds the
+// newest messages before Before (or overall when Before is zero). Pages are
+// always returned oldest first.
+type MessageQuery struct {
+	Before time.Time
+	After  time.Time
+	Limit  int
+}
+
+type MessageStore interface {
+	SaveMessage(ctx context.Context, message *models.Message) error
+	ListMessages(ctx context.Context, roomID string, query MessageQuery) ([]models.Message, error)
+}
+
+// CodeStore persists the content of each file in a room's workspace.
+// UpdateCode is a no-op when the stored revision is already at or past the
+// given one, so out-of-order writes never roll the document back.
+type CodeStore interface {
+	GetCode(ctx context.Context, roomID, fileID string) (*models.CodeSync, error)
+	PutCode(ctx context.Context, codeSync *models.CodeSync) error
+	UpdateCode(ctx context.Context, roomID, fileID, code, language string, revision int) error
+	AppendCRDTUpdates(ctx context.Context, roomID, fileID, code string, updates []models.CRDTUpdate) error
+}
+
+// FileStore keeps the workspace tree of each room. DeleteFile also removes
+// the file's content from the CodeStore.
+type FileStore interface {
+	PutFile(ctx context.Context, file *models.WorkspaceFile) error
+	GetFile(ctx context.Context, roomID, fileID string) (*models.WorkspaceFile, error)
+	ListFiles(ctx context.Context, roomID string) ([]models.WorkspaceFile, error)
+	DeleteFile(ctx context.Context, roomID, fileID string) error
+}
+
+// VersionStore keeps immutable code snapshots. ListVersions returns the
+// newest versions first, starting below the before cursor when it is set.
+type VersionStore interface {
+	SaveVersion(ctx context.Context, version *models.CodeVersion) error
+	GetVersion(ctx context.Context, roomID, versionID string) (*models.CodeVersion, error)
+	ListVersions(ctx context.Context, roomID, before string, limit int) ([]models.CodeVersion, error)
+}
+
+// SessionStore keeps login sessions and the list of revoked access tokens.
+// RotateSession replaces a session's token hash only while it still holds
+// oldHash, failing with ErrConflict otherwise, so each refresh token can be
+// redeemed once. Revoked token IDs only need keeping until expiresAt.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, userID, sessionID string) (*models.Session, error)
+	RotateSession(ctx context.Context, session *models.Session, oldHash string) error
+	SessionActive(ctx context.Context, userID, sessionID string) (bool, error)
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+	DeleteUserSessions(ctx context.Context, userID string) error
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// UserTokenStore keeps single-use tokens by hash. ConsumeUserToken deletes
+// the token and returns it, so of two concurrent uses only one succeeds;
+// the other gets ErrNotFound. Expired tokens are returned like any other.
+type UserTokenStore interface {
+	CreateUserToken(ctx context.Context, token *models.UserToken) error
+	ConsumeUserToken(ctx context.Context, tokenHash string) (*models.UserToken, error)
+}
+
+// LoginAttemptStore counts failed logins per key. RecordLoginFailure adds
+// a failure atomically, starting the count over when the previous failure
+// is older than window, and returns the updated count.
+type LoginAttemptStore interface {
+	GetLoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error)
+	RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*models.LoginAttempts, error)
+	ClearLoginAttempts(ctx context.Context, key string) error
+}
+
+// APITokenStore keeps personal API tokens by user. TouchAPIToken records
+// when a token was last used.
+type APITokenStore interface {
+	CreateAPIToken(ctx context.Context, token *models.APIToken) error
+	GetAPIToken(ctx context.Context, userID, tokenID string) (*models.APIToken, error)
+	ListAPITokens(ctx context.Context, userID string) ([]models.APIToken, error)
+	TouchAPIToken(ctx context.Context, userID, tokenID string, usedAt time.Time) error
+	DeleteAPIToken(ctx context.Context, userID, tokenID string) error
+}
+
+// AuditStore keeps audit entries by scope. ListAuditEntries returns up to
+// limit of a scope's entries, newest first.
+type AuditStore interface {
+	AddAuditEntry(ctx context.Context, entry *models.AuditEntry) error
+	ListAuditEntries(ctx context.Context, scope string, limit int) ([]models.AuditEntry, error)
+}
+
+type Store struct {
+	Users      UserStore
+	Rooms      RoomStore
+	Messages   MessageStore
+	Code       CodeStore
+	Files      FileStore
+	Versions   VersionStore
+	Invites    InviteStore
+	Sessions   SessionStore
+	UserTokens UserTokenStore
+	Attempts   LoginAttemptStore
+	Audit      AuditStore
+	APITokens  APITokenStore
+}
+
+// codeKey is where a file's content is stored. The main file keeps the bare
+// room ID so code saved before workspaces existed is still found.
+func codeKey(roomID, fileID string) string {
+	if fileID == "" || fileID == models.MainFileID {
+		return roomID
+	}
+	return roomID + "/" + fileID
+}
+
+// identityKey names an external identity. OIDC issuers never contain a
+// fragment, so "#" cannot appear in one.
+func identityKey(issuer, subject string) string {
+	return issuer + "#" + subject
+}
+
+// listedPublicly reports whether room shows up in public room listings.
+// Password-protected rooms are listed, since anyone with the passphrase may
+// join them.
+func listedPublicly(room *models.Room) bool {
+	return room.EffectiveVisibility() != models.VisibilityPrivate && !room.InviteOnly && !room.Archived
+}
+
+// matchesSearch reports whether room's name contains search, ignoring case.
+func matchesSearch(room *models.Room, search string) bool {
+	return search == "" || strings.Contains(strings.ToLower(room.Name), strings.ToLower(search))
+}
+
+// activeBefore reports whether a room active at t with ID id comes after
+// one active at t2 with ID id2 in a listing.
+func activeBefore(t time.Time, id string, t2 time.Time, id2 string) bool {
+	if !t.Equal(t2) {
+		return t.Before(t2)
+	}
+	return id > id2
+}
+
+// pageRooms applies query to rooms already narrowed down to its scope.
+func pageRooms(rooms []models.Room, query RoomQuery) []models.Room {
+	page := rooms[:0]
+	for i := range rooms {
+		room := &rooms[i]
+		if !matchesSearch(room, query.Search) {
+			continue
+		}
+		if query.AfterID != "" && !activeBefore(room.ActiveAt(), room.RoomID, query.AfterTime, query.AfterID) {
+			continue
+		}
+		page = append(page, *room)
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return activeBefore(page[j].ActiveAt(), page[j].RoomID, page[i].ActiveAt(), page[i].RoomID)
+	})
+	if query.Limit > 0 && len(page) > query.Limit {
+		page = page[:query.Limit]
+	}
+	return page
+}
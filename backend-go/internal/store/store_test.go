@@ -0,0 +1,381 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/anant/realtime-pair-programming/internal/models"
+)
+
+// backends are the stores that run without outside services. Each one must
+// pass the same contract, so handlers behave alike whichever is configured.
+var backends = map[string]func(t *testing.T) *Store{
+	"memory": func(t *testing.T) *Store { return NewMemory() },
+	"bolt": func(t *testing.T) *Store {
+		s, err := NewBolt(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("opening bolt store: %v", err)
+		}
+		t.Cleanup(func() { s.Users.(*BoltStore).DB.Close() })
+		return s
+	},
+}
+
+func TestStoreContract(t *testing.T) {
+	contract := map[string]func(t *testing.T, s *Store){
+		"users":     testUsers,
+		"rooms":     testRooms,
+		"messages":  testMessages,
+		"code":      testCode,
+		"versions":  testVersions,
+		"invites":   testInvites,
+		"sessions":  testSessions,
+		"tokens":    testUserTokens,
+		"attempts":  testLoginAttempts,
+		"audit":     testAudit,
+		"apiTokens": testAPITokens,
+	}
+	for backend, open := range backends {
+		for name, test := range contract {
+			open, test := open, test
+			t.Run(backend+"/"+name, func(t *testing.T) { test(t, open(t)) })
+		}
+	}
+}
+
+var ctx = context.Background()
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wantErr(t *testing.T, what string, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("%s: got %v, want %v", what, err, want)
+	}
+}
+
+func testUsers(t *testing.T, s *Store) {
+	must(t, s.Users.CreateUser(ctx, &models.User{UserID: "u1", Username: "alice", Email: "alice@example.com"}))
+	wantErr(t, "reusing an email", s.Users.CreateUser(ctx, &models.User{UserID: "u2", Email: "alice@example.com"}), ErrConflict)
+
+	user, err := s.Users.GetUserByEmail(ctx, "alice@example.com")
+	must(t, err)
+	if user.UserID != "u1" {
+		t.Errorf("got user %q by email, want u1", user.UserID)
+	}
+	_, err = s.Users.GetUser(ctx, "missing")
+	wantErr(t, "unknown user", err, ErrNotFound)
+
+	identity := &models.UserIdentity{Issuer: "https://idp", Subject: "sub", UserID: "u1"}
+	must(t, s.Users.LinkIdentity(ctx, identity))
+	wantErr(t, "linking a linked identity", s.Users.LinkIdentity(ctx, identity), ErrConflict)
+
+	wantErr(t, "TOTP step without 2FA", s.Users.UseTOTPStep(ctx, "u1", 10), ErrConflict)
+	must(t, s.Users.SetTwoFactor(ctx, "u1", &models.TwoFactor{Enabled: true, RecoveryCodes: []string{"hash"}}))
+	must(t, s.Users.UseTOTPStep(ctx, "u1", 10))
+	wantErr(t, "reusing a TOTP step", s.Users.UseTOTPStep(ctx, "u1", 10), ErrConflict)
+	must(t, s.Users.UseTOTPStep(ctx, "u1", 11))
+	must(t, s.Users.UseRecoveryCode(ctx, "u1", "hash"))
+	wantErr(t, "reusing a recovery code", s.Users.UseRecoveryCode(ctx, "u1", "hash"), ErrNotFound)
+
+	must(t, s.Users.DeleteUser(ctx, "u1"))
+	_, err = s.Users.GetUserByIdentity(ctx, "https://idp", "sub")
+	wantErr(t, "identity of a deleted user", err, ErrNotFound)
+	_, err = s.Users.GetUserByEmail(ctx, "alice@example.com")
+	wantErr(t, "email of a deleted user", err, ErrNotFound)
+}
+
+func testRooms(t *testing.T, s *Store) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, room := range []models.Room{
+		{RoomID: "r1", Name: "Go pairing", Users: []string{"alice"}, Visibility: models.VisibilityPublic},
+		{RoomID: "r2", Name: "Rust", Users: []string{"alice", "bob"}, Visibility: models.VisibilityPrivate},
+		{RoomID: "r3", Name: "go interview", Users: []string{"bob"}, Visibility: models.VisibilityPassword},
+		{RoomID: "r4", Name: "Invites", Users: []string{"bob"}, InviteOnly: true},
+		{RoomID: "r5", Name: "Old go", Users: []string{"bob"}, Archived: true},
+	} {
+		room.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		must(t, s.Rooms.CreateRoom(ctx, &room))
+	}
+	must(t, s.Rooms.TouchRoom(ctx, "r1", base.Add(time.Hour)))
+
+	tests := []struct {
+		name  string
+		query RoomQuery
+		want  []string
+	}{
+		{"member", RoomQuery{MemberID: "alice"}, []string{"r1", "r2"}},
+		{"public", RoomQuery{}, []string{"r1", "r3"}},
+		{"search", RoomQuery{Search: "GO"}, []string{"r1", "r3"}},
+		{"member search", RoomQuery{MemberID: "bob", Search: "go"}, []string{"r5", "r3"}},
+		{"first page", RoomQuery{MemberID: "bob", Limit: 2}, []string{"r5", "r4"}},
+		{"next page", RoomQuery{MemberID: "bob", AfterTime: base.Add(3 * time.Minute), AfterID: "r4"}, []string{"r3", "r2"}},
+	}
+	for _, tt := range tests {
+		rooms, err := s.Rooms.QueryRooms(ctx, tt.query)
+		must(t, err)
+		if got := roomIDs(rooms); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	room, err := s.Rooms.AddRoomUser(ctx, "r1", "carol", models.RoleViewer)
+	must(t, err)
+	if room.Roles["carol"] != models.RoleViewer {
+		t.Errorf("got role %q after adding carol, want %q", room.Roles["carol"], models.RoleViewer)
+	}
+	_, err = s.Rooms.RemoveRoomUser(ctx, "r2", "alice")
+	must(t, err)
+	rooms, err := s.Rooms.QueryRooms(ctx, RoomQuery{MemberID: "alice"})
+	must(t, err)
+	if got := roomIDs(rooms); !slices.Equal(got, []string{"r1"}) {
+		t.Errorf("got %v after leaving r2, want [r1]", got)
+	}
+
+	must(t, s.Rooms.DeleteRoom(ctx, "r1"))
+	_, err = s.Rooms.GetRoom(ctx, "r1")
+	wantErr(t, "deleted room", err, ErrNotFound)
+	rooms, err = s.Rooms.QueryRooms(ctx, RoomQuery{MemberID: "carol"})
+	must(t, err)
+	if len(rooms) != 0 {
+		t.Errorf("got %v for a member of a deleted room, want none", roomIDs(rooms))
+	}
+}
+
+func testMessages(t *testing.T, s *Store) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		must(t, s.Messages.SaveMessage(ctx, &models.Message{
+			RoomID:    "r1",
+			MessageID: string(rune('0' + i)),
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	tests := []struct {
+		name  string
+		query MessageQuery
+		want  []string
+	}{
+		{"newest", MessageQuery{Limit: 2}, []string{"4", "5"}},
+		{"before", MessageQuery{Before: base.Add(4 * time.Second), Limit: 2}, []string{"2", "3"}},
+		{"after", MessageQuery{After: base.Add(1 * time.Second), Limit: 2}, []string{"2", "3"}},
+		{"all", MessageQuery{Limit: 10}, []string{"1", "2", "3", "4", "5"}},
+	}
+	for _, tt := range tests {
+		messages, err := s.Messages.ListMessages(ctx, "r1", tt.query)
+		must(t, err)
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.MessageID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testCode(t *testing.T, s *Store) {
+	_, err := s.Code.GetCode(ctx, "r1", models.MainFileID)
+	wantErr(t, "code never saved", err, ErrNotFound)
+
+	must(t, s.Code.UpdateCode(ctx, "r1", models.MainFileID, "v2", "go", 2))
+	must(t, s.Code.UpdateCode(ctx, "r1", models.MainFileID, "v1", "go", 1))
+	code, err := s.Code.GetCode(ctx, "r1", models.MainFileID)
+	must(t, err)
+	if code.Code != "v2" || code.Revision != 2 {
+		t.Errorf("got %q at %d after an older write, want %q at 2", code.Code, code.Revision, "v2")
+	}
+
+	must(t, s.Code.AppendCRDTUpdates(ctx, "r1", "f1", "a", []models.CRDTUpdate{crdtInsert(1, "a")}))
+	must(t, s.Code.AppendCRDTUpdates(ctx, "r1", "f1", "ab", []models.CRDTUpdate{crdtInsert(2, "b")}))
+	code, err = s.Code.GetCode(ctx, "r1", "f1")
+	must(t, err)
+	if code.Code != "ab" || len(code.Updates) != 2 || code.FileID != "f1" {
+		t.Errorf("got %q with %d updates in %q, want %q with 2 in f1", code.Code, len(code.Updates), code.FileID, "ab")
+	}
+
+	must(t, s.Files.PutFile(ctx, &models.WorkspaceFile{RoomID: "r1", FileID: "f1", Name: "a.go", Type: models.FileTypeFile}))
+	must(t, s.Files.DeleteFile(ctx, "r1", "f1"))
+	_, err = s.Files.GetFile(ctx, "r1", "f1")
+	wantErr(t, "deleted file", err, ErrNotFound)
+	_, err = s.Code.GetCode(ctx, "r1", "f1")
+	wantErr(t, "code of a deleted file", err, ErrNotFound)
+	if _, err := s.Code.GetCode(ctx, "r1", models.MainFileID); err != nil {
+		t.Errorf("main file after deleting another: %v", err)
+	}
+}
+
+func testVersions(t *testing.T, s *Store) {
+	for _, id := range []string{"v2", "v1", "v3"} {
+		must(t, s.Versions.SaveVersion(ctx, &models.CodeVersion{RoomID: "r1", VersionID: id}))
+	}
+
+	versions, err := s.Versions.ListVersions(ctx, "r1", "", 2)
+	must(t, err)
+	if got := versionIDs(versions); !slices.Equal(got, []string{"v3", "v2"}) {
+		t.Errorf("first page: got %v, want [v3 v2]", got)
+	}
+	versions, err = s.Versions.ListVersions(ctx, "r1", "v2", 2)
+	must(t, err)
+	if got := versionIDs(versions); !slices.Equal(got, []string{"v1"}) {
+		t.Errorf("next page: got %v, want [v1]", got)
+	}
+	_, err = s.Versions.GetVersion(ctx, "r1", "v9")
+	wantErr(t, "unknown version", err, ErrNotFound)
+}
+
+func testInvites(t *testing.T, s *Store) {
+	must(t, s.Invites.CreateInvite(ctx, &models.Invite{RoomID: "r1", InviteID: "i1", MaxUses: 2}))
+	for i := 1; i <= 2; i++ {
+		invite, err := s.Invites.UseInvite(ctx, "r1", "i1")
+		must(t, err)
+		if invite.Uses != i {
+			t.Errorf("got %d uses, want %d", invite.Uses, i)
+		}
+	}
+	_, err := s.Invites.UseInvite(ctx, "r1", "i1")
+	wantErr(t, "using a spent invite", err, ErrExhausted)
+
+	must(t, s.Invites.DeleteInvite(ctx, "r1", "i1"))
+	_, err = s.Invites.UseInvite(ctx, "r1", "i1")
+	wantErr(t, "using a deleted invite", err, ErrNotFound)
+}
+
+func testSessions(t *testing.T, s *Store) {
+	now := time.Now()
+	session := &models.Session{UserID: "u1", SessionID: "s1", TokenHash: "h1", ExpiresAt: now.Add(time.Hour)}
+	must(t, s.Sessions.CreateSession(ctx, session))
+
+	rotated := *session
+	rotated.TokenHash = "h2"
+	must(t, s.Sessions.RotateSession(ctx, &rotated, "h1"))
+	replayed := *session
+	replayed.TokenHash = "h3"
+	wantErr(t, "rotating with a used hash", s.Sessions.RotateSession(ctx, &replayed, "h1"), ErrConflict)
+
+	must(t, s.Sessions.CreateSession(ctx, &models.Session{UserID: "u1", SessionID: "s2", ExpiresAt: now.Add(time.Hour)}))
+	must(t, s.Sessions.DeleteUserSessions(ctx, "u1"))
+	for _, id := range []string{"s1", "s2"} {
+		active, err := s.Sessions.SessionActive(ctx, "u1", id)
+		must(t, err)
+		if active {
+			t.Errorf("session %s still active after signing out everywhere", id)
+		}
+	}
+
+	must(t, s.Sessions.RevokeToken(ctx, "jti", now.Add(time.Hour)))
+	for jti, want := range map[string]bool{"jti": true, "other": false} {
+		revoked, err := s.Sessions.IsTokenRevoked(ctx, jti)
+		must(t, err)
+		if revoked != want {
+			t.Errorf("token %s: got revoked %v, want %v", jti, revoked, want)
+		}
+	}
+}
+
+func testUserTokens(t *testing.T, s *Store) {
+	must(t, s.UserTokens.CreateUserToken(ctx, &models.UserToken{TokenHash: "h1", UserID: "u1", ExpiresAt: time.Now().Add(time.Hour)}))
+	token, err := s.UserTokens.ConsumeUserToken(ctx, "h1")
+	must(t, err)
+	if token.UserID != "u1" {
+		t.Errorf("got token for %q, want u1", token.UserID)
+	}
+	_, err = s.UserTokens.ConsumeUserToken(ctx, "h1")
+	wantErr(t, "consuming a token twice", err, ErrNotFound)
+}
+
+func testLoginAttempts(t *testing.T, s *Store) {
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		attempts, err := s.Attempts.RecordLoginFailure(ctx, "k", now.Add(time.Duration(i)*time.Second), time.Minute)
+		must(t, err)
+		if attempts.Failures != i {
+			t.Errorf("got %d failures, want %d", attempts.Failures, i)
+		}
+	}
+	attempts, err := s.Attempts.GetLoginAttempts(ctx, "k")
+	must(t, err)
+	if attempts.Failures != 3 {
+		t.Errorf("got %d failures stored, want 3", attempts.Failures)
+	}
+
+	// A failure after the window starts the count over.
+	attempts, err = s.Attempts.RecordLoginFailure(ctx, "k", now.Add(2*time.Minute), time.Minute)
+	must(t, err)
+	if attempts.Failures != 1 {
+		t.Errorf("got %d failures after the window, want 1", attempts.Failures)
+	}
+
+	must(t, s.Attempts.ClearLoginAttempts(ctx, "k"))
+	_, err = s.Attempts.GetLoginAttempts(ctx, "k")
+	wantErr(t, "cleared attempts", err, ErrNotFound)
+}
+
+func testAudit(t *testing.T, s *Store) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"e1", "e2", "e3"} {
+		must(t, s.Audit.AddAuditEntry(ctx, &models.AuditEntry{Scope: "auth", EntryID: id, CreatedAt: base.Add(time.Duration(i) * time.Second)}))
+	}
+	must(t, s.Audit.AddAuditEntry(ctx, &models.AuditEntry{Scope: "room#r1", EntryID: "e4", CreatedAt: base}))
+
+	entries, err := s.Audit.ListAuditEntries(ctx, "auth", 2)
+	must(t, err)
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.EntryID)
+	}
+	if !slices.Equal(got, []string{"e3", "e2"}) {
+		t.Errorf("got %v, want [e3 e2]", got)
+	}
+}
+
+func testAPITokens(t *testing.T, s *Store) {
+	must(t, s.APITokens.CreateAPIToken(ctx, &models.APIToken{UserID: "u1", TokenID: "t1", Scopes: []string{models.ScopeRoomsRead}}))
+	usedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	must(t, s.APITokens.TouchAPIToken(ctx, "u1", "t1", usedAt))
+
+	token, err := s.APITokens.GetAPIToken(ctx, "u1", "t1")
+	must(t, err)
+	if token.LastUsedAt == nil || !token.LastUsedAt.Equal(usedAt) {
+		t.Errorf("got last used %v, want %v", token.LastUsedAt, usedAt)
+	}
+	_, err = s.APITokens.GetAPIToken(ctx, "u2", "t1")
+	wantErr(t, "another user's token", err, ErrNotFound)
+
+	must(t, s.APITokens.DeleteAPIToken(ctx, "u1", "t1"))
+	tokens, err := s.APITokens.ListAPITokens(ctx, "u1")
+	must(t, err)
+	if len(tokens) != 0 {
+		t.Errorf("got %d tokens after deleting, want none", len(tokens))
+	}
+}
+
+func crdtInsert(clock int, value string) models.CRDTUpdate {
+	return models.CRDTUpdate{Type: models.OpInsert, ID: models.CRDTID{Client: "server", Clock: clock}, Value: value}
+}
+
+func roomIDs(rooms []models.Room) []string {
+	var ids []string
+	for _, room := range rooms {
+		ids = append(ids, room.RoomID)
+	}
+	return ids
+}
+
+func versionIDs(versions []models.CodeVersion) []string {
+	var ids []string
+	for _, version := range versions {
+		ids = append(ids, version.VersionID)
+	}
+	return ids
+}
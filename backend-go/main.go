@@ -5,11 +5,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/anant/realtime-pair-programming/internal/auth"
 	"github.com/anant/realtime-pair-programming/internal/db"
 	"github.com/anant/realtime-pair-programming/internal/handlers"
+	"github.com/anant/realtime-pair-programming/internal/mail"
+	"github.com/anant/realtime-pair-programming/internal/models"
+	"github.com/anant/realtime-pair-programming/internal/oidc"
 	"github.com/anant/realtime-pair-programming/internal/services"
+	"github.com/anant/realtime-pair-programming/internal/store"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -20,24 +26,77 @@ func main() {
 	if err := godotenv.Load("../.env"); err != nil {
 		log.Printf("Warning: .env file not found, using system environment variables")
 	}
-	database, err := db.NewDynamoDB()
-	if err != nil {
-		log.Fatalf("Failed to initialize DynamoDB: %v", err)
+	if err := auth.LoadKeys(os.Getenv("JWT_KEYS_FILE")); err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
 	}
-	if err := database.EnsureTablesExist(context.TODO()); err != nil {
-		log.Fatalf("Failed to ensure tables exist: %v", err)
+	var stores *store.Store
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "memory":
+		log.Printf("Using in-memory storage, data will not survive a restart")
+		stores = store.NewMemory()
+	case "bolt":
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = "pair-programming.db"
+		}
+		var err error
+		stores, err = store.NewBolt(path)
+		if err != nil {
+			log.Fatalf("Failed to open bolt database: %v", err)
+		}
+	case "", "dynamodb":
+		database, err := db.NewDynamoDB()
+		if err != nil {
+			log.Fatalf("Failed to initialize DynamoDB: %v", err)
+		}
+		if err := database.EnsureTablesExist(context.TODO()); err != nil {
+			log.Fatalf("Failed to ensure tables exist: %v", err)
+		}
+		stores, err = store.NewDynamo(database)
+		if err != nil {
+			log.Fatalf("Failed to index rooms: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q", backend)
 	}
-	roomManager := services.NewRoomManager()
+	var bus services.Bus
+	switch backend := os.Getenv("BUS_BACKEND"); backend {
+	case "", "local":
+		bus = services.NewLocalBus()
+	case "redis":
+		url := os.Getenv("REDIS_URL")
+		if url == "" {
+			url = "redis://localhost:6379/0"
+		}
+		redisBus, err := services.NewRedisBus(url)
+		if err != nil {
+			log.Fatalf("Failed to connect to Redis: %v", err)
+		}
+		bus = redisBus
+	default:
+		log.Fatalf("Unknown BUS_BACKEND %q", backend)
+	}
+	roomManager := services.NewRoomManager(bus)
 	go roomManager.Run()
-	authHandler := handlers.NewAuthHandler(database)
-	roomHandler := handlers.NewRoomHandler(database)
-	wsHandler := handlers.NewWebSocketHandler(roomManager, database)
+	authHandler := handlers.NewAuthHandler(stores, mailer(), envOr("APP_URL", "http://localhost:5173"))
+	roomHandler := handlers.NewRoomHandler(roomManager, stores)
+	snapshots := services.NewSnapshotScheduler(snapshotInterval())
+	wsHandler := handlers.NewWebSocketHandler(roomManager, snapshots, stores)
+	versionHandler := handlers.NewVersionHandler(roomManager, snapshots, stores)
+	workspaceHandler := handlers.NewWorkspaceHandler(roomManager, stores)
+	inviteHandler := handlers.NewInviteHandler(stores)
+	moderationHandler := handlers.NewModerationHandler(roomManager, stores)
+	apiTokenHandler := handlers.NewAPITokenHandler(stores)
+	userHandler := handlers.NewUserHandler(authHandler, roomManager, stores)
 	r := chi.NewRouter()
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		r.Use(middleware.RealIP)
+	}
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:5173", "http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
@@ -45,12 +104,81 @@ func main() {
 	}))
 	r.Post("/api/auth/signup", authHandler.Signup)
 	r.Post("/api/auth/login", authHandler.Login)
+	r.Post("/api/auth/login/2fa", authHandler.LoginTwoFactor)
+	r.Post("/api/auth/refresh", authHandler.Refresh)
+	r.Post("/api/auth/verify", authHandler.VerifyEmail)
+	r.Post("/api/auth/forgot-password", authHandler.ForgotPassword)
+	r.Post("/api/auth/reset-password", authHandler.ResetPassword)
+	r.Get("/.well-known/jwks.json", authHandler.JWKS)
+	if provider := oidcProvider(); provider != nil {
+		oidcHandler := handlers.NewOIDCHandler(authHandler, provider, envOr("OIDC_POST_LOGIN_REDIRECT", "http://localhost:5173/auth/callback"))
+		r.Get("/api/auth/oidc/login", oidcHandler.Login)
+		r.Get("/api/auth/oidc/callback", oidcHandler.Callback)
+	}
 	r.Group(func(r chi.Router) {
-		r.Use(auth.Middleware)
-		r.Get("/api/rooms", roomHandler.GetRooms)
-		r.Post("/api/rooms", roomHandler.CreateRoom)
-		r.Get("/api/rooms/{roomId}", roomHandler.GetRoom)
-		r.Post("/api/rooms/{roomId}/join", roomHandler.JoinRoom)
+		r.Use(auth.Middleware(auth.NewVerifier(stores.Sessions, stores.APITokens, stores.Users)))
+		r.Get("/api/users/me", userHandler.GetMe)
+		r.Get("/api/users/{userId}", userHandler.GetUser)
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireSession)
+			r.Post("/api/auth/logout", authHandler.Logout)
+			r.Post("/api/auth/logout-all", authHandler.LogoutAll)
+			r.Post("/api/auth/verify/resend", authHandler.ResendVerification)
+			r.Get("/api/auth/2fa", authHandler.TwoFactorStatus)
+			r.Post("/api/auth/2fa/setup", authHandler.SetupTwoFactor)
+			r.Post("/api/auth/2fa/enable", authHandler.EnableTwoFactor)
+			r.Post("/api/auth/2fa/disable", authHandler.DisableTwoFactor)
+			r.Get("/api/tokens", apiTokenHandler.ListAPITokens)
+			r.Post("/api/tokens", apiTokenHandler.CreateAPIToken)
+			r.Delete("/api/tokens/{tokenId}", apiTokenHandler.RevokeAPIToken)
+			r.Patch("/api/users/me", userHandler.UpdateMe)
+			r.Post("/api/users/me/password", userHandler.ChangePassword)
+			r.Delete("/api/users/me", userHandler.DeleteMe)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireScope(models.ScopeRoomsRead))
+			r.Get("/api/rooms", roomHandler.GetRooms)
+			r.Get("/api/rooms/{roomId}", roomHandler.GetRoom)
+			r.Get("/api/rooms/{roomId}/messages", roomHandler.GetMessages)
+			r.Get("/api/rooms/{roomId}/members", roomHandler.ListMembers)
+			r.Get("/api/rooms/{roomId}/invites", inviteHandler.ListInvites)
+			r.Get("/api/rooms/{roomId}/bans", moderationHandler.ListBans)
+			r.Get("/api/rooms/{roomId}/audit", moderationHandler.ListAudit)
+			r.Get("/api/rooms/{roomId}/files", workspaceHandler.ListFiles)
+			r.Get("/api/rooms/{roomId}/files/{fileId}", workspaceHandler.GetFile)
+			r.Get("/api/rooms/{roomId}/versions", versionHandler.ListVersions)
+			r.Get("/api/rooms/{roomId}/versions/diff", versionHandler.DiffVersions)
+			r.Get("/api/rooms/{roomId}/versions/{versionId}", versionHandler.GetVersion)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireScope(models.ScopeRoomsWrite))
+			r.Post("/api/rooms", roomHandler.CreateRoom)
+			r.Post("/api/rooms/{roomId}/join", roomHandler.JoinRoom)
+			r.Put("/api/rooms/{roomId}/members/{userId}/role", roomHandler.UpdateMemberRole)
+			r.Put("/api/rooms/{roomId}/invite-only", roomHandler.SetInviteOnly)
+			r.Put("/api/rooms/{roomId}/visibility", roomHandler.SetVisibility)
+			r.Put("/api/rooms/{roomId}/capacity", roomHandler.SetCapacity)
+			r.Put("/api/rooms/{roomId}/driver-mode", roomHandler.SetDriverMode)
+			r.Patch("/api/rooms/{roomId}", roomHandler.UpdateRoom)
+			r.Delete("/api/rooms/{roomId}", roomHandler.DeleteRoom)
+			r.Post("/api/rooms/{roomId}/archive", roomHandler.ArchiveRoom)
+			r.Post("/api/rooms/{roomId}/unarchive", roomHandler.UnarchiveRoom)
+			r.Post("/api/rooms/{roomId}/leave", roomHandler.LeaveRoom)
+			r.Post("/api/rooms/{roomId}/transfer", roomHandler.TransferOwnership)
+			r.Post("/api/rooms/{roomId}/invites", inviteHandler.CreateInvite)
+			r.Delete("/api/rooms/{roomId}/invites/{inviteId}", inviteHandler.RevokeInvite)
+			r.Post("/api/invites/{token}/accept", inviteHandler.AcceptInvite)
+			r.Post("/api/rooms/{roomId}/members/{userId}/kick", moderationHandler.KickMember)
+			r.Put("/api/rooms/{roomId}/members/{userId}/mute", moderationHandler.MuteMember)
+			r.Delete("/api/rooms/{roomId}/members/{userId}/mute", moderationHandler.UnmuteMember)
+			r.Post("/api/rooms/{roomId}/bans", moderationHandler.BanUser)
+			r.Delete("/api/rooms/{roomId}/bans/{userId}", moderationHandler.UnbanUser)
+			r.Post("/api/rooms/{roomId}/files", workspaceHandler.CreateFile)
+			r.Patch("/api/rooms/{roomId}/files/{fileId}", workspaceHandler.UpdateFile)
+			r.Delete("/api/rooms/{roomId}/files/{fileId}", workspaceHandler.DeleteFile)
+			r.Post("/api/rooms/{roomId}/versions/{versionId}/restore", versionHandler.RestoreVersion)
+		})
+		r.With(auth.RequireScope(models.ScopeChatWrite)).Post("/api/rooms/{roomId}/messages", roomHandler.PostMessage)
 	})
 	r.Get("/ws/{roomId}", wsHandler.HandleWebSocket)
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -69,3 +197,67 @@ func main() {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
+
+func snapshotInterval() time.Duration {
+	if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid SNAPSHOT_INTERVAL %q: %v", v, err)
+		}
+		return d
+	}
+	return 5 * time.Minute
+}
+
+// mailer picks how emails are delivered from MAIL_BACKEND: "smtp", or by
+// default "log", which writes them to MAIL_LOG_FILE or the log.
+func mailer() mail.Mailer {
+	from := envOr("MAIL_FROM", "Pair Programming <noreply@localhost>")
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "", "log":
+		return &mail.LogMailer{Path: os.Getenv("MAIL_LOG_FILE"), From: from}
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			log.Fatalf("MAIL_BACKEND is smtp but SMTP_HOST is not set")
+		}
+		return &mail.SMTPMailer{
+			Host:     host,
+			Port:     envOr("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	default:
+		log.Fatalf("Unknown MAIL_BACKEND %q", backend)
+		return nil
+	}
+}
+
+// oidcProvider configures OpenID Connect login from the environment. It
+// returns nil, leaving OIDC login off, unless an issuer is set.
+func oidcProvider() *oidc.Provider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	config := oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  envOr("OIDC_REDIRECT_URL", "http://localhost:8080/api/auth/oidc/callback"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+	}
+	if config.ClientID == "" {
+		log.Fatalf("OIDC_ISSUER is set but OIDC_CLIENT_ID is not")
+	}
+	log.Printf("OIDC login enabled with issuer %s", issuer)
+	return oidc.NewProvider(config)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -1,13 +1,14 @@
 import React, { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
-import { roomAPI, Room } from '../services/api';
+import { roomAPI, RoomSummary } from '../services/api';
 import { useAuthStore } from '../store/authStore';
 import './Dashboard.css';
 
 export const Dashboard: React.FC = () => {
-    const [rooms, setRooms] = useState<Room[]>([]);
+    const [rooms, setRooms] = useState<RoomSummary[]>([]);
     const [roomName, setRoomName] = useState('');
     const [joinRoomId, setJoinRoomId] = useState('');
+    const [joinPassword, setJoinPassword] = useState('');
     const [loading, setLoading] = useState(false);
     const [error, setError] = useState('');
 
@@ -21,7 +22,7 @@ export const Dashboard: React.FC = () => {
     const loadRooms = async () => {
         try {
             const data = await roomAPI.getRooms();
-            setRooms(data);
+            setRooms(data.rooms);
         } catch (err) {
             console.error('Failed to load rooms:', err);
         }
@@ -54,7 +55,7 @@ export const Dashboard: React.FC = () => {
 
         try {
             console.log('Attempting to join room:', joinRoomId);
-            const response = await roomAPI.joinRoom(joinRoomId.trim());
+            const response = await roomAPI.joinRoom(joinRoomId.trim(), joinPassword);
             console.log('Join room response:', response);
             navigate(`/room/${joinRoomId.trim()}`);
         } catch (err: any) {
@@ -128,6 +129,13 @@ export const Dashboard: React.FC = () => {
                                 value={joinRoomId}
                                 onChange={(e) => setJoinRoomId(e.target.value)}
                             />
+                            <input
+                                type="password"
+                                className="input"
+                                placeholder="Room password (if required)"
+                                value={joinPassword}
+                                onChange={(e) => setJoinPassword(e.target.value)}
+                            />
                             <button type="submit" className="btn btn-primary w-full" disabled={loading}>
                                 Join Room
                             </button>
@@ -153,12 +161,12 @@ export const Dashboard: React.FC = () => {
                                     <div className="room-header">
                                         <h4>{room.name}</h4>
                                         <span className="badge badge-info">
-                                            {room.users.length} {room.users.length === 1 ? 'user' : 'users'}
+                                            {room.participants} online
                                         </span>
                                     </div>
                                     <p className="room-id">ID: {room.roomId}</p>
                                     <p className="room-date">
-                                        Created {new Date(room.createdAt).toLocaleDateString()}
+                                        Active {new Date(room.lastActivity).toLocaleDateString()}
                                     </p>
                                 </div>
                             ))}
@@ -27,7 +27,7 @@ interface RoomData {
 export const EditorPage: React.FC = () => {
     const { roomId } = useParams<{ roomId: string }>();
     const navigate = useNavigate();
-    const { user } = useAuthStore();
+    const { user, token } = useAuthStore();
     const { toasts, addToast, removeToast } = useToastStore();
 
     const [roomData, setRoomData] = useState<RoomData | null>(null);
@@ -41,7 +41,7 @@ export const EditorPage: React.FC = () => {
     const wsClientRef = useRef<WebSocketClient | null>(null);
 
     useEffect(() => {
-        if (!roomId || !user) return;
+        if (!roomId || !user || !token) return;
 
         const initRoom = async () => {
             try {
@@ -56,15 +56,14 @@ export const EditorPage: React.FC = () => {
                     wsClientRef.current.disconnect();
                 }
 
-                const client = new WebSocketClient(roomId, user.userId, user.username);
+                const client = new WebSocketClient(roomId, user.userId, user.username, token);
                 await client.connect();
                 wsClientRef.current = client;
 
                 client.on('code_change', (payload: any) => {
                     console.log('Code change received:', payload);
-                    if (payload.userId !== user.userId) {
-                        setCode(payload.code);
-                    }
+                    // Never echoed to this tab, but the user's other tabs get it.
+                    setCode(payload.code);
                 });
 
                 client.on('user_list', (payload: any) => {
@@ -85,6 +84,10 @@ export const EditorPage: React.FC = () => {
                     addToast(`${payload.username} left the room`, 'info');
                 });
 
+                client.on('chat_history', (payload: any) => {
+                    setChatMessages(payload || []);
+                });
+
                 client.on('chat', (payload: any) => {
                     console.log('Chat message received:', payload);
                     if (payload.text && (
@@ -118,7 +121,7 @@ export const EditorPage: React.FC = () => {
                 wsClientRef.current = null;
             }
         };
-    }, [roomId, user]);
+    }, [roomId, user, token]);
 
     const handleEditorDidMount: OnMount = () => {
         monaco.languages.registerCompletionItemProvider(language, {
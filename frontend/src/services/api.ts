@@ -31,6 +31,20 @@ export interface Room {
     createdBy: string;
     users: string[];
     createdAt: string;
+    lastActivity: string;
+    visibility: 'public' | 'private' | 'password';
+    maxEditors?: number;
+    driverMode?: boolean;
+    rotateMinutes?: number;
+}
+
+export interface RoomSummary extends Room {
+    participants: number;
+}
+
+export interface RoomList {
+    rooms: RoomSummary[];
+    next?: string;
 }
 
 export interface AuthResponse {
@@ -52,8 +66,10 @@ export const authAPI = {
 };
 
 export const roomAPI = {
-    getRooms: async (): Promise<Room[]> => {
-        const { data } = await api.get('/rooms');
+    getRooms: async (
+        params: { visibility?: 'member' | 'public'; q?: string; cursor?: string; limit?: number } = {}
+    ): Promise<RoomList> => {
+        const { data } = await api.get('/rooms', { params });
         return data;
     },
 
@@ -67,9 +83,9 @@ export const roomAPI = {
         return data;
     },
 
-    joinRoom: async (roomId: string): Promise<{ message: string }> => {
+    joinRoom: async (roomId: string, password?: string): Promise<{ message: string }> => {
         try {
-            const { data } = await api.post(`/rooms/${roomId}/join`);
+            const { data } = await api.post(`/rooms/${roomId}/join`, password ? { password } : undefined);
             return data;
         } catch (error) {
             console.error('API Join Room Error:', error);
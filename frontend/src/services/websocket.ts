@@ -8,21 +8,23 @@ export class WebSocketClient {
     private roomId: string;
     private userId: string;
     private username: string;
+    private token: string;
     private reconnectAttempts = 0;
     private maxReconnectAttempts = 5;
     private messageHandlers: Map<string, (payload: any) => void> = new Map();
 
-    constructor(roomId: string, userId: string, username: string) {
+    constructor(roomId: string, userId: string, username: string, token: string) {
         this.roomId = roomId;
         this.userId = userId;
         this.username = username;
+        this.token = token;
     }
 
     connect(): Promise<void> {
         return new Promise((resolve, reject) => {
-            const wsUrl = `ws://localhost:8080/ws/${this.roomId}?userId=${this.userId}&username=${encodeURIComponent(this.username)}`;
+            const wsUrl = `ws://localhost:8080/ws/${this.roomId}`;
 
-            this.ws = new WebSocket(wsUrl);
+            this.ws = new WebSocket(wsUrl, ['access_token', this.token]);
 
             this.ws.onopen = () => {
                 console.log('WebSocket connected');
@@ -0,0 +1,24 @@
+#!/bin/sh
+# Creates an Ed25519 JWT signing key. Without an existing manifest one is
+# written with the new key active immediately; otherwise the entry to add
+# is printed, so the rotation date can be picked.
+#
+# usage: generate-jwt-key.sh [keys dir] [kid]
+set -e
+
+dir=${1:-backend-go/keys}
+kid=${2:-$(date -u +%Y%m%d%H%M%S)}
+manifest="$dir/jwt-keys.json"
+
+mkdir -p "$dir"
+openssl genpkey -algorithm ed25519 -out "$dir/$kid.pem"
+chmod 600 "$dir/$kid.pem"
+
+entry="{\"kid\": \"$kid\", \"path\": \"$kid.pem\", \"activeFrom\": \"$(date -u +%Y-%m-%dT%H:%M:%SZ)\"}"
+if [ -f "$manifest" ]; then
+  echo "Created $dir/$kid.pem. Add it to $manifest, setting activeFrom to when it should take over:"
+  echo "  $entry"
+else
+  printf '{\n  "keys": [\n    %s\n  ]\n}\n' "$entry" > "$manifest"
+  echo "Created $dir/$kid.pem and $manifest"
+fi
@@ -45,6 +45,19 @@ const tables = [
       WriteCapacityUnits: 1,
     },
   },
+  {
+    TableName: process.env.DYNAMO_IDENTITIES_TABLE || 'UserIdentities',
+    KeySchema: [
+      { AttributeName: 'identity', KeyType: 'HASH' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'identity', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
   {
     TableName: process.env.DYNAMO_ROOMS_TABLE || 'Rooms',
     KeySchema: [
@@ -86,6 +99,135 @@ const tables = [
       WriteCapacityUnits: 1,
     },
   },
+  {
+    TableName: process.env.DYNAMO_VERSIONS_TABLE || 'CodeVersions',
+    KeySchema: [
+      { AttributeName: 'roomId', KeyType: 'HASH' },
+      { AttributeName: 'versionId', KeyType: 'RANGE' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'roomId', AttributeType: 'S' },
+      { AttributeName: 'versionId', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_FILES_TABLE || 'WorkspaceFiles',
+    KeySchema: [
+      { AttributeName: 'roomId', KeyType: 'HASH' },
+      { AttributeName: 'fileId', KeyType: 'RANGE' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'roomId', AttributeType: 'S' },
+      { AttributeName: 'fileId', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_INVITES_TABLE || 'RoomInvites',
+    KeySchema: [
+      { AttributeName: 'roomId', KeyType: 'HASH' },
+      { AttributeName: 'inviteId', KeyType: 'RANGE' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'roomId', AttributeType: 'S' },
+      { AttributeName: 'inviteId', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_SESSIONS_TABLE || 'Sessions',
+    KeySchema: [
+      { AttributeName: 'userId', KeyType: 'HASH' },
+      { AttributeName: 'sessionId', KeyType: 'RANGE' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'userId', AttributeType: 'S' },
+      { AttributeName: 'sessionId', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_REVOKED_TABLE || 'RevokedTokens',
+    KeySchema: [
+      { AttributeName: 'jti', KeyType: 'HASH' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'jti', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_USER_TOKENS_TABLE || 'UserTokens',
+    KeySchema: [
+      { AttributeName: 'tokenHash', KeyType: 'HASH' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'tokenHash', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_LOGIN_ATTEMPTS_TABLE || 'LoginAttempts',
+    KeySchema: [
+      { AttributeName: 'attemptKey', KeyType: 'HASH' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'attemptKey', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_AUDIT_TABLE || 'AuditLog',
+    KeySchema: [
+      { AttributeName: 'scope', KeyType: 'HASH' },
+      { AttributeName: 'entryId', KeyType: 'RANGE' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'scope', AttributeType: 'S' },
+      { AttributeName: 'entryId', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
+  {
+    TableName: process.env.DYNAMO_API_TOKENS_TABLE || 'APITokens',
+    KeySchema: [
+      { AttributeName: 'userId', KeyType: 'HASH' },
+      { AttributeName: 'tokenId', KeyType: 'RANGE' },
+    ],
+    AttributeDefinitions: [
+      { AttributeName: 'userId', AttributeType: 'S' },
+      { AttributeName: 'tokenId', AttributeType: 'S' },
+    ],
+    ProvisionedThroughput: {
+      ReadCapacityUnits: 1,
+      WriteCapacityUnits: 1,
+    },
+  },
 ];
 
 async function setupDynamoDB() {